@@ -2,12 +2,20 @@ package api
 
 import (
 	"bytes"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/bbbacsa/deploy.io/constants"
+	"github.com/bbbacsa/deploy.io/dialer"
+	"github.com/bbbacsa/deploy.io/trust"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"sync"
+	"time"
 )
 
 type Host struct {
@@ -17,14 +25,28 @@ type Host struct {
 	Size       int64
 	IPAddress  string `json:"ipv4_address"`
 	Port       int64
+	Region     string
+	Labels     map[string]string
 	ClientKey  string `json:"client_key"`
 	ClientCert string `json:"client_cert"`
+	CACert     string `json:"ca_cert"`
 }
 
 type HTTPClient struct {
 	BaseURL  string
 	Username string
 	Key    string
+
+	// InsecureAPI allows talking to the API over plain HTTP, which sends
+	// passwords and API keys in the clear. It's set by the --insecure-api
+	// flag.
+	InsecureAPI bool
+
+	// The HTTP client is made the first time it's needed, and shared by
+	// every request after, so that connections to the API are reused.
+	once   sync.Once
+	client *http.Client
+	err    error
 }
 
 type AuthResponse struct {
@@ -35,7 +57,12 @@ type AuthResponse struct {
 }
 
 func (client *HTTPClient) GetAuthKey(username string, password string) (string, string, error) {
-	resp, err := http.PostForm(client.BaseURL+"/login",
+	cl, err := client.httpClient()
+	if err != nil {
+		return "", "", err
+	}
+
+	resp, err := cl.PostForm(client.BaseURL+"/login",
 		url.Values{"username": {username}, "password": {password}})
 
 	if err != nil {
@@ -66,6 +93,32 @@ func (client *HTTPClient) GetHosts() ([]*Host, error) {
 	return hosts.Data, nil
 }
 
+// ErrNotModified is returned by GetHostsIfNoneMatch when the hosts haven't
+// changed.
+var ErrNotModified = errors.New("Not modified")
+
+// GetHostsIfNoneMatch is like GetHosts, but returns ErrNotModified if the
+// hosts' ETag is still etag. Otherwise, it returns their new ETag too, which
+// is empty if the API didn't send one.
+func (client *HTTPClient) GetHostsIfNoneMatch(etag string) ([]*Host, string, error) {
+	req, err := http.NewRequest("GET", client.BaseURL+"/hosts", nil)
+	if err != nil {
+		return nil, "", err
+	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+
+	var hosts struct {
+		Data []*Host
+	}
+	resp, err := client.doRequest(req, &hosts)
+	if err != nil {
+		return nil, "", err
+	}
+	return hosts.Data, resp.Header.Get("ETag"), nil
+}
+
 func (client *HTTPClient) GetHost(name string) (*Host, error) {
 	req, err := http.NewRequest("GET", client.BaseURL+"/hosts/"+name, nil)
 	if err != nil {
@@ -78,11 +131,22 @@ func (client *HTTPClient) GetHost(name string) (*Host, error) {
 	return &host, nil
 }
 
+// HostSpec is what a host is created with.
+type HostSpec struct {
+	Name string `json:"name"`
+	// Size is how much RAM the host has, in MB.
+	Size int `json:"size"`
+	// Region is where the host runs. If it's empty, the API chooses.
+	Region string            `json:"region,omitempty"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
 func (client *HTTPClient) CreateHost(name string, ramInMB int) (*Host, error) {
-	v := make(map[string]interface{})
-	v["name"] = name
-	v["size"] = ramInMB
-	body, err := json.Marshal(v)
+	return client.CreateHostFromSpec(HostSpec{Name: name, Size: ramInMB})
+}
+
+func (client *HTTPClient) CreateHostFromSpec(spec HostSpec) (*Host, error) {
+	body, err := json.Marshal(spec)
 	if err != nil {
 		return nil, err
 	}
@@ -99,6 +163,44 @@ func (client *HTTPClient) CreateHost(name string, ramInMB int) (*Host, error) {
 	return &host, nil
 }
 
+// ResizeHost changes how much RAM a host has, in MB.
+func (client *HTTPClient) ResizeHost(name string, ramInMB int) (*Host, error) {
+	body, err := json.Marshal(map[string]int{"size": ramInMB})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("PATCH", client.BaseURL+"/hosts/"+name, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	var host Host
+	if err := client.DoRequest(req, &host); err != nil {
+		return nil, err
+	}
+	return &host, nil
+}
+
+// SetHostLabels replaces all of a host's labels.
+func (client *HTTPClient) SetHostLabels(name string, labels map[string]string) (*Host, error) {
+	body, err := json.Marshal(map[string]map[string]string{"labels": labels})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("PATCH", client.BaseURL+"/hosts/"+name, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	var host Host
+	if err := client.DoRequest(req, &host); err != nil {
+		return nil, err
+	}
+	return &host, nil
+}
+
 func (client *HTTPClient) DeleteHost(id string) error {
 	req, err := http.NewRequest("DELETE", client.BaseURL+"/hosts/"+id, nil)
 	if err != nil {
@@ -111,19 +213,173 @@ func (client *HTTPClient) DeleteHost(id string) error {
 	return nil
 }
 
+// SignCertificateRequest asks the API to sign a PEM encoded certificate
+// request for a host, and returns the PEM encoded client certificate.
+func (client *HTTPClient) SignCertificateRequest(hostName string, csrPEM []byte) (string, error) {
+	body, err := json.Marshal(map[string]string{"csr": string(csrPEM)})
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequest("POST", client.BaseURL+"/hosts/"+hostName+"/certs", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+
+	var cert struct {
+		ClientCert string `json:"client_cert"`
+	}
+	if err := client.DoRequest(req, &cert); err != nil {
+		return "", err
+	}
+	if cert.ClientCert == "" {
+		return "", fmt.Errorf("The Deploy.IO API didn't return a certificate")
+	}
+	return cert.ClientCert, nil
+}
+
+// RotateCertificates asks the API to reissue a host's client certificates,
+// revoking the old ones. If csrPEM is nil, the API generates the key as
+// well, and returns both; otherwise, it signs csrPEM and key is empty.
+func (client *HTTPClient) RotateCertificates(hostName string, csrPEM []byte) (cert string, key string, err error) {
+	v := make(map[string]interface{})
+	if csrPEM != nil {
+		v["csr"] = string(csrPEM)
+	}
+	body, err := json.Marshal(v)
+	if err != nil {
+		return "", "", err
+	}
+
+	req, err := http.NewRequest("POST", client.BaseURL+"/hosts/"+hostName+"/certs/rotate", bytes.NewReader(body))
+	if err != nil {
+		return "", "", err
+	}
+
+	var certs struct {
+		ClientCert string `json:"client_cert"`
+		ClientKey  string `json:"client_key"`
+	}
+	if err := client.DoRequest(req, &certs); err != nil {
+		return "", "", err
+	}
+	if certs.ClientCert == "" {
+		return "", "", fmt.Errorf("The Deploy.IO API didn't return a certificate")
+	}
+	return certs.ClientCert, certs.ClientKey, nil
+}
+
 func (client *HTTPClient) DoRequest(req *http.Request, v interface{}) error {
-	cl := &http.Client{}
+	_, err := client.doRequest(req, v)
+	return err
+}
+
+func (client *HTTPClient) doRequest(req *http.Request, v interface{}) (*http.Response, error) {
+	cl, err := client.httpClient()
+	if err != nil {
+		return nil, err
+	}
 	req.SetBasicAuth(client.Username, client.Key)
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("User-Agent", fmt.Sprintf("deploy.io/%s", constants.Version))
 	resp, err := cl.Do(req)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotModified {
+		resp.Body.Close()
+		return resp, ErrNotModified
 	}
 	if err := DecodeResponse(resp, v); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// IsUnreachable returns true if err means the API couldn't be reached at
+// all, rather than that it returned an error. Only failing to connect, and
+// timing out, count: a certificate that doesn't verify, or a redirect that's
+// refused, is an error like any other.
+func IsUnreachable(err error) bool {
+	urlErr, ok := err.(*url.Error)
+	if !ok {
+		return false
+	}
+	if netErr, ok := urlErr.Err.(net.Error); ok && netErr.Timeout() {
+		return true
+	}
+	opErr, ok := urlErr.Err.(*net.OpError)
+	return ok && opErr.Op == "dial"
+}
+
+// CheckBaseURL returns an error if credentials shouldn't be sent to baseURL:
+// if it isn't HTTPS, unless insecure is set.
+func CheckBaseURL(baseURL string, insecure bool) error {
+	u, err := url.Parse(baseURL)
+	if err != nil {
 		return err
 	}
-	return nil
+	switch {
+	case u.Scheme == "https":
+		return nil
+	case u.Scheme == "http" && insecure:
+		return nil
+	case u.Scheme == "http":
+		return fmt.Errorf("Refusing to send credentials to %s over plain HTTP.\nUse an https:// URL, or pass --insecure-api if you really mean it.", baseURL)
+	}
+	return fmt.Errorf("The Deploy.IO API URL has to start with https://, but it's %s", baseURL)
+}
+
+// httpClient returns the HTTP client requests to the API are made with.
+func (client *HTTPClient) httpClient() (*http.Client, error) {
+	client.once.Do(func() {
+		client.client, client.err = newHTTPClient(client.BaseURL, client.InsecureAPI)
+	})
+	return client.client, client.err
+}
+
+// newHTTPClient returns an HTTP client for the API at baseURL, which reaches
+// it through the egress proxy configured in the environment, if any, and
+// trusts the CAs in trust.ForAPI. If DEPLOY_API_CLIENT_CERT and
+// DEPLOY_API_CLIENT_KEY are set, it presents that client certificate too.
+func newHTTPClient(baseURL string, insecure bool) (*http.Client, error) {
+	if err := CheckBaseURL(baseURL, insecure); err != nil {
+		return nil, err
+	}
+
+	d, err := dialer.FromEnvironment()
+	if err != nil {
+		return nil, err
+	}
+	bundle, err := trust.ForAPI()
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{RootCAs: bundle.Pool()}
+
+	certFile, keyFile := os.Getenv("DEPLOY_API_CLIENT_CERT"), os.Getenv("DEPLOY_API_CLIENT_KEY")
+	if certFile != "" || keyFile != "" {
+		if certFile == "" || keyFile == "" {
+			return nil, fmt.Errorf("DEPLOY_API_CLIENT_CERT and DEPLOY_API_CLIENT_KEY have to be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return &http.Client{
+		Transport: &http.Transport{Dial: d.Dial, TLSClientConfig: config, IdleConnTimeout: 90 * time.Second},
+		// A redirect mustn't take our credentials somewhere CheckBaseURL
+		// wouldn't.
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return fmt.Errorf("Stopped after 10 redirects")
+			}
+			return CheckBaseURL(req.URL.String(), insecure)
+		},
+	}, nil
 }
 
 func DecodeResponse(resp *http.Response, v interface{}) error {
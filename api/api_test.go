@@ -1,112 +1,299 @@
 package api
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
 	"encoding/json"
-	"fmt"
-	"io/ioutil"
-	"net/http"
-	"net/http/httptest"
+	"encoding/pem"
+	"github.com/bbbacsa/deploy.io/api/apitest"
+	"strings"
 	"testing"
+	"time"
 )
 
-func TestGetHosts(t *testing.T) {
-	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.URL.Path != "/hosts" {
-			t.Errorf("expected HTTP request to /hosts, got %s", r.URL.Path)
-		}
+// newTestClient starts a fake API with one user, returning the server and a
+// client logged in as them.
+func newTestClient(t *testing.T) (*apitest.Server, *HTTPClient, func()) {
+	server := apitest.NewServer()
+	server.SetEnv(t)
+	key := server.AddUser("bfirsh", "secret")
+
+	return server, &HTTPClient{BaseURL: server.URL, Username: "bfirsh", Key: key}, server.Close
+}
 
-		fmt.Fprintln(w, `[
-      {
-        "id": "14dff6d8-3b9a-41be-9ffd-d0d054a17492",
-        "url": "http://dummy/hosts/default_bfirsh",
-        "name": "default_bfirsh"
-      }
-    ]`)
-	}))
-	defer ts.Close()
+func TestGetAuthKey(t *testing.T) {
+	server, client, cleanup := newTestClient(t)
+	defer cleanup()
 
-	client := HTTPClient{ts.URL, "dummy_key"}
+	username, key, err := client.GetAuthKey("bfirsh", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if username != "bfirsh" || key != client.Key {
+		t.Errorf("expected bfirsh's key, got %q, %q", username, key)
+	}
+
+	if _, _, err := client.GetAuthKey("bfirsh", "wrong"); err == nil {
+		t.Error("expected a wrong password to be refused")
+	}
+
+	requests := server.Requests()
+	if len(requests) != 2 || requests[0].Method != "POST" || requests[0].Path != "/login" {
+		t.Errorf("expected two POST requests to /login, got %v", requests)
+	}
+}
+
+func TestGetHosts(t *testing.T) {
+	server, client, cleanup := newTestClient(t)
+	defer cleanup()
+
+	server.AddHost("bfirsh", "default", 512)
+	server.AddUser("someone_else", "secret")
+	server.AddHost("someone_else", "theirs", 512)
 
 	hosts, err := client.GetHosts()
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
 	if len(hosts) != 1 {
-		t.Errorf("expected 1 element, got %d (hosts: %v)", len(hosts), hosts)
+		t.Fatalf("expected 1 element, got %d (hosts: %v)", len(hosts), hosts)
 	}
-	if hosts[0].Name != "default_bfirsh" {
-		t.Errorf("expected default_bfirsh, got %s (hosts: %v)", hosts[0].Name, hosts)
+	if hosts[0].Name != "default" {
+		t.Errorf("expected default, got %s (hosts: %v)", hosts[0].Name, hosts)
+	}
+	if hosts[0].Port != 2376 || hosts[0].IPAddress == "" || hosts[0].ClientCert == "" {
+		t.Errorf("expected the host's address and certificate, got %+v", hosts[0])
+	}
+
+	if requests := server.Requests(); requests[0].Username != "bfirsh" {
+		t.Errorf("expected the request to be made as bfirsh, got %q", requests[0].Username)
 	}
 }
 
 func TestCreateHost(t *testing.T) {
-	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.URL.Path != "/hosts" {
-			t.Errorf("expected HTTP request to /hosts, got %s", r.URL.Path)
-		}
+	server, client, cleanup := newTestClient(t)
+	defer cleanup()
 
-		if r.Header.Get("Content-Type") != "application/json" {
-			t.Errorf("expected application/json, got %s", r.Header.Get("Content-Type"))
-		}
+	host, err := client.CreateHost("newhost", 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if host.Name != "newhost" || host.Size != 512 {
+		t.Errorf("expected a 512MB host named 'newhost', got %+v", host)
+	}
+	if _, ok := server.Host("bfirsh", "newhost"); !ok {
+		t.Error("expected the host to be created")
+	}
+
+	requests := server.Requests()
+	var data map[string]interface{}
+	if err := json.Unmarshal(requests[0].Body, &data); err != nil {
+		t.Fatal(err)
+	}
+	if data["name"] != "newhost" || data["size"] != float64(512) {
+		t.Errorf("expected name 'newhost' and size 512, got %v", data)
+	}
+}
 
-		body, _ := ioutil.ReadAll(r.Body)
-		var data map[string]interface{}
-		json.Unmarshal(body, &data)
+func TestCreateHostErrors(t *testing.T) {
+	server, client, cleanup := newTestClient(t)
+	defer cleanup()
 
-		if data["name"] != "newhost" {
-			t.Errorf("expected 'newhost', got '%s'", data["name"])
-		}
+	server.AddHost("bfirsh", "default", 512)
 
-		if int(data["size"].(float64)) != 512 {
-			t.Errorf("expected 512, got %#v", data["size"])
+	tests := []struct {
+		name     string
+		size     int
+		expected string
+	}{
+		{"default", 512, "already exists"},
+		{"Not-Valid", 512, "Invalid value"},
+		{"newhost", 3, "Unsupported size"},
+	}
+	for _, test := range tests {
+		_, err := client.CreateHost(test.name, test.size)
+		if err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Errorf("%s, %d: expected an error containing %q, got %v", test.name, test.size, test.expected, err)
 		}
+	}
+}
 
-		w.WriteHeader(201)
-		fmt.Fprintln(w, `{
-      "id": "14dff6d8-3b9a-41be-9ffd-d0d054a17492",
-      "url": "http://dummy/hosts/newhost",
-      "name": "newhost"
-    }`)
-	}))
+func TestGetHost(t *testing.T) {
+	server, client, cleanup := newTestClient(t)
+	defer cleanup()
 
-	client := HTTPClient{ts.URL, "dummy_key"}
+	created := server.AddHost("bfirsh", "myhost", 1024)
 
-	host, err := client.CreateHost("newhost", 512)
+	host, err := client.GetHost("myhost")
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
+	}
+	if host.ID != created.ID || host.CACert != string(server.CA.PEM) {
+		t.Errorf("expected %+v, got %+v", created, host)
 	}
-	if host.Name != "newhost" {
-		t.Errorf("expected 'newhost', got '%s' (host: %v)", host.Name, host)
+
+	_, err = client.GetHost("nothere")
+	if err == nil || !strings.Contains(err.Error(), "Not found") {
+		t.Errorf("expected a Not found error, got %v", err)
 	}
 }
 
 func TestDeleteHost(t *testing.T) {
-	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != "DELETE" || r.URL.Path != "/hosts/myhost" {
-			t.Errorf("expected DELETE request to /hosts/myhost, got %s request to %s", r.Method, r.URL.Path)
-		}
+	server, client, cleanup := newTestClient(t)
+	defer cleanup()
+
+	server.AddHost("bfirsh", "myhost", 512)
+
+	if err := client.DeleteHost("myhost"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := server.Host("bfirsh", "myhost"); ok {
+		t.Error("expected the host to be deleted")
+	}
 
-		fmt.Fprintln(w, "")
-	}))
+	requests := server.Requests()
+	if requests[0].Method != "DELETE" || requests[0].Path != "/hosts/myhost" {
+		t.Errorf("expected DELETE request to /hosts/myhost, got %s request to %s", requests[0].Method, requests[0].Path)
+	}
+}
+
+func TestDeleteHostError(t *testing.T) {
+	server, client, cleanup := newTestClient(t)
+	defer cleanup()
 
-	client := HTTPClient{ts.URL, "dummy_key"}
+	server.AddHost("bfirsh", "myhost", 512)
+	server.Fail("DELETE", "/hosts/myhost", 500, "I broke :(")
 
 	err := client.DeleteHost("myhost")
+	if err == nil || !strings.Contains(err.Error(), "I broke :(") {
+		t.Errorf("expected DeleteHost() to return the server's error, got %v", err)
+	}
+	if _, ok := server.Host("bfirsh", "myhost"); !ok {
+		t.Error("expected the host not to be deleted")
+	}
+
+	if err := client.DeleteHost("myhost"); err != nil {
+		t.Errorf("expected only one request to fail, got %v", err)
+	}
+}
+
+func TestInvalidKey(t *testing.T) {
+	_, client, cleanup := newTestClient(t)
+	defer cleanup()
+
+	client.Key = "wrong"
+	if _, err := client.GetHosts(); err == nil {
+		t.Error("expected a wrong API key to be refused")
+	}
+}
+
+func TestLatency(t *testing.T) {
+	server, client, cleanup := newTestClient(t)
+	defer cleanup()
+
+	server.SetLatency(50 * time.Millisecond)
+	start := time.Now()
+	if _, err := client.GetHosts(); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("expected the request to take at least 50ms, took %s", elapsed)
+	}
+}
+
+func TestSignAndRotateCertificates(t *testing.T) {
+	server, client, cleanup := newTestClient(t)
+	defer cleanup()
+
+	host := server.AddHost("bfirsh", "myhost", 512)
+	original := parseTestCertificate(t, host.ClientCert)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csrPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})
+
+	certPEM, err := client.SignCertificateRequest("myhost", csrPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := parseTestCertificate(t, certPEM)
+	if !server.IsClientCertValid(host.ID, signed) || !server.IsClientCertValid(host.ID, original) {
+		t.Error("expected both certificates to be valid")
+	}
+
+	certPEM, keyPEM, err := client.RotateCertificates("myhost", nil)
 	if err != nil {
+		t.Fatal(err)
+	}
+	if keyPEM == "" {
+		t.Error("expected a new key")
+	}
+	if !server.IsClientCertValid(host.ID, parseTestCertificate(t, certPEM)) {
+		t.Error("expected the new certificate to be valid")
+	}
+	if server.IsClientCertValid(host.ID, signed) || server.IsClientCertValid(host.ID, original) {
+		t.Error("expected the old certificates to be revoked")
+	}
+
+	if _, err := client.SignCertificateRequest("myhost", []byte("not a CSR")); err == nil || !strings.Contains(err.Error(), "Invalid value") {
+		t.Errorf("expected an invalid CSR to be refused, got %v", err)
+	}
+}
+
+func TestCheckBaseURL(t *testing.T) {
+	if err := CheckBaseURL("https://api.deploy.io", false); err != nil {
+		t.Error(err)
+	}
+	if err := CheckBaseURL("http://api.deploy.io", false); err == nil {
+		t.Error("expected plain HTTP to be refused")
+	}
+	if err := CheckBaseURL("ftp://api.deploy.io", false); err == nil {
+		t.Error("expected FTP to be refused")
+	}
+
+	client := &HTTPClient{BaseURL: "http://127.0.0.1:1", Username: "bfirsh", Key: "key"}
+	if _, _, err := client.GetAuthKey("bfirsh", "secret"); err == nil || !strings.Contains(err.Error(), "--insecure-api") {
+		t.Errorf("expected the password not to be sent, got %v", err)
+	}
+
+	if err := CheckBaseURL("http://api.deploy.io", true); err != nil {
 		t.Error(err)
 	}
 }
 
-func TestDeleteHostError(t *testing.T) {
-	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(500)
-		fmt.Fprintln(w, "I broke :(")
-	}))
+func parseTestCertificate(t *testing.T, certPEM string) *x509.Certificate {
+	block, _ := pem.Decode([]byte(certPEM))
+	if block == nil {
+		t.Fatalf("expected a PEM encoded certificate, got %q", certPEM)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
 
-	client := HTTPClient{ts.URL, "dummy_key"}
+func TestHTTPClientIsShared(t *testing.T) {
+	_, client, cleanup := newTestClient(t)
+	defer cleanup()
 
-	err := client.DeleteHost("myhost")
-	if err == nil {
-		t.Error("expected DeleteHost() to return an error")
+	first, err := client.httpClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := client.httpClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != second {
+		t.Error("expected every request to share one http.Client")
 	}
 }
@@ -0,0 +1,598 @@
+// Package apitest provides an in-memory Deploy.IO API server for tests.
+//
+// It keeps users and hosts in memory, signs client certificates with its own
+// CA, and returns errors the way the real server does: a JSON object with a
+// "detail" message, which the CLI looks for phrases like "Not found" and
+// "already exists" in. It sends an ETag with the list of hosts. Tests can
+// slow it down, make requests fail or the whole server unreachable, and see
+// every request it got.
+package apitest
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"github.com/bbbacsa/deploy.io/dockertest"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Host is a host as the API returns it.
+type Host struct {
+	ID         string            `json:"_id"`
+	Name       string            `json:"name"`
+	URL        string            `json:"url"`
+	Size       int               `json:"size"`
+	IPAddress  string            `json:"ipv4_address"`
+	Port       int               `json:"port"`
+	Region     string            `json:"region"`
+	Labels     map[string]string `json:"labels"`
+	ClientKey  string            `json:"client_key"`
+	ClientCert string            `json:"client_cert"`
+	CACert     string            `json:"ca_cert"`
+
+	owner string
+	// serials are the serial numbers of the client certificates that
+	// haven't been revoked.
+	serials map[string]bool
+}
+
+// Request is a request the server got.
+type Request struct {
+	Method   string
+	Path     string
+	Username string
+	Header   http.Header
+	Body     []byte
+}
+
+type failure struct {
+	method string
+	path   string
+	status int
+	detail string
+}
+
+// ValidSizes are the sizes of host, in MB of RAM, that can be created.
+var ValidSizes = []int{512, 1024, 2048, 4096, 8192}
+
+// ValidRegions are the regions hosts can be created in. The first is the
+// default.
+var ValidRegions = []string{"nyc1", "sfo1", "ams1"}
+
+var validHostName = regexp.MustCompile(`^[a-z0-9_]+$`)
+
+// Server is a fake Deploy.IO API, served over HTTPS.
+type Server struct {
+	*httptest.Server
+
+	// CA signs the certificates of hosts and their clients. Hosts' ca_cert
+	// is set to its PEM encoding.
+	CA *dockertest.CA
+
+	mu          sync.Mutex
+	latency     time.Duration
+	unreachable bool
+	passwords   map[string]string
+	keys        map[string]string
+	hosts       map[string]*Host
+	failures    []failure
+	requests    []Request
+	nextID      int
+	nextIP      int
+
+	tempDir string
+}
+
+// NewServer starts a server with no users or hosts. Close it when you're
+// done.
+func NewServer() *Server {
+	s := &Server{
+		passwords: make(map[string]string),
+		keys:      make(map[string]string),
+		hosts:     make(map[string]*Host),
+	}
+	ca, err := dockertest.NewCA("apitest CA")
+	if err != nil {
+		panic(err)
+	}
+	s.CA = ca
+	s.Server = httptest.NewTLSServer(s)
+	return s
+}
+
+// Close shuts the server down, and removes anything SetEnv wrote.
+func (s *Server) Close() {
+	s.Server.Close()
+	if s.tempDir != "" {
+		os.RemoveAll(s.tempDir)
+	}
+}
+
+// SetEnv points deploy at the server for the rest of test t: DEPLOY_API_URL
+// is set to its URL, its certificate is added to DEPLOY_CA_BUNDLE, and
+// DEPLOY_EGRESS_PROXY is set so that it's connected to directly.
+func (s *Server) SetEnv(t *testing.T) {
+	if s.tempDir == "" {
+		dir, err := ioutil.TempDir("", "deploy-apitest")
+		if err != nil {
+			t.Fatal(err)
+		}
+		certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.Certificate().Raw})
+		if err := ioutil.WriteFile(path.Join(dir, "api.pem"), certPEM, 0600); err != nil {
+			t.Fatal(err)
+		}
+		s.tempDir = dir
+	}
+
+	t.Setenv("DEPLOY_API_URL", s.URL)
+	t.Setenv("DEPLOY_CA_BUNDLE", path.Join(s.tempDir, "api.pem"))
+	t.Setenv("DEPLOY_EGRESS_PROXY", "direct")
+}
+
+// AddUser adds a user, returning their API key.
+func (s *Server) AddUser(username, password string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := randomHex(20)
+	s.passwords[username] = password
+	s.keys[username] = key
+	return key
+}
+
+// AddHost adds a host for a user, as if they'd created it, and returns a
+// copy of it.
+func (s *Server) AddHost(username, name string, size int) Host {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return *s.createHost(username, name, size, ValidRegions[0])
+}
+
+// Host returns a copy of a user's host, found by name or ID.
+func (s *Server) Host(username, nameOrID string) (Host, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	host := s.findHost(username, nameOrID)
+	if host == nil {
+		return Host{}, false
+	}
+	return *host, true
+}
+
+// SetHostAddress points a user's host at addr, the "IP:port" of a daemon
+// such as one from dockertest.
+func (s *Server) SetHostAddress(username, nameOrID, addr string) error {
+	ip, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	portNumber, err := strconv.Atoi(port)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	host := s.findHost(username, nameOrID)
+	if host == nil {
+		return fmt.Errorf("apitest: no host %q", nameOrID)
+	}
+	host.IPAddress = ip
+	host.Port = portNumber
+	host.URL = "tcp://" + addr
+	return nil
+}
+
+// IsClientCertValid returns whether cert was issued for a host by the
+// server, and hasn't been revoked.
+func (s *Server) IsClientCertValid(hostID string, cert *x509.Certificate) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, host := range s.hosts {
+		if host.ID == hostID {
+			return host.serials[cert.SerialNumber.String()] && cert.CheckSignatureFrom(s.CA.Cert) == nil
+		}
+	}
+	return false
+}
+
+// SetLatency makes the server wait before handling each request.
+func (s *Server) SetLatency(latency time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.latency = latency
+}
+
+// SetUnreachable makes the server stop listening and drop every connection,
+// as if it were down, or start listening again at the same address.
+func (s *Server) SetUnreachable(unreachable bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if unreachable == s.unreachable {
+		return
+	}
+	s.unreachable = unreachable
+
+	if unreachable {
+		s.Listener.Close()
+		s.CloseClientConnections()
+		return
+	}
+	l, err := net.Listen("tcp", s.Listener.Addr().String())
+	if err != nil {
+		panic(fmt.Sprintf("apitest: couldn't listen again: %s", err))
+	}
+	s.Listener = tls.NewListener(l, s.TLS)
+	go s.Config.Serve(s.Listener)
+}
+
+// Fail makes the next request with the given method and path fail, with the
+// given status and detail message. An empty method matches any method.
+func (s *Server) Fail(method, path string, status int, detail string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures = append(s.failures, failure{method, path, status, detail})
+}
+
+// Requests returns every request the server has got, in order.
+func (s *Server) Requests() []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Request(nil), s.requests...)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	latency := s.latency
+	s.mu.Unlock()
+	time.Sleep(latency)
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	username, key, _ := r.BasicAuth()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.requests = append(s.requests, Request{Method: r.Method, Path: r.URL.Path, Username: username, Header: r.Header, Body: body})
+
+	for i, f := range s.failures {
+		if (f.method == "" || f.method == r.Method) && f.path == r.URL.Path {
+			s.failures = append(s.failures[:i], s.failures[i+1:]...)
+			writeError(w, f.status, f.detail)
+			return
+		}
+	}
+
+	if r.URL.Path == "/login" && r.Method == "POST" {
+		s.login(w, body)
+		return
+	}
+
+	// DEPLOY_API_KEY gives the CLI a key without a username.
+	if username == "" {
+		for user, userKey := range s.keys {
+			if key == userKey {
+				username = user
+			}
+		}
+	}
+	if expected, ok := s.keys[username]; !ok || key != expected {
+		writeError(w, http.StatusUnauthorized, "Invalid API key.")
+		return
+	}
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case len(parts) == 1 && parts[0] == "hosts" && r.Method == "GET":
+		s.listHosts(w, r, username)
+	case len(parts) == 1 && parts[0] == "hosts" && r.Method == "POST":
+		s.postHost(w, username, body)
+	case len(parts) == 2 && parts[0] == "hosts" && r.Method == "GET":
+		if host := s.findHost(username, parts[1]); host != nil {
+			writeJSON(w, http.StatusOK, host)
+		} else {
+			writeError(w, http.StatusNotFound, "Not found")
+		}
+	case len(parts) == 2 && parts[0] == "hosts" && r.Method == "PATCH":
+		s.patchHost(w, username, parts[1], body)
+	case len(parts) == 2 && parts[0] == "hosts" && r.Method == "DELETE":
+		if host := s.findHost(username, parts[1]); host != nil {
+			delete(s.hosts, host.ID)
+			w.WriteHeader(http.StatusNoContent)
+		} else {
+			writeError(w, http.StatusNotFound, "Not found")
+		}
+	case len(parts) == 3 && parts[0] == "hosts" && parts[2] == "certs" && r.Method == "POST":
+		s.postCerts(w, username, parts[1], body, false)
+	case len(parts) == 4 && parts[0] == "hosts" && parts[2] == "certs" && parts[3] == "rotate" && r.Method == "POST":
+		s.postCerts(w, username, parts[1], body, true)
+	default:
+		writeError(w, http.StatusNotFound, "Not found")
+	}
+}
+
+func (s *Server) login(w http.ResponseWriter, body []byte) {
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Malformed form.")
+		return
+	}
+	username, password := form.Get("username"), form.Get("password")
+	expected, ok := s.passwords[username]
+	if !ok || password != expected {
+		writeError(w, http.StatusUnauthorized, "Invalid username or password.")
+		return
+	}
+
+	var response struct {
+		Session struct {
+			Username string `json:"username"`
+			Key      string `json:"key"`
+		} `json:"session"`
+	}
+	response.Session.Username = username
+	response.Session.Key = s.keys[username]
+	writeJSON(w, http.StatusOK, response)
+}
+
+// listHosts sends an ETag with the hosts, and just 304 Not Modified if it
+// matches If-None-Match.
+func (s *Server) listHosts(w http.ResponseWriter, r *http.Request, username string) {
+	hosts := []*Host{}
+	for _, host := range s.hosts {
+		if host.owner == username {
+			hosts = append(hosts, host)
+		}
+	}
+	sort.Sort(byName(hosts))
+	data, err := json.Marshal(map[string]interface{}{"data": hosts})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	etag := fmt.Sprintf(`"%x"`, sha256.Sum256(data))
+	w.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+func (s *Server) postHost(w http.ResponseWriter, username string, body []byte) {
+	var params struct {
+		Name   string
+		Size   int
+		Region string
+		Labels map[string]string
+	}
+	if err := json.Unmarshal(body, &params); err != nil {
+		writeError(w, http.StatusBadRequest, "Malformed JSON.")
+		return
+	}
+
+	if !validHostName.MatchString(params.Name) {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Invalid value for name: '%s'", params.Name))
+		return
+	}
+	if !isValidSize(params.Size) {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Unsupported size: %d", params.Size))
+		return
+	}
+	if params.Region == "" {
+		params.Region = ValidRegions[0]
+	}
+	validRegion := false
+	for _, region := range ValidRegions {
+		validRegion = validRegion || region == params.Region
+	}
+	if !validRegion {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Unsupported region: %s", params.Region))
+		return
+	}
+	if s.findHost(username, params.Name) != nil {
+		writeError(w, http.StatusConflict, fmt.Sprintf("A host named '%s' already exists.", params.Name))
+		return
+	}
+
+	host := s.createHost(username, params.Name, params.Size, params.Region)
+	if params.Labels != nil {
+		host.Labels = params.Labels
+	}
+	writeJSON(w, http.StatusCreated, host)
+}
+
+// patchHost resizes a host, or replaces its labels.
+func (s *Server) patchHost(w http.ResponseWriter, username, nameOrID string, body []byte) {
+	var params struct {
+		Size   *int
+		Labels map[string]string
+	}
+	if err := json.Unmarshal(body, &params); err != nil {
+		writeError(w, http.StatusBadRequest, "Malformed JSON.")
+		return
+	}
+	host := s.findHost(username, nameOrID)
+	if host == nil {
+		writeError(w, http.StatusNotFound, "Not found")
+		return
+	}
+	if params.Size != nil && !isValidSize(*params.Size) {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Unsupported size: %d", *params.Size))
+		return
+	}
+	if params.Size != nil {
+		host.Size = *params.Size
+	}
+	if params.Labels != nil {
+		host.Labels = params.Labels
+	}
+	writeJSON(w, http.StatusOK, host)
+}
+
+func isValidSize(size int) bool {
+	for _, validSize := range ValidSizes {
+		if size == validSize {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) postCerts(w http.ResponseWriter, username, nameOrID string, body []byte, rotate bool) {
+	host := s.findHost(username, nameOrID)
+	if host == nil {
+		writeError(w, http.StatusNotFound, "Not found")
+		return
+	}
+
+	var params struct {
+		CSR string
+	}
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &params); err != nil {
+			writeError(w, http.StatusBadRequest, "Malformed JSON.")
+			return
+		}
+	}
+
+	var csr *x509.CertificateRequest
+	if params.CSR != "" || !rotate {
+		block, _ := pem.Decode([]byte(params.CSR))
+		if block == nil || block.Type != "CERTIFICATE REQUEST" {
+			writeError(w, http.StatusBadRequest, "Invalid value for csr: expected a PEM encoded certificate request.")
+			return
+		}
+		var err error
+		csr, err = x509.ParseCertificateRequest(block.Bytes)
+		if err == nil {
+			err = csr.CheckSignature()
+		}
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("Invalid value for csr: %s", err))
+			return
+		}
+	}
+
+	if rotate {
+		host.serials = make(map[string]bool)
+	}
+
+	response := make(map[string]string)
+	if csr != nil {
+		response["client_cert"] = string(s.issueClientCert(host, csr.PublicKey))
+	} else {
+		s.issueClientKey(host)
+		response["client_cert"] = host.ClientCert
+		response["client_key"] = host.ClientKey
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// createHost must be called with s.mu held.
+func (s *Server) createHost(username, name string, size int, region string) *Host {
+	s.nextID++
+	s.nextIP++
+	host := &Host{
+		ID:        fmt.Sprintf("%024x", s.nextID),
+		Name:      name,
+		URL:       fmt.Sprintf("%s/hosts/%s", s.URL, name),
+		Size:      size,
+		IPAddress: fmt.Sprintf("10.0.%d.%d", s.nextIP/256, s.nextIP%256),
+		Port:      2376,
+		Region:    region,
+		Labels:    map[string]string{},
+		CACert:    string(s.CA.PEM),
+		owner:     username,
+		serials:   make(map[string]bool),
+	}
+	s.issueClientKey(host)
+	s.hosts[host.ID] = host
+	return host
+}
+
+// findHost must be called with s.mu held.
+func (s *Server) findHost(username, nameOrID string) *Host {
+	for _, host := range s.hosts {
+		if host.owner == username && (host.ID == nameOrID || host.Name == nameOrID) {
+			return host
+		}
+	}
+	return nil
+}
+
+// issueClientKey generates a new client key for host, as the real server
+// does, and issues a certificate for it.
+func (s *Server) issueClientKey(host *Host) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		panic(err)
+	}
+	host.ClientKey = string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}))
+	host.ClientCert = string(s.issueClientCert(host, &key.PublicKey))
+}
+
+// issueClientCert returns a PEM encoded client certificate for host's public
+// key pub, signed by the CA.
+func (s *Server) issueClientCert(host *Host, pub crypto.PublicKey) []byte {
+	cert, err := s.CA.SignClient(host.Name, pub)
+	if err != nil {
+		panic(err)
+	}
+	host.serials[cert.SerialNumber.String()] = true
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, detail string) {
+	writeJSON(w, status, map[string]string{"detail": detail})
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+type byName []*Host
+
+func (h byName) Len() int           { return len(h) }
+func (h byName) Less(i, j int) bool { return h[i].Name < h[j].Name }
+func (h byName) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
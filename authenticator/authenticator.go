@@ -13,6 +13,10 @@ import (
 	"errors"
 )
 
+// ErrNotLoggedIn is returned when there's no key for the API and the user
+// mustn't be asked to log in.
+var ErrNotLoggedIn = errors.New("Not logged in")
+
 type PyString string
 
 func (py PyString) Split(str string) ( string, string , error ) {
@@ -23,16 +27,47 @@ func (py PyString) Split(str string) ( string, string , error ) {
     return s[0] , s[1] , nil
 }
 
-func Authenticate() (*api.HTTPClient, error) {
-	httpClient := api.HTTPClient{GetAPIURL(), "", ""}
-	err := PopulateKey(&httpClient)
+// Options says how to authenticate with the API.
+type Options struct {
+	// In and Out are where the user is asked to log in.
+	In  io.Reader
+	Out io.Writer
+
+	// NoPrompt makes authenticating return ErrNotLoggedIn instead of asking
+	// the user to log in.
+	NoPrompt bool
+
+	// InsecureAPI allows talking to the API over plain HTTP.
+	InsecureAPI bool
+}
+
+func Authenticate(options *Options) (*api.HTTPClient, error) {
+	return authenticateURL(GetAPIURL(), options)
+}
+
+// AuthenticateContext is like Authenticate, but talks to the API at apiURL,
+// unless it's empty. Its key is kept with the others in GetKeyDir.
+func AuthenticateContext(apiURL string, options *Options) (*api.HTTPClient, error) {
+	if apiURL == "" {
+		apiURL = GetAPIURL()
+	}
+	return authenticateURL(apiURL, options)
+}
+
+func authenticateURL(apiURL string, options *Options) (*api.HTTPClient, error) {
+	httpClient := api.HTTPClient{BaseURL: apiURL, InsecureAPI: options.InsecureAPI}
+	// Find out before asking for a password that we won't send it.
+	if err := api.CheckBaseURL(httpClient.BaseURL, httpClient.InsecureAPI); err != nil {
+		return nil, err
+	}
+	err := PopulateKey(&httpClient, options)
 	if err != nil {
 		return nil, err
 	}
 	return &httpClient, nil
 }
 
-func PopulateKey(httpClient *api.HTTPClient) error {
+func PopulateKey(httpClient *api.HTTPClient, options *Options) error {
 	envVar := os.Getenv("DEPLOY_API_KEY")
 	if envVar != "" {
 		httpClient.Key = envVar
@@ -45,7 +80,10 @@ func PopulateKey(httpClient *api.HTTPClient) error {
 	}
 
 	if _, err := os.Stat(keyFile); os.IsNotExist(err) {
-		username, key, err := GetKeyByPromptingUser(*httpClient)
+		if options.NoPrompt {
+			return ErrNotLoggedIn
+		}
+		username, key, err := GetKeyByPromptingUser(httpClient, options)
 		if err != nil {
 			return err
 		}
@@ -70,7 +108,7 @@ func GetAPIURL() string {
 	apiURL := os.Getenv("DEPLOY_API_URL")
 
 	if apiURL == "" {
-		apiURL = "http://104.131.158.124:8001"
+		apiURL = "https://104.131.158.124:8001"
 	}
 
 	return apiURL
@@ -98,8 +136,8 @@ func GetKeyDir() (string, error) {
 	return keyDir, nil
 }
 
-func GetKeyByPromptingUser(httpClient api.HTTPClient) (string, string, error) {
-	username, password := Prompt()
+func GetKeyByPromptingUser(httpClient *api.HTTPClient, options *Options) (string, string, error) {
+	username, password := Prompt(options.In, options.Out)
 
 	username, key, err := httpClient.GetAuthKey(username, password)
 	if err != nil {
@@ -109,13 +147,13 @@ func GetKeyByPromptingUser(httpClient api.HTTPClient) (string, string, error) {
 	return username, key, nil
 }
 
-func Prompt() (string, string) {
+func Prompt(in io.Reader, out io.Writer) (string, string) {
 	var (
 		username string
 		password string
 	)
-	fmt.Print("Deploy username: ")
-	fmt.Scanln(&username)
-	password, _ = gopass.GetPass("Password: ")
+	fmt.Fprint(out, "Deploy username: ")
+	fmt.Fscanln(in, &username)
+	password, _ = gopass.GetPassTo(out, "Password: ")
 	return username, password
 }
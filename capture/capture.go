@@ -0,0 +1,203 @@
+// Package capture records the decrypted traffic a proxy forwards to a host's
+// Docker daemon, and replays it later as a fake daemon.
+//
+// A capture file is UTF-8 text with one JSON object per line. The first line
+// is a header:
+//
+//	{"format":"deploy-capture","version":1,"host":"default","started_at":"2014-11-10T05:23:59Z"}
+//
+// Every following line is an event on one of the forwarded connections:
+//
+//	{"conn":1,"t":1520000,"event":"open"}
+//	{"conn":1,"t":1730000,"event":"send","data":"R0VUIC92ZXJzaW9uIEhUVFAvMS4xDQo..."}
+//	{"conn":1,"t":9130000,"event":"recv","data":"SFRUUC8xLjEgMjAwIE9LDQo..."}
+//	{"conn":1,"t":9400000,"event":"close"}
+//
+// conn numbers connections in the order the proxy accepted them, starting
+// at 1. t is the time since started_at in nanoseconds. send events carry
+// bytes the local client sent to the host, recv events carry bytes the host
+// sent back, and data is base64-encoded (RFC 4648, with padding). Events are
+// in the order they happened, so the events of concurrent connections are
+// interleaved. A connection may have no close event if the capture was cut
+// short.
+//
+// Captures contain everything sent over the tunnel in the clear, including
+// any credentials passed to the Docker daemon, so they're written 0600.
+package capture
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	FormatName    = "deploy-capture"
+	FormatVersion = 1
+)
+
+type Header struct {
+	Format    string    `json:"format"`
+	Version   int       `json:"version"`
+	Host      string    `json:"host"`
+	StartedAt time.Time `json:"started_at"`
+}
+
+type Event struct {
+	Conn  int64         `json:"conn"`
+	T     time.Duration `json:"t"`
+	Event string        `json:"event"`
+	Data  []byte        `json:"data,omitempty"`
+}
+
+const (
+	EventOpen  = "open"
+	EventSend  = "send"
+	EventRecv  = "recv"
+	EventClose = "close"
+)
+
+// Recorder writes a capture file. It implements proxy.Tap.
+type Recorder struct {
+	mu      sync.Mutex
+	w       io.Writer
+	enc     *json.Encoder
+	started time.Time
+	err     error
+}
+
+// Create creates a capture file at filename, overwriting any existing file,
+// and writes its header.
+func Create(filename, host string) (*Recorder, io.Closer, error) {
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, nil, err
+	}
+	r, err := NewRecorder(f, host)
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return r, f, nil
+}
+
+func NewRecorder(w io.Writer, host string) (*Recorder, error) {
+	r := &Recorder{w: w, enc: json.NewEncoder(w), started: time.Now()}
+	header := Header{
+		Format:    FormatName,
+		Version:   FormatVersion,
+		Host:      host,
+		StartedAt: r.started.UTC(),
+	}
+	if err := r.enc.Encode(header); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *Recorder) Open(id int64) {
+	r.write(Event{Conn: id, Event: EventOpen})
+}
+
+func (r *Recorder) Data(id int64, fromClient bool, data []byte) {
+	event := EventRecv
+	if fromClient {
+		event = EventSend
+	}
+	r.write(Event{Conn: id, Event: event, Data: data})
+}
+
+func (r *Recorder) Close(id int64) {
+	r.write(Event{Conn: id, Event: EventClose})
+}
+
+// Err returns the first error encountered writing the capture, if any.
+// Recording stops after an error.
+func (r *Recorder) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.err
+}
+
+func (r *Recorder) write(event Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.err != nil {
+		return
+	}
+	event.T = time.Since(r.started)
+	r.err = r.enc.Encode(event)
+}
+
+// Connection is the traffic of one recorded connection.
+type Connection struct {
+	ID     int64
+	Sent   []byte
+	Recv   []byte
+	Events []Event
+}
+
+// Read parses a capture file, returning its header and its connections in
+// the order they were opened.
+func Read(r io.Reader) (*Header, []*Connection, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return nil, nil, err
+		}
+		return nil, nil, fmt.Errorf("Capture file is empty")
+	}
+
+	var header Header
+	if err := json.Unmarshal(scanner.Bytes(), &header); err != nil || header.Format != FormatName {
+		return nil, nil, fmt.Errorf("Not a capture file: expected a %q header on the first line", FormatName)
+	}
+	if header.Version != FormatVersion {
+		return nil, nil, fmt.Errorf("Unsupported capture format version %d (expected %d)", header.Version, FormatVersion)
+	}
+
+	byID := map[int64]*Connection{}
+	connections := []*Connection{}
+	line := 1
+	for scanner.Scan() {
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var event Event
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			return nil, nil, fmt.Errorf("Malformed event on line %d of capture file: %s", line, err)
+		}
+
+		conn, ok := byID[event.Conn]
+		if !ok {
+			conn = &Connection{ID: event.Conn}
+			byID[event.Conn] = conn
+			connections = append(connections, conn)
+		}
+		conn.Events = append(conn.Events, event)
+
+		switch event.Event {
+		case EventSend:
+			conn.Sent = append(conn.Sent, event.Data...)
+		case EventRecv:
+			conn.Recv = append(conn.Recv, event.Data...)
+		case EventOpen, EventClose:
+		default:
+			return nil, nil, fmt.Errorf("Unknown event %q on line %d of capture file", event.Event, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	return &header, connections, nil
+}
@@ -0,0 +1,172 @@
+package capture
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/bbbacsa/deploy.io/proxy"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func fakeDaemon() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1.15/version":
+			fmt.Fprint(w, `{"Version":"1.3.1"}`)
+		case "/v1.15/containers/abc/attach":
+			// Like Docker, hijack first and write the headers by hand.
+			conn, buf, _ := w.(http.Hijacker).Hijack()
+			buf.WriteString("HTTP/1.1 200 OK\r\nContent-Type: application/vnd.docker.raw-stream\r\n\r\n")
+			buf.WriteString("hello from the container\n")
+			buf.Flush()
+			conn.Close()
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+// record sends requests through a recording proxy to a fake daemon and
+// returns the capture.
+func record(t *testing.T, requests ...string) []byte {
+	daemon := fakeDaemon()
+	defer daemon.Close()
+
+	var capture bytes.Buffer
+	recorder, err := NewRecorder(&capture, "default")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := proxy.New(
+		func() (net.Listener, error) { return net.Listen("tcp", "127.0.0.1:0") },
+		func() (net.Conn, error) { return net.Dial("tcp", daemon.Listener.Addr().String()) },
+	)
+	p.Tap = recorder
+	go p.Start()
+	if err := <-p.ErrorChannel; err != nil {
+		t.Fatal(err)
+	}
+
+	for _, request := range requests {
+		conn, err := net.Dial("tcp", (*p.Listener).Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprint(conn, request)
+		ioutil.ReadAll(conn)
+		conn.Close()
+	}
+	// The proxy records a close event after the client's seen everything,
+	// so wait for the connections to finish.
+	for p.Active() > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	p.Stop()
+
+	if err := recorder.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return capture.Bytes()
+}
+
+func replay(t *testing.T, r *Replayer, request string) *http.Response {
+	client, server := net.Pipe()
+	go r.ServeConn(server)
+	defer client.Close()
+
+	go fmt.Fprint(client, request)
+	resp, err := http.ReadResponse(bufio.NewReader(client), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return resp
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	data := record(t,
+		"GET /v1.15/version HTTP/1.1\r\nHost: docker\r\nConnection: close\r\n\r\n",
+		"POST /v1.15/containers/abc/attach?stream=1&stdout=1 HTTP/1.1\r\nHost: docker\r\n\r\n",
+	)
+
+	header, connections, err := Read(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Host != "default" || header.Version != FormatVersion {
+		t.Errorf("unexpected header: %+v", header)
+	}
+	if len(connections) != 2 {
+		t.Fatalf("expected 2 connections, got %d", len(connections))
+	}
+	if !strings.HasPrefix(string(connections[0].Sent), "GET /v1.15/version") {
+		t.Errorf("expected the first connection to send GET /v1.15/version, got %q", connections[0].Sent)
+	}
+	events := connections[0].Events
+	if events[0].Event != EventOpen || events[len(events)-1].Event != EventClose {
+		t.Errorf("expected connection to be opened and closed, got %+v", events)
+	}
+
+	exchanges := Exchanges(connections)
+	if len(exchanges) != 2 {
+		t.Fatalf("expected 2 exchanges, got %d", len(exchanges))
+	}
+	if !exchanges[1].Hijacked {
+		t.Error("expected the attach request to be hijacked")
+	}
+
+	r := NewReplayer(exchanges)
+
+	resp := replay(t, r, "GET /v1.15/version HTTP/1.1\r\nHost: docker\r\n\r\n")
+	if body, _ := ioutil.ReadAll(resp.Body); string(body) != `{"Version":"1.3.1"}` {
+		t.Errorf("expected the recorded version, got %q", body)
+	}
+
+	resp = replay(t, r, "GET /v1.16/version HTTP/1.1\r\nHost: docker\r\n\r\n")
+	if resp.StatusCode != 200 {
+		t.Errorf("expected a request for another API version to match, got %d", resp.StatusCode)
+	}
+
+	resp = replay(t, r, "POST /v1.15/containers/abc/attach?stream=1&stdout=1 HTTP/1.1\r\nHost: docker\r\n\r\n")
+	if body, _ := ioutil.ReadAll(resp.Body); string(body) != "hello from the container\n" {
+		t.Errorf("expected the recorded stream, got %q", body)
+	}
+
+	resp = replay(t, r, "GET /v1.15/info HTTP/1.1\r\nHost: docker\r\n\r\n")
+	if resp.StatusCode != 404 || resp.Header.Get("X-Deploy-Replay") != "miss" {
+		t.Errorf("expected a 404 for an unrecorded request, got %d", resp.StatusCode)
+	}
+}
+
+func TestReadRejectsOtherFiles(t *testing.T) {
+	if _, _, err := Read(strings.NewReader(`{"hello":"world"}` + "\n")); err == nil {
+		t.Error("expected a file without a capture header to be rejected")
+	}
+	if _, _, err := Read(strings.NewReader(`{"format":"deploy-capture","version":99}` + "\n")); err == nil {
+		t.Error("expected an unknown format version to be rejected")
+	}
+}
+
+func TestReplayLeavesExchangesAlone(t *testing.T) {
+	exchange := &Exchange{
+		Method:   "POST",
+		URI:      "/v1.15/containers/abc/attach",
+		Response: &http.Response{Status: "200 OK", StatusCode: 200, ProtoMajor: 1, ProtoMinor: 1, Header: http.Header{"Transfer-Encoding": {"chunked"}}},
+		Hijacked: true,
+		Raw:      []byte("hello\n"),
+	}
+	r := NewReplayer([]*Exchange{exchange})
+
+	replay(t, r, "POST /v1.15/containers/abc/attach HTTP/1.1\r\nHost: docker\r\n\r\n")
+	if exchange.Response.Header.Get("Transfer-Encoding") != "chunked" {
+		t.Errorf("expected the recorded headers to be left alone, got %v", exchange.Response.Header)
+	}
+}
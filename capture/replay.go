@@ -0,0 +1,214 @@
+package capture
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Exchange is an HTTP request the client made over a recorded connection and
+// the daemon's response to it.
+type Exchange struct {
+	Method string
+	URI    string
+
+	Response *http.Response
+	Body     []byte
+
+	// Hijacked is true if the daemon took over the connection after
+	// responding, as it does for 'docker attach' and 'docker run'. Raw then
+	// holds everything it sent after the response headers.
+	Hijacked bool
+	Raw      []byte
+}
+
+// Exchanges parses the HTTP traffic of each connection. Parsing a connection
+// stops at the first request or response that can't be parsed, such as one
+// cut off at the end of a capture.
+func Exchanges(connections []*Connection) []*Exchange {
+	exchanges := []*Exchange{}
+
+	for _, conn := range connections {
+		requests := bufio.NewReader(bytes.NewReader(conn.Sent))
+		responses := bufio.NewReader(bytes.NewReader(conn.Recv))
+
+		for {
+			req, err := http.ReadRequest(requests)
+			if err != nil {
+				break
+			}
+			io.Copy(ioutil.Discard, req.Body)
+
+			resp, err := http.ReadResponse(responses, req)
+			if err != nil {
+				break
+			}
+
+			exchange := &Exchange{
+				Method:   req.Method,
+				URI:      req.RequestURI,
+				Response: resp,
+			}
+			exchanges = append(exchanges, exchange)
+
+			// After a hijack, whatever follows the headers is the raw
+			// stream, however the headers describe it.
+			if resp.StatusCode == http.StatusSwitchingProtocols || isRawStream(resp) {
+				exchange.Hijacked = true
+				exchange.Raw, _ = ioutil.ReadAll(responses)
+				break
+			}
+
+			exchange.Body, err = ioutil.ReadAll(resp.Body)
+			if err != nil {
+				break
+			}
+			if resp.Close {
+				break
+			}
+		}
+	}
+
+	return exchanges
+}
+
+func isRawStream(resp *http.Response) bool {
+	return strings.HasPrefix(resp.Header.Get("Content-Type"), "application/vnd.docker.raw-stream")
+}
+
+// Replayer is a fake Docker daemon which answers requests with responses
+// from a capture. Requests are matched on method and URI. If a request was
+// made more than once, the recorded responses are given in order, and the
+// last one is repeated once they run out. Requests which don't match
+// exactly are matched ignoring the API version prefix (e.g. /v1.15), and
+// then ignoring the query string.
+type Replayer struct {
+	mu        sync.Mutex
+	exchanges map[string][]*Exchange
+	served    map[string]int
+	count     int
+}
+
+func NewReplayer(exchanges []*Exchange) *Replayer {
+	r := &Replayer{
+		exchanges: map[string][]*Exchange{},
+		served:    map[string]int{},
+		count:     len(exchanges),
+	}
+	for _, exchange := range exchanges {
+		for _, key := range matchKeys(exchange.Method, exchange.URI) {
+			r.exchanges[key] = append(r.exchanges[key], exchange)
+		}
+	}
+	return r
+}
+
+// Len returns the number of recorded exchanges.
+func (r *Replayer) Len() int {
+	return r.count
+}
+
+// Serve accepts connections on l until it's closed.
+func (r *Replayer) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go r.ServeConn(conn)
+	}
+}
+
+// ServeConn answers requests on conn until the client closes it.
+func (r *Replayer) ServeConn(conn net.Conn) {
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+
+	for {
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			return
+		}
+		io.Copy(ioutil.Discard, req.Body)
+
+		exchange := r.find(req.Method, req.RequestURI)
+		if exchange == nil {
+			writeMiss(conn, req)
+			continue
+		}
+
+		// The same exchange can be replayed on several connections at
+		// once, so its headers are copied before they're changed.
+		resp := *exchange.Response
+		resp.Header = exchange.Response.Header.Clone()
+		resp.Request = req
+		if exchange.Hijacked {
+			resp.Header.Del("Transfer-Encoding")
+			writeHeader(conn, &resp)
+			conn.Write(exchange.Raw)
+			return
+		}
+
+		resp.Body = ioutil.NopCloser(bytes.NewReader(exchange.Body))
+		resp.ContentLength = int64(len(exchange.Body))
+		resp.TransferEncoding = nil
+		if err := resp.Write(conn); err != nil || resp.Close {
+			return
+		}
+	}
+}
+
+func (r *Replayer) find(method, uri string) *Exchange {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, key := range matchKeys(method, uri) {
+		candidates := r.exchanges[key]
+		if len(candidates) == 0 {
+			continue
+		}
+		i := r.served[key]
+		if i >= len(candidates) {
+			i = len(candidates) - 1
+		}
+		r.served[key] = i + 1
+		return candidates[i]
+	}
+	return nil
+}
+
+var apiVersionPrefix = regexp.MustCompile(`^/v[0-9.]+/`)
+
+// matchKeys returns the keys a request is looked up under, most specific
+// first.
+func matchKeys(method, uri string) []string {
+	unversioned := apiVersionPrefix.ReplaceAllString(uri, "/")
+	withoutQuery := unversioned
+	if i := strings.Index(withoutQuery, "?"); i >= 0 {
+		withoutQuery = withoutQuery[:i]
+	}
+	return []string{
+		method + " " + uri,
+		method + " ~" + unversioned,
+		method + " ~~" + withoutQuery,
+	}
+}
+
+// writeHeader writes resp's status line and headers, but no body.
+func writeHeader(w io.Writer, resp *http.Response) {
+	fmt.Fprintf(w, "HTTP/%d.%d %s\r\n", resp.ProtoMajor, resp.ProtoMinor, resp.Status)
+	resp.Header.Write(w)
+	io.WriteString(w, "\r\n")
+}
+
+func writeMiss(w io.Writer, req *http.Request) {
+	body := fmt.Sprintf(`{"message":"deploy proxy replay: no recorded response for %s %s"}`+"\n", req.Method, req.RequestURI)
+	fmt.Fprintf(w, "HTTP/1.1 404 Not Found\r\nContent-Type: application/json\r\nContent-Length: %d\r\nX-Deploy-Replay: miss\r\n\r\n%s", len(body), body)
+}
@@ -0,0 +1,334 @@
+package commands
+
+import (
+	"flag"
+	"fmt"
+	"github.com/bbbacsa/deploy.io/api"
+	"github.com/bbbacsa/deploy.io/labels"
+	"github.com/bbbacsa/deploy.io/manifest"
+	"github.com/bbbacsa/deploy.io/utils"
+	"io"
+	"strings"
+	"sync"
+)
+
+var Plan = &Command{
+	UsageLine: "plan [--manifest FILE] [--prune]",
+	Short:     "Show how apply would change your hosts",
+	Long: `Compare the hosts listed in deploy.yml with the hosts you have, and show
+which 'deploy apply' would create, resize, relabel or delete.
+
+deploy.yml lists hosts by name, with their size, region and labels:
+
+    hosts:
+      - name: web
+        size: 1G
+        region: nyc1
+        labels:
+          env: prod
+      - name: db
+        size: 4G
+
+Only name is required. New hosts are 512M unless size is given, and
+existing hosts are only resized if it is. Region defaults to wherever
+Deploy.IO puts new hosts. Hosts can't be moved to another region, so a host
+in the wrong one is reported but left alone. If labels aren't given, a
+host's labels are left alone; if they are, they replace all of its labels.
+
+Hosts that aren't in deploy.yml are only deleted with --prune.
+`,
+	Flags: manifestFlags,
+}
+
+var Apply = &Command{
+	UsageLine: "apply [-f] [--manifest FILE] [--prune] [--parallel N]",
+	Short:     "Make your hosts match deploy.yml",
+	Long: `Create, resize, relabel and, with --prune, delete hosts so that they
+match the ones listed in deploy.yml. See 'deploy plan -h' for what it
+contains.
+
+The plan is shown before anything is changed, and you're asked to confirm
+it unless you set -f. Up to --parallel changes are made at once.
+`,
+	Flags: func(flags *flag.FlagSet) {
+		manifestFlags(flags)
+		flags.Bool("f", false, "Don't ask for confirmation")
+		flags.Int("parallel", 4, "Make up to `N` changes at once")
+	},
+}
+
+func manifestFlags(flags *flag.FlagSet) {
+	flags.String("manifest", "deploy.yml", "Read the hosts you want from `FILE`")
+	flags.Bool("prune", false, "Delete hosts that aren't in the manifest")
+}
+
+// A hostChange is a step of a plan.
+type hostChange struct {
+	// Action is "create", "resize", "label" or "delete".
+	Action string
+	Name   string
+
+	// Size is what the host is created or resized to, and OldSize what
+	// it's resized from, in MB.
+	Size    int
+	OldSize int
+	Region  string
+
+	// Labels are what the host is created or relabelled with, and
+	// OldLabels what it's relabelled from.
+	Labels    map[string]string
+	OldLabels map[string]string
+
+	// host is the host being resized, relabelled or deleted.
+	host *api.Host
+}
+
+func (c hostChange) String() string {
+	switch c.Action {
+	case "create":
+		if c.Region != "" {
+			return fmt.Sprintf("+ create %s (%s in %s)", c.Name, humanMB(c.Size), c.Region)
+		}
+		return fmt.Sprintf("+ create %s (%s)", c.Name, humanMB(c.Size))
+	case "resize":
+		return fmt.Sprintf("~ resize %s from %s to %s", c.Name, humanMB(c.OldSize), humanMB(c.Size))
+	case "label":
+		return fmt.Sprintf("~ relabel %s from %s to %s", c.Name, humanLabels(c.OldLabels), humanLabels(c.Labels))
+	}
+	return fmt.Sprintf("- delete %s", c.Name)
+}
+
+func humanMB(size int) string {
+	return utils.HumanSize(int64(size) * 1024 * 1024)
+}
+
+func humanLabels(hostLabels map[string]string) string {
+	if len(hostLabels) == 0 {
+		return "(none)"
+	}
+	return labels.String(hostLabels)
+}
+
+// hostPlan is what it takes to make the hosts you have match a manifest.
+type hostPlan struct {
+	Changes []hostChange
+
+	// Unmanaged are the hosts that aren't in the manifest, which are left
+	// alone without --prune.
+	Unmanaged []string
+
+	// Notes are about differences that can't be changed.
+	Notes []string
+}
+
+func makePlan(m *manifest.Manifest, hosts []*api.Host, prune bool) *hostPlan {
+	plan := &hostPlan{}
+	existing := map[string]*api.Host{}
+	for _, host := range hosts {
+		existing[host.Name] = host
+	}
+	wanted := map[string]bool{}
+
+	for _, want := range m.Hosts {
+		wanted[want.Name] = true
+		host, ok := existing[want.Name]
+		if !ok {
+			size := want.Size
+			if size == 0 {
+				size = manifest.DefaultSize
+			}
+			plan.Changes = append(plan.Changes, hostChange{Action: "create", Name: want.Name, Size: size, Region: want.Region, Labels: want.Labels})
+			continue
+		}
+		if want.Size != 0 && int(host.Size) != want.Size {
+			plan.Changes = append(plan.Changes, hostChange{Action: "resize", Name: want.Name, Size: want.Size, OldSize: int(host.Size), host: host})
+		}
+		if want.Labels != nil && labels.String(want.Labels) != labels.String(host.Labels) {
+			plan.Changes = append(plan.Changes, hostChange{Action: "label", Name: want.Name, Labels: want.Labels, OldLabels: host.Labels, host: host})
+		}
+		if want.Region != "" && host.Region != "" && want.Region != host.Region {
+			plan.Notes = append(plan.Notes, fmt.Sprintf("%s is in %s, not %s. Hosts can't be moved, so to move it, remove it and apply again.", want.Name, host.Region, want.Region))
+		}
+	}
+
+	for _, host := range hosts {
+		if wanted[host.Name] {
+			continue
+		}
+		if prune {
+			plan.Changes = append(plan.Changes, hostChange{Action: "delete", Name: host.Name, host: host})
+		} else {
+			plan.Unmanaged = append(plan.Unmanaged, host.Name)
+		}
+	}
+	return plan
+}
+
+// count returns how many of the plan's changes are action.
+func (plan *hostPlan) count(action string) int {
+	n := 0
+	for _, change := range plan.Changes {
+		if change.Action == action {
+			n++
+		}
+	}
+	return n
+}
+
+func (plan *hostPlan) Print(w io.Writer, manifestPath string) {
+	for _, change := range plan.Changes {
+		fmt.Fprintf(w, "  %s\n", change)
+	}
+	if len(plan.Changes) > 0 {
+		fmt.Fprintln(w)
+	}
+	for _, note := range plan.Notes {
+		fmt.Fprintf(w, "Note: %s\n", note)
+	}
+	if len(plan.Unmanaged) > 0 {
+		fmt.Fprintf(w, "Not in %s, so left alone without --prune: %s\n", manifestPath, strings.Join(plan.Unmanaged, ", "))
+	}
+	if len(plan.Changes) == 0 {
+		fmt.Fprintf(w, "Your hosts match %s.\n", manifestPath)
+		return
+	}
+	fmt.Fprintf(w, "Plan: %d to create, %d to resize, %d to relabel, %d to delete.\n", plan.count("create"), plan.count("resize"), plan.count("label"), plan.count("delete"))
+}
+
+// loadPlan reads the manifest named by --manifest and compares it with the
+// user's hosts.
+func loadPlan(ctx *Context, httpClient *api.HTTPClient) (*hostPlan, error) {
+	m, err := manifest.Load(ctx.String("manifest"))
+	if err != nil {
+		return nil, err
+	}
+	if ctx.Bool("prune") && len(m.Hosts) == 0 {
+		return nil, fmt.Errorf("%s doesn't list any hosts, so --prune would delete all of yours.\nIf that's what you want, use `deploy hosts rm`.", ctx.String("manifest"))
+	}
+	hosts, err := httpClient.GetHosts()
+	if err != nil {
+		return nil, err
+	}
+	return makePlan(m, hosts, ctx.Bool("prune")), nil
+}
+
+func RunPlan(cmd *Command, ctx *Context, args []string) error {
+	if len(args) > 0 {
+		return cmd.UsageError(ctx, "`deploy plan` doesn't expect any arguments, but got: %s", strings.Join(args, " "))
+	}
+
+	httpClient, err := ctx.NewAPIClient()
+	if err != nil {
+		return err
+	}
+	plan, err := loadPlan(ctx, httpClient)
+	if err != nil {
+		return err
+	}
+	plan.Print(ctx.Stdout, ctx.String("manifest"))
+	return nil
+}
+
+func RunApply(cmd *Command, ctx *Context, args []string) error {
+	if len(args) > 0 {
+		return cmd.UsageError(ctx, "`deploy apply` doesn't expect any arguments, but got: %s", strings.Join(args, " "))
+	}
+	parallel := ctx.Int("parallel")
+	if parallel < 1 {
+		return cmd.UsageError(ctx, "--parallel has to be at least 1, but it's %d", parallel)
+	}
+
+	httpClient, err := ctx.NewAPIClient()
+	if err != nil {
+		return err
+	}
+	plan, err := loadPlan(ctx, httpClient)
+	if err != nil {
+		return err
+	}
+	plan.Print(ctx.Stdout, ctx.String("manifest"))
+	if len(plan.Changes) == 0 {
+		return nil
+	}
+
+	if !ctx.Bool("f") {
+		if n := plan.count("delete"); n == 1 {
+			fmt.Fprintf(ctx.Stdout, "All data on the deleted host will be lost.\n")
+		} else if n > 1 {
+			fmt.Fprintf(ctx.Stdout, "All data on the %d deleted hosts will be lost.\n", n)
+		}
+		if !ctx.Confirm("Apply these changes?") {
+			return nil
+		}
+	}
+
+	// Each change is made by one of parallel workers, and its result
+	// printed as soon as it's done.
+	var (
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		failed   int
+		changes  = make(chan hostChange)
+		finished = map[string]int{}
+	)
+	for i := 0; i < parallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for change := range changes {
+				result, err := applyChange(ctx, httpClient, change)
+
+				mu.Lock()
+				if err != nil {
+					failed++
+					fmt.Fprintf(ctx.Stderr, "Failed to %s %s: %s\n", change.Action, change.Name, err)
+				} else {
+					finished[change.Action]++
+					fmt.Fprintln(ctx.Stderr, result)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, change := range plan.Changes {
+		changes <- change
+	}
+	close(changes)
+	wg.Wait()
+	forgetHosts(ctx, httpClient)
+
+	fmt.Fprintf(ctx.Stderr, "\nDone: %d created, %d resized, %d relabelled, %d deleted, %d failed.\n", finished["create"], finished["resize"], finished["label"], finished["delete"], failed)
+	if failed > 0 {
+		return &ExitError{Code: 1}
+	}
+	return nil
+}
+
+// applyChange makes a change, and returns what to say it's done.
+func applyChange(ctx *Context, httpClient *api.HTTPClient, change hostChange) (string, error) {
+	switch change.Action {
+	case "create":
+		host, err := httpClient.CreateHostFromSpec(api.HostSpec{Name: change.Name, Size: change.Size, Region: change.Region, Labels: change.Labels})
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("Created %s at %s", change.Name, host.IPAddress), nil
+	case "resize":
+		if _, err := httpClient.ResizeHost(change.Name, change.Size); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("Resized %s to %s", change.Name, humanMB(change.Size)), nil
+	case "label":
+		if _, err := httpClient.SetHostLabels(change.Name, change.Labels); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("Relabelled %s with %s", change.Name, humanLabels(change.Labels)), nil
+	case "delete":
+		if err := httpClient.DeleteHost(change.Name); err != nil {
+			return "", err
+		}
+		cleanUpHost(ctx, change.host)
+		return fmt.Sprintf("Deleted %s", change.Name), nil
+	}
+	return "", fmt.Errorf("Unknown action %q", change.Action)
+}
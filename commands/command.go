@@ -0,0 +1,276 @@
+package commands
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"text/tabwriter"
+)
+
+// A Command is a node in the command tree. It either runs something, has
+// subcommands, or both, in which case Run is called when no subcommand is
+// named.
+type Command struct {
+	Run       func(cmd *Command, ctx *Context, args []string) error
+	UsageLine string
+	Short     string
+	Long      string
+
+	// Flags, if not nil, defines the command's own flags. Their values are
+	// read in Run with ctx.String and ctx.Bool. A flag with an empty usage
+	// string isn't shown in help.
+	Flags func(flags *flag.FlagSet)
+
+	Subcommands []*Command
+
+	// Complete, if not nil, returns what the next positional argument
+	// could be, after args, for shell completion.
+	Complete func(ctx *Context, args []string) []Completion
+
+	// Hidden commands aren't listed in help or suggested.
+	Hidden bool
+
+	// RawArgs commands get their arguments without any flags parsed.
+	RawArgs bool
+
+	parent *Command
+}
+
+func (c *Command) Name() string {
+	name := c.UsageLine
+	i := strings.Index(name, " ")
+	if i >= 0 {
+		name = name[:i]
+	}
+	return name
+}
+
+// FullName returns the command as it's typed, e.g. "deploy hosts create".
+func (c *Command) FullName() string {
+	if c.parent == nil {
+		return c.Name()
+	}
+	return c.parent.FullName() + " " + c.Name()
+}
+
+// Subcommand returns the subcommand called name, or nil if there isn't one.
+func (c *Command) Subcommand(name string) *Command {
+	for _, subcommand := range c.Subcommands {
+		if subcommand.Name() == name {
+			return subcommand
+		}
+	}
+	return nil
+}
+
+// setParents links every command below c to its parent, so that it knows
+// its full name.
+func (c *Command) setParents() {
+	for _, subcommand := range c.Subcommands {
+		subcommand.parent = c
+		subcommand.setParents()
+	}
+}
+
+// FlagSet returns a new set of the command's flags and the global ones, for
+// one run of the command. The global flags write straight to ctx.Config, so
+// they can be given at any level, e.g. both 'deploy --format json hosts'
+// and 'deploy hosts --format json'.
+func (c *Command) FlagSet(ctx *Context) *flag.FlagSet {
+	flags := flag.NewFlagSet(c.FullName(), flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	if c.Flags != nil {
+		c.Flags(flags)
+	}
+	ctx.Config.globalFlags(flags)
+	return flags
+}
+
+// Execute parses the command's flags, then runs the subcommand named by the
+// first argument, or else the command itself.
+func (c *Command) Execute(ctx *Context, args []string) error {
+	flags := c.FlagSet(ctx)
+	if !c.RawArgs {
+		if err := flags.Parse(args); err != nil {
+			if err == flag.ErrHelp {
+				return c.Usage(ctx)
+			}
+			return c.UsageError(ctx, "%s", err)
+		}
+		if err := ctx.Config.check(); err != nil {
+			return c.UsageError(ctx, "%s", err)
+		}
+		args = flags.Args()
+	}
+
+	if len(args) > 0 {
+		if subcommand := c.Subcommand(args[0]); subcommand != nil {
+			// The subcommand won't see this command's own flags, so
+			// they'd be silently ignored.
+			if name := c.ownFlagSet(flags); name != "" {
+				return c.UsageError(ctx, "-%s has to come after `%s`", name, subcommand.FullName())
+			}
+			return subcommand.Execute(ctx, args[1:])
+		}
+	}
+	if c.Run == nil {
+		if len(args) > 0 {
+			return c.UnknownCommand(ctx, args[0])
+		}
+		return c.Usage(ctx)
+	}
+
+	ctx.Flags = flags
+	ctx.Debugf("Running %s", strings.Join(append([]string{c.FullName()}, args...), " "))
+	return c.Run(c, ctx, args)
+}
+
+// ownFlagSet returns the name of one of the command's own flags, as opposed
+// to the global ones, if it was set in flags.
+func (c *Command) ownFlagSet(flags *flag.FlagSet) string {
+	if c.Flags == nil {
+		return ""
+	}
+	own := flag.NewFlagSet(c.Name(), flag.ContinueOnError)
+	c.Flags(own)
+	name := ""
+	flags.Visit(func(f *flag.Flag) {
+		if name == "" && own.Lookup(f.Name) != nil {
+			name = f.Name
+		}
+	})
+	return name
+}
+
+// Usage prints the command's help and returns an error to exit with
+// status 2.
+func (c *Command) Usage(ctx *Context) error {
+	c.PrintHelp(ctx.Stderr)
+	return &ExitError{Code: 2}
+}
+
+func (c *Command) UsageError(ctx *Context, format string, args ...interface{}) error {
+	fmt.Fprintf(ctx.Stderr, format, args...)
+	fmt.Fprintf(ctx.Stderr, "\n")
+	return c.Usage(ctx)
+}
+
+// UnknownCommand returns an error for a subcommand that doesn't exist,
+// suggesting any with similar names.
+func (c *Command) UnknownCommand(ctx *Context, name string) error {
+	message := fmt.Sprintf("Unknown `%s` command: %s\n", c.FullName(), name)
+	if suggestions := c.Suggestions(name); len(suggestions) > 0 {
+		message += "\nDid you mean this?\n"
+		for _, suggestion := range suggestions {
+			message += "\t" + suggestion + "\n"
+		}
+	}
+	message += fmt.Sprintf("\nRun '%s -h' for a list of commands.", c.FullName())
+	return &ExitError{Code: 2, Message: message}
+}
+
+// Suggestions returns the names of subcommands that name may be a typo of.
+func (c *Command) Suggestions(name string) []string {
+	suggestions := []string{}
+	for _, subcommand := range c.Subcommands {
+		if subcommand.Hidden {
+			continue
+		}
+		candidate := subcommand.Name()
+		distance := editDistance(name, candidate)
+		if (distance <= 2 && distance < len(candidate)) || (len(name) > 1 && strings.HasPrefix(candidate, name)) {
+			suggestions = append(suggestions, candidate)
+		}
+	}
+	return suggestions
+}
+
+// PrintHelp writes the command's usage, description, flags and subcommands
+// to w.
+func (c *Command) PrintHelp(w io.Writer) {
+	usageLine := c.UsageLine
+	if c.parent != nil {
+		usageLine = c.parent.FullName() + " " + usageLine
+	}
+	fmt.Fprintf(w, "Usage: %s\n\n", usageLine)
+	fmt.Fprintf(w, "%s\n", strings.TrimSpace(c.Long))
+
+	// Global flags are only described at the top, since they're the same
+	// everywhere.
+	flags := flag.NewFlagSet(c.FullName(), flag.ContinueOnError)
+	if c.Flags != nil {
+		c.Flags(flags)
+	}
+	if c.parent == nil {
+		(&Config{}).globalFlags(flags)
+	}
+	printFlags(w, flags)
+
+	if len(c.Subcommands) > 0 {
+		fmt.Fprintf(w, "\nCommands:\n")
+		for _, subcommand := range c.Subcommands {
+			if !subcommand.Hidden {
+				fmt.Fprintf(w, "  %-11s %s\n", subcommand.Name(), subcommand.Short)
+			}
+		}
+		fmt.Fprintf(w, "\nRun '%s COMMAND -h' for more information on a command.\n", c.FullName())
+	}
+}
+
+func printFlags(w io.Writer, flags *flag.FlagSet) {
+	writer := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	header := false
+	flags.VisitAll(func(f *flag.Flag) {
+		if f.Usage == "" {
+			return
+		}
+		if !header {
+			fmt.Fprintf(w, "\nOptions:\n")
+			header = true
+		}
+
+		name, usage := flag.UnquoteUsage(f)
+		flagName := "-" + f.Name
+		if len(f.Name) > 1 {
+			flagName = "-" + flagName
+		}
+		if name != "" {
+			flagName += " " + name
+		}
+		if f.DefValue != "" && f.DefValue != "false" {
+			usage += fmt.Sprintf(" (default %s)", f.DefValue)
+		}
+		fmt.Fprintf(writer, "  %s\t%s\n", flagName, usage)
+	})
+	writer.Flush()
+}
+
+// editDistance returns the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = minInt(minInt(previous[j]+1, current[j-1]+1), previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(b)]
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -1,96 +1,142 @@
 package commands
 
 import (
+	"bufio"
+	"bytes"
 	"errors"
 	"flag"
 	"fmt"
 	"github.com/bbbacsa/deploy.io/api"
-	"github.com/bbbacsa/deploy.io/authenticator"
-//	"github.com/bbbacsa/deploy.io/proxy"
-//	"github.com/bbbacsa/deploy.io/tlsconfig"
+	"github.com/bbbacsa/deploy.io/capture"
+	"github.com/bbbacsa/deploy.io/daemon"
+	"github.com/bbbacsa/deploy.io/dialer"
+	"github.com/bbbacsa/deploy.io/inventory"
+	"github.com/bbbacsa/deploy.io/labels"
+	"github.com/bbbacsa/deploy.io/proxy"
+	"github.com/bbbacsa/deploy.io/tlsconfig"
+	"github.com/bbbacsa/deploy.io/trust"
 	"github.com/bbbacsa/deploy.io/utils"
-//	"github.com/bbbacsa/deploy.io/vendor/crypto/tls"
 	"io/ioutil"
-//	"net"
+	"net"
+	"net/url"
 	"os"
 	"os/exec"
-//	"os/signal"
+	"os/signal"
 	"path"
+	"path/filepath"
+	"strconv"
 	"strings"
-//	"syscall"
-	"text/tabwriter"
+	"syscall"
+	"time"
 )
 
-type Command struct {
-	Run       func(cmd *Command, args []string) error
-	UsageLine string
-	Short     string
-	Long      string
-	Flag      flag.FlagSet
-}
-
-func (c *Command) Name() string {
-	name := c.UsageLine
-	i := strings.Index(name, " ")
-	if i >= 0 {
-		name = name[:i]
-	}
-	return name
-}
+var Root = &Command{
+	UsageLine: "deploy [OPTIONS] COMMAND [ARG...]",
+	Short:     "Deploy.IO command-line client",
+	Long: `Deploy.IO command-line client.
 
-func (c *Command) Usage() {
-	fmt.Fprintf(os.Stderr, "Usage: %s\n\n", c.UsageLine)
-	fmt.Fprintf(os.Stderr, "%s\n", strings.TrimSpace(c.Long))
-	os.Exit(2)
-}
-
-func (c *Command) UsageError(format string, args ...interface{}) error {
-	fmt.Fprintf(os.Stderr, format, args...)
-	fmt.Fprintf(os.Stderr, "\nUsage: %s\n\n", c.UsageLine)
-	fmt.Fprintf(os.Stderr, "%s\n", strings.TrimSpace(c.Long))
-	os.Exit(2)
-	return fmt.Errorf(format, args...)
+Options can be given before any command, e.g. both 'deploy --format json
+hosts' and 'deploy hosts --format json' work.`,
 }
 
 var All = []*Command{
+	Apply,
+	Certs,
+	CompletionScript,
 	Docker,
 	Hosts,
 	IP,
+	Plan,
 	Proxy,
 	Run,
+	CompleteLine,
 }
 
 var HostSubcommands = []*Command{
+	ListHosts,
 	CreateHost,
 	RemoveHost,
+	LabelHost,
+	TrustHost,
+	HostCerts,
+}
+
+var HostCertSubcommands = []*Command{
+	RequestCert,
+	RotateCert,
+}
+
+var CertsSubcommands = []*Command{
+	TrustCerts,
+}
+
+var ProxySubcommands = []*Command{
+	ListProxies,
+	StopProxy,
+	ReplayProxy,
 }
 
 func init() {
+	Root.Subcommands = All
+	Hosts.Subcommands = HostSubcommands
+	HostCerts.Subcommands = HostCertSubcommands
+	Certs.Subcommands = CertsSubcommands
+	Proxy.Subcommands = ProxySubcommands
+	Root.setParents()
+
 	Hosts.Run = RunHosts
+	ListHosts.Run = RunListHosts
 	CreateHost.Run = RunCreateHost
 	RemoveHost.Run = RunRemoveHost
+	LabelHost.Run = RunLabelHost
+	TrustHost.Run = RunTrustHost
+	RequestCert.Run = RunRequestCert
+	RotateCert.Run = RunRotateCert
+	TrustCerts.Run = RunTrustCerts
 	Docker.Run = RunDocker
+	Proxy.Run = RunProxy
+	ListProxies.Run = RunListProxies
+	StopProxy.Run = RunStopProxy
+	ReplayProxy.Run = RunReplayProxy
 	IP.Run = RunIP
+	Run.Run = RunRun
+	CompletionScript.Run = RunCompletionScript
+	CompleteLine.Run = RunCompleteLine
+	Plan.Run = RunPlan
+	Apply.Run = RunApply
 }
 
 var Hosts = &Command{
-	UsageLine: "hosts",
+	UsageLine: "hosts [COMMAND] [ARGS...]",
 	Short:     "Manage hosts",
-	Long: `Manage hosts.
+	Long: `Manage hosts. With no command, lists them, like 'deploy hosts ls'.
+`,
+	Flags: listHostsFlags,
+}
 
-Usage: deploy hosts [COMMAND] [ARGS...]
+var ListHosts = &Command{
+	UsageLine: "ls [-l SELECTOR]",
+	Short:     "List hosts",
+	Long: `List your hosts, with their size, IP address and labels.
 
-Commands:
-  ls          List hosts (default)
-  create      Create a host
-  rm          Remove a host
+With -l, only hosts whose labels match SELECTOR are listed. A selector is
+a list of requirements separated by commas, which hosts have to meet all
+of, e.g. env=prod,team!=data. Each requirement is one of:
 
-Run 'deploy hosts COMMAND -h' for more information on a command.
+    KEY=VALUE   the label is set to VALUE
+    KEY!=VALUE  the label isn't set to VALUE, or isn't set at all
+    KEY         the label is set
+    !KEY        the label isn't set
 `,
+	Flags: listHostsFlags,
+}
+
+func listHostsFlags(flags *flag.FlagSet) {
+	flags.String("l", "", "Only list hosts whose labels match `SELECTOR`")
 }
 
 var CreateHost = &Command{
-	UsageLine: "create [-m MEMORY] [NAME]",
+	UsageLine: "create [-m MEMORY] [--label KEY=VALUE...] [NAME]",
 	Short:     "Create a host",
 	Long: fmt.Sprintf(`Create a host.
 
@@ -98,43 +144,190 @@ You can optionally specify a name for the host - if not, it will be
 named 'default', and 'deploy docker' commands will use it automatically.
 
 You can also specify how much RAM the host should have with -m.
-Valid amounts are %s.`, validSizes),
+Valid amounts are %s.
+
+Labels, like --label env=prod, mark hosts so that they can be picked out
+with -l. See 'deploy hosts label -h'.`, validSizes),
+	Flags: func(flags *flag.FlagSet) {
+		flags.String("m", "512M", "How much `MEMORY` the host should have")
+		flags.Var(labelFlag{}, "label", "Set a label on the host, as `KEY=VALUE`; can be repeated")
+	},
+}
+
+// labelFlag collects the labels given with repeated --label flags.
+type labelFlag map[string]string
+
+func (l labelFlag) String() string {
+	return labels.String(l)
+}
+
+func (l labelFlag) Set(value string) error {
+	key, value, err := labels.ParseLabel(value)
+	if err != nil {
+		return err
+	}
+	l[key] = value
+	return nil
 }
 
-var flCreateSize = CreateHost.Flag.String("m", "512M", "")
 var validSizes = "512M, 1G, 2G, 4G and 8G"
 
 var RemoveHost = &Command{
-	UsageLine: "rm [-f] [NAME]",
+	UsageLine: "rm [-f] [-l SELECTOR | NAME]",
 	Short:     "Remove a host",
 	Long: `Remove a host.
 
 You can optionally specify which host to remove - if you don't, the default
-host (named 'default') will be removed.
+host (named 'default') will be removed. With -l, every host whose labels
+match SELECTOR is removed instead - see 'deploy hosts ls -h'.
 
 Set -f to bypass the confirmation step, at your peril.
 `,
+	Flags: func(flags *flag.FlagSet) {
+		flags.Bool("f", false, "Don't ask for confirmation")
+		flags.String("l", "", "Remove every host whose labels match `SELECTOR`")
+	},
+	Complete: completeHostName,
+}
+
+var LabelHost = &Command{
+	UsageLine: "label NAME [KEY=VALUE...] [KEY-...]",
+	Short:     "Add or remove a host's labels",
+	Long: `Add or remove a host's labels, then print them.
+
+Labels mark hosts by, for example, team, environment or owner, so that
+'deploy hosts ls', 'deploy hosts rm' and the commands which take -H can
+pick hosts out by them with -l. KEY=VALUE sets a label, replacing any
+value it had, and KEY- removes one, e.g.
+
+    $ deploy hosts label web env=prod team=web
+    $ deploy hosts label web team-
+
+With no labels to change, just prints the host's labels.
+`,
+	Complete: completeHostName,
 }
 
-var flRemoveHostForce = RemoveHost.Flag.Bool("f", false, "")
+var TrustHost = &Command{
+	UsageLine: "trust [-f] [NAME]",
+	Short:     "Accept a host's new certificate",
+	Long: `Accept a host's new certificate.
+
+The first time you connect to a host, the fingerprint of its certificate is
+saved in ~/.deploy/known_hosts. If the host later presents a different
+certificate, connections to it are refused, since someone may be
+intercepting them. If you know why the certificate changed, this command
+shows you the new fingerprint and saves it.
+
+You can optionally specify which host - if you don't, the default
+host (named 'default') will be assumed.
+
+Set -f to bypass the confirmation step.
+`,
+	Flags: func(flags *flag.FlagSet) {
+		flags.Bool("f", false, "Don't ask for confirmation")
+	},
+	Complete: completeHostName,
+}
+
+var HostCerts = &Command{
+	UsageLine: "certs COMMAND [ARGS...]",
+	Short:     "Manage client certificates",
+	Long: `Manage client certificates.
+`,
+}
+
+var RequestCert = &Command{
+	UsageLine: "request [NAME]",
+	Short:     "Request a client certificate for a key generated locally",
+	Long: `Request a client certificate for a key generated locally.
+
+By default, the key you connect to a host with is generated by Deploy.IO
+and sent to you over the API. This command instead generates a key on this
+machine, sends only a certificate request for it, and saves the signed
+certificate and the key in ~/.deploy/certs. From then on, they're used
+instead of the ones from the API.
+
+You can optionally specify which host - if you don't, the default
+host (named 'default') will be assumed.
+`,
+	Complete: completeHostName,
+}
+
+var RotateCert = &Command{
+	UsageLine: "rotate [NAME]",
+	Short:     "Replace a host's client certificates",
+	Long: `Replace a host's client certificates.
+
+The host's current client certificates are revoked, and new ones issued.
+If you requested a certificate with 'deploy hosts certs request', a new
+key is generated on this machine and the certificate for it replaces the
+one in ~/.deploy/certs. Otherwise, Deploy.IO generates a new key too.
+
+Commands that connect to a host warn when its certificates expire within
+30 days, or however many days DEPLOY_CERT_WARNING_DAYS is set to.
+
+You can optionally specify which host - if you don't, the default
+host (named 'default') will be assumed.
+`,
+	Complete: completeHostName,
+}
+
+var Certs = &Command{
+	UsageLine: "certs COMMAND [ARGS...]",
+	Short:     "Manage certificates",
+	Long: `Manage certificates.
+`,
+}
+
+var TrustCerts = &Command{
+	UsageLine: "trust [ls]",
+	Short:     "List the certificate authorities deploy trusts",
+	Long: `List the certificate authorities deploy trusts, and where each came from.
+
+Hosts' certificates are checked against:
+  - the Deploy.IO CA, which is built in, unless DEPLOY_HOST_CA is set
+  - every *.pem and *.crt file in ~/.deploy/ca
+  - the files in DEPLOY_CA_BUNDLE, separated by colons, and DEPLOY_HOST_CA
+  - the CA Deploy.IO says signed the host's certificate, for that host only
+
+The API's certificate is checked against all of those except the last, and
+the system roots.
+`,
+}
 
 var Docker = &Command{
-	UsageLine: "docker [-H HOST] [COMMAND...]",
-	Short:     "Run a Docker command against a host",
-	Long: `Run a Docker command against a host.
+	UsageLine: "docker [-H HOST[,HOST...] | -l SELECTOR] [--parallel N] [--group] [COMMAND...]",
+	Short:     "Run a Docker command against a host, or several",
+	Long: `Run a Docker command against a host, or several.
 
 Wraps the 'docker' command-line tool - see the Docker website for reference:
 
     http://docs.docker.io/en/latest/reference/commandline/
 
-You can optionally specify a host by name - if you don't, the default host
-will be used.`,
+You can optionally specify a host by name, or with -l, by its labels - if
+you don't, the default host will be used. -H can also be a list of names
+separated by commas, or a selector like -l's, to run the command against
+several hosts, e.g.
+
+    $ deploy docker -H web1,web2 pull myapp
+    $ deploy docker -H env=prod,team=web run -d myapp
+
+Against several hosts, up to --parallel run the command at once, without
+any input. Each line of their output is prefixed with the name of the host
+it came from, as it comes, or with --group, each host's output is printed
+together once it's finished. At the end, whether the command succeeded on
+each host is summarised, and if it failed on any, deploy exits with status 1.`,
+	Flags: func(flags *flag.FlagSet) {
+		flags.String("H", "", "The `HOST` to use, or several separated by commas")
+		flags.String("l", "", "Use the hosts whose labels match `SELECTOR`")
+		flags.Int("parallel", 4, "Run the command on up to `N` hosts at once")
+		flags.Bool("group", false, "Print each host's output together, once it's finished")
+	},
 }
 
-var flDockerHost = Docker.Flag.String("H", "", "")
-
 var Proxy = &Command{
-	UsageLine: "proxy [-H HOST] [LISTEN_URL]",
+	UsageLine: "proxy [-H HOST | -l SELECTOR] [--detach] [--record FILE] [LISTEN_URL]",
 	Short:     "Start a local proxy to a host's Docker daemon",
 	Long: `Start a local proxy to a host's Docker daemon.
 
@@ -150,10 +343,65 @@ Instead, you can specify a URL to listen on, which can be a socket or TCP addres
 
     $ deploy proxy unix:///path/to/socket
     $ deploy proxy tcp://localhost:1234
+
+With --detach, the proxy keeps running in the background after the command
+returns.
+
+With --record FILE, the decrypted traffic of every connection is written to
+FILE, which 'deploy proxy replay' can serve back later. The recording holds
+everything sent to the host, including any credentials, so keep it private.
+`,
+	Flags: func(flags *flag.FlagSet) {
+		flags.String("H", "", "The name of the `HOST` to proxy to")
+		flags.String("l", "", "Proxy to the host whose labels match `SELECTOR`")
+		flags.Bool("detach", false, "Keep running in the background")
+		flags.String("record", "", "Record decrypted traffic to `FILE`")
+		// Set on the background process started by --detach.
+		flags.Bool("daemon", false, "")
+	},
+}
+
+var ListProxies = &Command{
+	UsageLine: "ls",
+	Short:     "List background proxies",
+	Long: `List proxies started with 'deploy proxy --detach', along with how long
+they've been running and how many connections they've forwarded.
+`,
+}
+
+var StopProxy = &Command{
+	UsageLine: "stop [--all] [HOST]",
+	Short:     "Stop background proxies",
+	Long: `Stop a proxy started with 'deploy proxy --detach'.
+
+You can optionally specify which host's proxy to stop - if you don't, the
+proxy to the default host will be stopped. Use --all to stop every
+background proxy.
 `,
+	Flags: func(flags *flag.FlagSet) {
+		flags.Bool("all", false, "Stop every background proxy")
+	},
+	Complete: completeHostName,
 }
 
-var flProxyHost = Proxy.Flag.String("H", "", "")
+var ReplayProxy = &Command{
+	UsageLine: "replay FILE [LISTEN_URL]",
+	Short:     "Serve a recording as a fake Docker daemon",
+	Long: `Serve the responses in a recording made with 'deploy proxy --record' as a
+fake Docker daemon, e.g.
+
+    $ deploy proxy --record session.capture
+    $ deploy proxy replay session.capture
+    Replaying 12 recorded requests at unix:///tmp/deploy-12345/deploy.sock
+
+Requests are answered with the recorded response to the same method and
+path, in the order they were recorded. Requests that weren't recorded get a
+404 error.
+
+Like 'deploy proxy', listens on a Unix socket at a random path unless you
+specify a URL to listen on.
+`,
+}
 
 var IP = &Command{
 	UsageLine: "ip [NAME]",
@@ -163,10 +411,11 @@ var IP = &Command{
 You can optionally specify which host - if you don't, the default
 host (named 'default') will be assumed.
 `,
+	Complete: completeHostName,
 }
 
 var Run = &Command{
-	UsageLine: "run [-H HOST] COMMAND [ARGS...]",
+	UsageLine: "run [-H HOST | -l SELECTOR] COMMAND [ARGS...]",
 	Short:     "Run a command with the DOCKER_HOST envvar set",
 	Long: `Start a proxy to a Deploy.IO host and run a command locally
 with the DOCKER_HOST environment variable set.
@@ -175,31 +424,32 @@ For example:
 
 $ deploy run fig up
 
-You can optionally specify which host - if you don't, the default
-host (named 'default') will be assumed.
+You can optionally specify a host by name, or with -l, by its labels - if
+you don't, the default host (named 'default') will be assumed.
 `,
+	Flags: func(flags *flag.FlagSet) {
+		flags.String("H", "", "The name of the `HOST` to use")
+		flags.String("l", "", "Use the host whose labels match `SELECTOR`")
+	},
 }
 
-var flRunHost = Run.Flag.String("H", "", "")
-
-func RunHosts(cmd *Command, args []string) error {
-	list := len(args) == 0 || (len(args) == 1 && args[0] == "ls")
-
-	if !list {
-		for _, subcommand := range HostSubcommands {
-			if subcommand.Name() == args[0] {
-				subcommand.Flag.Usage = func() { subcommand.Usage() }
-				subcommand.Flag.Parse(args[1:])
-				args = subcommand.Flag.Args()
-				err := subcommand.Run(subcommand, args)
-				return err
-			}
-		}
+func RunHosts(cmd *Command, ctx *Context, args []string) error {
+	if len(args) > 0 {
+		return cmd.UnknownCommand(ctx, args[0])
+	}
+	return RunListHosts(ListHosts, ctx, args)
+}
 
-		return fmt.Errorf("Unknown `hosts` subcommand: %s", args[0])
+func RunListHosts(cmd *Command, ctx *Context, args []string) error {
+	if len(args) > 0 {
+		return cmd.UsageError(ctx, "`deploy hosts ls` doesn't expect any arguments, but got: %s", strings.Join(args, " "))
+	}
+	selector, err := labels.ParseSelector(ctx.String("l"))
+	if err != nil {
+		return cmd.UsageError(ctx, "%s", err)
 	}
 
-	httpClient, err := authenticator.Authenticate()
+	httpClient, err := ctx.NewAPIClient()
 	if err != nil {
 		return err
 	}
@@ -209,22 +459,30 @@ func RunHosts(cmd *Command, args []string) error {
 		return err
 	}
 
-	writer := tabwriter.NewWriter(os.Stdout, 20, 1, 3, ' ', 0)
-	fmt.Fprintln(writer, "ID\tNAME\tSIZE\tIP")
-	for _, host := range hosts {
-		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\n", host.ID, host.Name, utils.HumanSize(host.Size*1024*1024), host.IPAddress)
+	rows := [][]string{}
+	for _, host := range SelectHosts(hosts, selector) {
+		rows = append(rows, []string{host.ID, host.Name, utils.HumanSize(host.Size * 1024 * 1024), host.IPAddress, labels.String(host.Labels)})
 	}
-	writer.Flush()
+	return ctx.PrintList([]string{"ID", "NAME", "SIZE", "IP", "LABELS"}, rows)
+}
 
-	return nil
+// SelectHosts returns the hosts whose labels match selector.
+func SelectHosts(hosts []*api.Host, selector labels.Selector) []*api.Host {
+	selected := []*api.Host{}
+	for _, host := range hosts {
+		if selector.Matches(host.Labels) {
+			selected = append(selected, host)
+		}
+	}
+	return selected
 }
 
-func RunCreateHost(cmd *Command, args []string) error {
+func RunCreateHost(cmd *Command, ctx *Context, args []string) error {
 	if len(args) > 1 {
-		return cmd.UsageError("`deploy hosts create` expects at most 1 argument, but got more: %s", strings.Join(args[1:], " "))
+		return cmd.UsageError(ctx, "`deploy hosts create` expects at most 1 argument, but got more: %s", strings.Join(args[1:], " "))
 	}
 
-	httpClient, err := authenticator.Authenticate()
+	httpClient, err := ctx.NewAPIClient()
 	if err != nil {
 		return err
 	}
@@ -232,246 +490,1115 @@ func RunCreateHost(cmd *Command, args []string) error {
 	hostName, humanName := GetHostName(args)
 	humanName = utils.Capitalize(humanName)
 
-	size, sizeString := GetHostSize()
+	size, sizeString := GetHostSize(ctx.String("m"))
 	if size == -1 {
-		fmt.Fprintf(os.Stderr, "Sorry, %q isn't a size we support.\nValid sizes are %s.\n", sizeString, validSizes)
+		fmt.Fprintf(ctx.Stderr, "Sorry, %q isn't a size we support.\nValid sizes are %s.\n", sizeString, validSizes)
 		return nil
 	}
 
-	host, err := httpClient.CreateHost(hostName, size)
+	hostLabels := ctx.Flags.Lookup("label").Value.(labelFlag)
+	host, err := httpClient.CreateHostFromSpec(api.HostSpec{Name: hostName, Size: size, Labels: hostLabels})
 	if err != nil {
 		// HACK. api.go should decode JSON and return a specific type of error for this case.
 		if strings.Contains(err.Error(), "already exists") {
-			fmt.Fprintf(os.Stderr, "%s is already running.\nYou can create additional hosts with `deploy hosts create [NAME]`.\n", humanName)
+			fmt.Fprintf(ctx.Stderr, "%s is already running.\nYou can create additional hosts with `deploy hosts create [NAME]`.\n", humanName)
 			return nil
 		}
 		if strings.Contains(err.Error(), "Invalid value") {
-			fmt.Fprintf(os.Stderr, "Sorry, '%s' isn't a valid host name.\nHost names can only contain lowercase letters, numbers and underscores.\n", hostName)
+			fmt.Fprintf(ctx.Stderr, "Sorry, '%s' isn't a valid host name.\nHost names can only contain lowercase letters, numbers and underscores.\n", hostName)
 			return nil
 		}
 		if strings.Contains(err.Error(), "Unsupported size") {
-			fmt.Fprintf(os.Stderr, "Sorry, %q isn't a size we support.\nValid sizes are %s.\n", sizeString, validSizes)
+			fmt.Fprintf(ctx.Stderr, "Sorry, %q isn't a size we support.\nValid sizes are %s.\n", sizeString, validSizes)
 			return nil
 		}
 
 		return err
 	}
-	fmt.Fprintf(os.Stderr, "%s running at %s\n", humanName, host.IPAddress)
+	forgetHosts(ctx, httpClient)
+	fmt.Fprintf(ctx.Stderr, "%s running at %s\n", humanName, host.IPAddress)
 
 	return nil
 }
 
-func RunRemoveHost(cmd *Command, args []string) error {
+func RunRemoveHost(cmd *Command, ctx *Context, args []string) error {
 	if len(args) > 1 {
-		return cmd.UsageError("`deploy hosts rm` expects at most 1 argument, but got more: %s", strings.Join(args[1:], " "))
+		return cmd.UsageError(ctx, "`deploy hosts rm` expects at most 1 argument, but got more: %s", strings.Join(args[1:], " "))
+	}
+	if ctx.String("l") != "" {
+		if len(args) > 0 {
+			return cmd.UsageError(ctx, "`deploy hosts rm` takes either a NAME or -l, not both")
+		}
+		selector, err := labels.ParseSelector(ctx.String("l"))
+		if err != nil {
+			return cmd.UsageError(ctx, "%s", err)
+		}
+		return removeSelectedHosts(ctx, selector)
 	}
 
 	hostName, humanName := GetHostName(args)
 
-	if !*flRemoveHostForce {
-		var confirm string
-		fmt.Printf("Going to remove %s. All data on it will be lost.\n", humanName)
-		fmt.Print("Are you sure you're ready? [yN] ")
-		fmt.Scanln(&confirm)
-
-		if strings.ToLower(confirm) != "y" {
+	if !ctx.Bool("f") {
+		fmt.Fprintf(ctx.Stdout, "Going to remove %s. All data on it will be lost.\n", humanName)
+		if !ctx.Confirm("Are you sure you're ready?") {
 			return nil
 		}
 	}
 
-	httpClient, err := authenticator.Authenticate()
+	httpClient, err := ctx.NewAPIClient()
 	if err != nil {
 		return err
 	}
 
+	// A new host may get the same address, so its pin goes with it, along
+	// with any certificate we requested for it.
+	host, _ := httpClient.GetHost(hostName)
+
 	err = httpClient.DeleteHost(hostName)
 	if err != nil {
 		// HACK. api.go should decode JSON and return a specific type of error for this case.
 		if strings.Contains(err.Error(), "Not found") {
-			fmt.Fprintf(os.Stderr, "%s doesn't seem to be running.\nYou can view your running hosts with `deploy hosts`.\n", utils.Capitalize(humanName))
+			fmt.Fprintf(ctx.Stderr, "%s doesn't seem to be running.\nYou can view your running hosts with `deploy hosts`.\n", utils.Capitalize(humanName))
 			return nil
 		}
 
 		return err
 	}
-	fmt.Fprintf(os.Stderr, "Removed %s\n", humanName)
+	forgetHosts(ctx, httpClient)
+	fmt.Fprintf(ctx.Stderr, "Removed %s\n", humanName)
+
+	if host != nil {
+		cleanUpHost(ctx, host)
+	}
+
+	return nil
+}
+
+// removeSelectedHosts removes every host whose labels match selector.
+func removeSelectedHosts(ctx *Context, selector labels.Selector) error {
+	httpClient, err := ctx.NewAPIClient()
+	if err != nil {
+		return err
+	}
+
+	hosts, err := httpClient.GetHosts()
+	if err != nil {
+		return err
+	}
+	hosts = SelectHosts(hosts, selector)
+	if len(hosts) == 0 {
+		return fmt.Errorf("No hosts match %s.\nYou can view your hosts and their labels with `deploy hosts`.", selector)
+	}
+	names := []string{}
+	for _, host := range hosts {
+		names = append(names, host.Name)
+	}
+
+	if !ctx.Bool("f") {
+		if len(hosts) == 1 {
+			fmt.Fprintf(ctx.Stdout, "Going to remove %s. All data on it will be lost.\n", names[0])
+		} else {
+			fmt.Fprintf(ctx.Stdout, "Going to remove %d hosts: %s. All data on them will be lost.\n", len(hosts), strings.Join(names, ", "))
+		}
+		if !ctx.Confirm("Are you sure you're ready?") {
+			return nil
+		}
+	}
+
+	failed := 0
+	for _, host := range hosts {
+		if err := httpClient.DeleteHost(host.Name); err != nil {
+			fmt.Fprintf(ctx.Stderr, "Failed to remove %s: %s\n", host.Name, err)
+			failed++
+			continue
+		}
+		fmt.Fprintf(ctx.Stderr, "Removed %s\n", host.Name)
+		cleanUpHost(ctx, host)
+	}
+	forgetHosts(ctx, httpClient)
 
+	if failed > 0 {
+		return &ExitError{Code: 1}
+	}
 	return nil
 }
 
-func RunDocker(cmd *Command, args []string) error {
-	return WithDockerProxy("", *flDockerHost, func(listenURL string, ca string, clientCert string, clientKey string) error {
-	  args = append([]string{"--tlscacert='" + ca + "'"}, args...)
-	  args = append([]string{"--tlscert='" + clientCert + "'"}, args...)
-	  args = append([]string{"--tlskey='" + clientKey + "'"}, args...)
-		err := CallDocker(args, listenURL)
+func RunLabelHost(cmd *Command, ctx *Context, args []string) error {
+	if len(args) == 0 {
+		return cmd.UsageError(ctx, "`deploy hosts label` expects the name of a host")
+	}
+	hostName := args[0]
+	set, remove, err := labels.ParseChanges(args[1:])
+	if err != nil {
+		return cmd.UsageError(ctx, "%s", err)
+	}
+
+	host, err := GetHost(ctx, hostName)
+	if err != nil {
+		return err
+	}
+
+	if len(set) > 0 || len(remove) > 0 {
+		hostLabels := map[string]string{}
+		for key, value := range host.Labels {
+			hostLabels[key] = value
+		}
+		for key, value := range set {
+			hostLabels[key] = value
+		}
+		for _, key := range remove {
+			delete(hostLabels, key)
+		}
+
+		httpClient, err := ctx.NewAPIClient()
 		if err != nil {
-			return fmt.Errorf("Docker exited with error")
+			return err
 		}
+		host, err = httpClient.SetHostLabels(hostName, hostLabels)
+		if err != nil {
+			return err
+		}
+		forgetHosts(ctx, httpClient)
+	}
+
+	if len(host.Labels) == 0 {
+		fmt.Fprintf(ctx.Stderr, "%s has no labels\n", hostName)
 		return nil
-	})
+	}
+	fmt.Fprintln(ctx.Stdout, labels.String(host.Labels))
+	return nil
+}
+
+// cleanUpHost removes what's kept locally for a host that's been removed:
+// its pin in known_hosts, and any certificate requested for it.
+func cleanUpHost(ctx *Context, host *api.Host) {
+	tlsconfig.NewKnownHosts(tlsconfig.GetKnownHostsPath()).Remove(HostAddress(host))
+	if host.ID != "" {
+		tlsconfig.NewCertStore(tlsconfig.GetCertDir(), ctx.Stderr).Remove(host.ID)
+	}
 }
 
-func RunIP(cmd *Command, args []string) error {
+func RunTrustHost(cmd *Command, ctx *Context, args []string) error {
 	if len(args) > 1 {
-		return cmd.UsageError("`deploy ip` expects at most 1 argument, but got more: %s", strings.Join(args[1:], " "))
+		return cmd.UsageError(ctx, "`deploy hosts trust` expects at most 1 argument, but got more: %s", strings.Join(args[1:], " "))
 	}
 
-	hostName, _ := GetHostName(args)
+	hostName, humanName := GetHostName(args)
 
-	host, err := GetHost(hostName)
+	host, err := GetHost(ctx, hostName)
 	if err != nil {
 		return err
 	}
+	destination := HostAddress(host)
 
-	fmt.Fprintln(os.Stdout, host.IPAddress)
-	return nil
-}
+	// The certificate still has to be signed by a CA we trust.
+	config, err := tlsconfig.GetTLSConfig(host, ctx.TLSOptions())
+	if err != nil {
+		return err
+	}
 
-func WithDockerProxy(listenURL, hostName string, callback func(string, string, string, string) error) error {
-	if hostName == "" {
-		hostName = "default"
+	d, err := dialer.FromEnvironment()
+	if err != nil {
+		return err
 	}
 
-	host, err := GetHost(hostName)
+	conn, err := d.DialTLS("tcp", destination, config)
 	if err != nil {
 		return err
 	}
+	fingerprint := tlsconfig.Fingerprint(conn.ConnectionState().PeerCertificates[0].Raw)
+	conn.Close()
 
-	listenURL = "tcp://" + host.IPAddress + ":" + fmt.Sprintf("%d", host.Port)
-	
-	ca, caerr := ioutil.TempFile(os.TempDir(), "ca")
-	cert, certerr := ioutil.TempFile(os.TempDir(), "cert")
-	key, keyerr := ioutil.TempFile(os.TempDir(), "key")
-	
-	if caerr != nil {
-	  return caerr
+	knownHosts := tlsconfig.NewKnownHosts(tlsconfig.GetKnownHostsPath())
+	known, ok, err := knownHosts.Lookup(destination)
+	if err != nil {
+		return err
 	}
-	if certerr != nil {
-	  return certerr
+	if ok && known == fingerprint {
+		fmt.Fprintf(ctx.Stderr, "The certificate of %s hasn't changed.\n", humanName)
+		return nil
 	}
-	if keyerr != nil {
-  	return keyerr
+
+	if !ctx.Bool("f") {
+		if ok {
+			fmt.Fprintf(ctx.Stdout, "The certificate of %s has changed.\n", humanName)
+			fmt.Fprintf(ctx.Stdout, "Old fingerprint: %s\n", known)
+		}
+		fmt.Fprintf(ctx.Stdout, "New fingerprint: %s\n", fingerprint)
+		if !ctx.Confirm("Do you trust it?") {
+			return nil
+		}
 	}
 
-	caerr = ioutil.WriteFile(ca.Name(), []byte(deployCerts), 0x644)
-	certerr = ioutil.WriteFile(cert.Name(), []byte(host.ClientCert), 0x644)
-	keyerr = ioutil.WriteFile(key.Name(), []byte(host.ClientKey), 0x644)
-	
-	if err := callback(listenURL, ca.Name(), cert.Name(), key.Name()); err != nil {
-	  os.Remove(ca.Name())
-	  os.Remove(cert.Name())
-	  os.Remove(key.Name())
+	if err := knownHosts.Set(destination, fingerprint); err != nil {
 		return err
 	}
-	
+	fmt.Fprintf(ctx.Stderr, "Trusted the certificate of %s\n", humanName)
 
 	return nil
 }
 
-func CallDocker(args []string, dockerHost string) error {
-	dockerPath := GetDockerPath()
-	if dockerPath == "" {
-		return errors.New("Can't find `docker` executable in $PATH.\nYou might need to install it: http://docs.docker.io/en/latest/installation/#installation-list")
+func RunRequestCert(cmd *Command, ctx *Context, args []string) error {
+	if len(args) > 1 {
+		return cmd.UsageError(ctx, "`deploy hosts certs request` expects at most 1 argument, but got more: %s", strings.Join(args[1:], " "))
 	}
 
-	os.Setenv("DOCKER_HOST", dockerHost)
-	os.Setenv("DOCKER_TLS_VERIFY", "1")
+	hostName, humanName := GetHostName(args)
 
-	cmd := exec.Command(dockerPath, args...)
-	cmd.Stdin = os.Stdin
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	return cmd.Run()
-}
+	host, err := GetHost(ctx, hostName)
+	if err != nil {
+		return err
+	}
+	if host.ID == "" {
+		return fmt.Errorf("The Deploy.IO API didn't return an ID for %s", humanName)
+	}
 
-func GetDockerPath() string {
-	for _, dir := range strings.Split(os.Getenv("PATH"), ":") {
-		dockerPath := path.Join(dir, "docker")
-		_, err := os.Stat(dockerPath)
-		if err == nil {
-			return dockerPath
-		}
+	key, keyPEMData, err := tlsconfig.GenerateKey()
+	if err != nil {
+		return err
+	}
+	csrPEMData, err := tlsconfig.CreateCertificateRequest(key, host.Name)
+	if err != nil {
+		return err
 	}
-	return ""
-}
 
-func GetHostName(args []string) (string, string) {
-	hostName := "default"
+	httpClient, err := ctx.NewAPIClient()
+	if err != nil {
+		return err
+	}
+	cert, err := httpClient.SignCertificateRequest(hostName, csrPEMData)
+	if err != nil {
+		return err
+	}
 
-	if len(args) > 0 {
-		hostName = args[0]
+	certStore := tlsconfig.NewCertStore(tlsconfig.GetCertDir(), ctx.Stderr)
+	if err := certStore.Save(host.ID, []byte(cert), keyPEMData); err != nil {
+		return err
 	}
+	fmt.Fprintf(ctx.Stderr, "Saved a client certificate for %s in %s\n", humanName, certStore.Dir)
 
-	return hostName, GetHumanHostName(hostName)
+	return nil
 }
 
-func GetHumanHostName(hostName string) string {
-	if hostName == "default" {
-		return "default host"
-	} else {
-		return fmt.Sprintf("host '%s'", hostName)
+func RunRotateCert(cmd *Command, ctx *Context, args []string) error {
+	if len(args) > 1 {
+		return cmd.UsageError(ctx, "`deploy hosts certs rotate` expects at most 1 argument, but got more: %s", strings.Join(args[1:], " "))
 	}
-}
 
-func GetHostSize() (int, string) {
-	sizeString := *flCreateSize
+	hostName, humanName := GetHostName(args)
 
-	bytes, err := utils.RAMInBytes(sizeString)
+	host, err := GetHost(ctx, hostName)
 	if err != nil {
-		return -1, sizeString
+		return err
 	}
 
-	megs := bytes / (1024 * 1024)
-	if megs < 1 {
-		return -1, sizeString
+	certStore := tlsconfig.NewCertStore(tlsconfig.GetCertDir(), ctx.Stderr)
+	local := false
+	if host.ID != "" {
+		if _, _, local, err = certStore.Load(host.ID); err != nil {
+			return err
+		}
 	}
 
-	return int(megs), sizeString
-}
-
-func GetHost(hostName string) (*api.Host, error) {
-	httpClient, err := authenticator.Authenticate()
+	httpClient, err := ctx.NewAPIClient()
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	host, err := httpClient.GetHost(hostName)
-	if err != nil {
-		// HACK. api.go should decode JSON and return a specific type of error for this case.
-		if strings.Contains(err.Error(), "Not found") {
-			humanName := GetHumanHostName(hostName)
-			return nil, fmt.Errorf("%s doesn't seem to be running.\nYou can create it with `deploy hosts create %s`.", utils.Capitalize(humanName), hostName)
+	if !local {
+		if _, _, err := httpClient.RotateCertificates(hostName, nil); err != nil {
+			return err
 		}
+		forgetHosts(ctx, httpClient)
+		fmt.Fprintf(ctx.Stderr, "Rotated the client certificates for %s\n", humanName)
+		return nil
+	}
 
-		return nil, err
+	key, keyPEMData, err := tlsconfig.GenerateKey()
+	if err != nil {
+		return err
+	}
+	csrPEMData, err := tlsconfig.CreateCertificateRequest(key, host.Name)
+	if err != nil {
+		return err
+	}
+	cert, _, err := httpClient.RotateCertificates(hostName, csrPEMData)
+	if err != nil {
+		return err
 	}
+	forgetHosts(ctx, httpClient)
 
-	return host, nil
+	// The old certificate is already revoked, so if this fails there's
+	// nothing to go back to: say how to recover.
+	if err := certStore.Save(host.ID, []byte(cert), keyPEMData); err != nil {
+		return fmt.Errorf("Couldn't save the new client certificate for %s: %s\nYou can request another with `deploy hosts certs request %s`.", humanName, err, hostName)
+	}
+	fmt.Fprintf(ctx.Stderr, "Rotated the client certificate for %s in %s\n", humanName, certStore.Dir)
+
+	return nil
 }
 
-var deployCerts string = `-----BEGIN CERTIFICATE-----
-MIIEKTCCAxGgAwIBAgIJAP81C5xoXHunMA0GCSqGSIb3DQEBCwUAMIGqMQswCQYD
-VQQGEwJQSDEPMA0GA1UECAwGTGFndW5hMRAwDgYDVQQHDAdDYWxhbWJhMS4wLAYD
-VQQKDCVCcnljaGVUZWNoIEludGVybmV0IFNvbHV0aW9ucyBDb21wYW55MQwwCgYD
-VQQLDANEZXYxGDAWBgNVBAMMDzEwNC4xMzEuMTU4LjEyNDEgMB4GCSqGSIb3DQEJ
-ARYRYmJiYWNzYUBnbWFpbC5jb20wHhcNMTQxMTEwMDUyMzU5WhcNMTUxMTEwMDUy
-MzU5WjCBqjELMAkGA1UEBhMCUEgxDzANBgNVBAgMBkxhZ3VuYTEQMA4GA1UEBwwH
-Q2FsYW1iYTEuMCwGA1UECgwlQnJ5Y2hlVGVjaCBJbnRlcm5ldCBTb2x1dGlvbnMg
-Q29tcGFueTEMMAoGA1UECwwDRGV2MRgwFgYDVQQDDA8xMDQuMTMxLjE1OC4xMjQx
-IDAeBgkqhkiG9w0BCQEWEWJiYmFjc2FAZ21haWwuY29tMIIBIjANBgkqhkiG9w0B
-AQEFAAOCAQ8AMIIBCgKCAQEAzWBb0yQS5ca0dQWhsrPdFcsfUGazhJ8EXM+2Np5s
-bj7wiT06TSunB+ME1Aj61KKxb9gI1QSW8LJy9Xp/1R1r7SWJ5VAAb8oSXP92w0Dk
-ph8MXPl1x8K3B22hJk0jiIADdS09AG30cp7osW6uqz7ARgsQh4khh2DohaB0zM1t
-9uLrDgUdP9BAVlFVRSYpfKMBPZ5PfmKmYod9GYOA9/Nxs44N/PhmvFMI42cVoL88
-YFZ3x/U7Iu495Hri9fJ1roHAh7Z7nGL3sD/iGd3bGXOeDztXWiqp59qSFUyvOuyC
-K/paZnz5izBlaz6Zir+M+zMcjAh4qvccfWyRlNZWFtAONwIDAQABo1AwTjAdBgNV
-HQ4EFgQUSBE1/wLJOO3R2TFs8katsJy9B+0wHwYDVR0jBBgwFoAUSBE1/wLJOO3R
-2TFs8katsJy9B+0wDAYDVR0TBAUwAwEB/zANBgkqhkiG9w0BAQsFAAOCAQEATZbL
-PdPIH8ahQpGdtTb0shcxOYcuLcrn67kxEzeOkXcOsmHhw8RdWkQiglMPBwdyi0Xj
-8yY9ri1Jv1jC/swAAmtsB6qd+oxJaiVn2G+okVX2xXaLCQROwfIcNEnwVxUXyNwG
-hMZEiNT1kymy8MI5FwQqZ4hvbbUqcMSrB2O1z5C8zwDL2eXm8LjrmRkRpb+pP9fX
-kwYPbQO4v0v4PKge2ezhWc4u0WFN3Zg68XS2YB5anKQzK1heFiB79mbHyRKF+t9c
-F4Un6peNMm7WBxup68KTBCQb6lK6jhtTUvVirMCjwaXUQOHOrRT9QzoBrfgJm0OJ
-gCAxbCdK3lcDQKxC8Q==
------END CERTIFICATE-----`
\ No newline at end of file
+func RunTrustCerts(cmd *Command, ctx *Context, args []string) error {
+	if len(args) > 1 || (len(args) == 1 && args[0] != "ls") {
+		return cmd.UsageError(ctx, "Unknown `certs trust` subcommand: %s", strings.Join(args, " "))
+	}
+
+	bundle, err := trust.Load()
+	if err != nil {
+		return err
+	}
+
+	// The API may be what's failing to connect, so its CAs are still
+	// worth listing without the hosts'.
+	var hosts []*api.Host
+	httpClient, err := ctx.NewAPIClient()
+	if err == nil {
+		hosts, err = httpClient.GetHosts()
+	}
+	if err != nil {
+		fmt.Fprintf(ctx.Stderr, "Warning: couldn't get the CAs of your hosts: %s\n", err)
+	}
+	for _, host := range hosts {
+		if strings.TrimSpace(host.CACert) == "" {
+			continue
+		}
+		if err := bundle.AddHostPEM([]byte(host.CACert), host.Name); err != nil {
+			fmt.Fprintf(ctx.Stderr, "Warning: %s\n", err)
+		}
+	}
+
+	rows := [][]string{}
+	for _, entry := range bundle.Entries {
+		rows = append(rows, []string{entry.Source, entry.Cert.Subject.CommonName, entry.Cert.NotAfter.UTC().Format("2006-01-02"), tlsconfig.Fingerprint(entry.Cert.Raw)})
+	}
+	rows = append(rows, []string{"system", "(system roots, for the API only)", "", ""})
+	return ctx.PrintList([]string{"SOURCE", "SUBJECT", "EXPIRES", "FINGERPRINT"}, rows)
+}
+
+func RunDocker(cmd *Command, ctx *Context, args []string) error {
+	parallel := ctx.Int("parallel")
+	if parallel < 1 {
+		return cmd.UsageError(ctx, "--parallel has to be at least 1, but it's %d", parallel)
+	}
+	hostNames, err := dockerHosts(cmd, ctx)
+	if err != nil {
+		return err
+	}
+	if len(hostNames) > 1 {
+		return runDockerOnHosts(ctx, hostNames, args, parallel, ctx.Bool("group"))
+	}
+
+	return WithDockerProxy(ctx, "", hostNames[0], func(listenURL string) error {
+		err := CallDocker(ctx, args, listenURL)
+		if err != nil {
+			return fmt.Errorf("Docker exited with error")
+		}
+		return nil
+	})
+}
+
+func RunProxy(cmd *Command, ctx *Context, args []string) error {
+	if len(args) > 1 {
+		return cmd.UsageError(ctx, "`deploy proxy` expects at most 1 argument, but got more: %s", strings.Join(args[1:], " "))
+	}
+
+	specifiedURL := ""
+	if len(args) == 1 {
+		specifiedURL = args[0]
+	}
+
+	hostName, err := hostFlag(cmd, ctx)
+	if err != nil {
+		return err
+	}
+	if hostName == "" {
+		hostName = "default"
+	}
+
+	if ctx.Bool("detach") {
+		return DetachProxy(ctx, hostName, specifiedURL, ctx.String("record"))
+	}
+
+	if ctx.Bool("daemon") {
+		return ServeDetachedProxy(ctx, hostName, specifiedURL, ctx.String("record"))
+	}
+
+	tap, stopRecording, err := StartRecording(ctx, ctx.String("record"), hostName)
+	if err != nil {
+		return err
+	}
+	defer stopRecording()
+
+	return WithHostProxy(ctx, specifiedURL, hostName, tap, func(p *proxy.Proxy, listenURL string) error {
+		fmt.Fprintf(ctx.Stderr, "Started proxy at %s\n", listenURL)
+
+		ctx.WaitForSignal()
+
+		fmt.Fprintf(ctx.Stderr, "\nStopping proxy (%d connections, %d handshakes saved)\n", p.Accepted(), p.Pool.Stats().HandshakesSaved())
+		return nil
+	})
+}
+
+func RunListProxies(cmd *Command, ctx *Context, args []string) error {
+	if len(args) > 0 {
+		return cmd.UsageError(ctx, "`deploy proxy ls` doesn't expect any arguments, but got: %s", strings.Join(args, " "))
+	}
+
+	dir, err := daemon.Dir()
+	if err != nil {
+		return err
+	}
+
+	states, err := daemon.List(dir)
+	if err != nil {
+		return err
+	}
+
+	rows := [][]string{}
+	for _, state := range states {
+		uptime := "starting"
+		if !state.StartedAt.IsZero() {
+			uptime = utils.HumanDuration(state.Uptime())
+		}
+		rows = append(rows, []string{
+			state.Host,
+			strconv.Itoa(state.PID),
+			state.ListenURL,
+			uptime,
+			fmt.Sprintf("%d (%d active)", state.Connections, state.Active),
+			strconv.FormatInt(state.HandshakesSaved, 10),
+		})
+	}
+	return ctx.PrintList([]string{"HOST", "PID", "LISTENING ON", "UPTIME", "CONNECTIONS", "HANDSHAKES SAVED"}, rows)
+}
+
+func RunStopProxy(cmd *Command, ctx *Context, args []string) error {
+	if len(args) > 1 {
+		return cmd.UsageError(ctx, "`deploy proxy stop` expects at most 1 argument, but got more: %s", strings.Join(args[1:], " "))
+	}
+	if ctx.Bool("all") && len(args) > 0 {
+		return cmd.UsageError(ctx, "`deploy proxy stop` doesn't take a host name with --all")
+	}
+
+	dir, err := daemon.Dir()
+	if err != nil {
+		return err
+	}
+
+	hostNames := []string{}
+	if ctx.Bool("all") {
+		states, err := daemon.List(dir)
+		if err != nil {
+			return err
+		}
+		for _, state := range states {
+			hostNames = append(hostNames, state.Host)
+		}
+	} else {
+		hostName, _ := GetHostName(args)
+		hostNames = append(hostNames, hostName)
+	}
+
+	for _, hostName := range hostNames {
+		if err := daemon.Stop(dir, hostName, 5*time.Second); err != nil {
+			return err
+		}
+		fmt.Fprintf(ctx.Stderr, "Stopped proxy to %s\n", GetHumanHostName(hostName))
+	}
+
+	return nil
+}
+
+func RunReplayProxy(cmd *Command, ctx *Context, args []string) error {
+	if len(args) < 1 {
+		return cmd.UsageError(ctx, "`deploy proxy replay` expects a recording to replay")
+	}
+	if len(args) > 2 {
+		return cmd.UsageError(ctx, "`deploy proxy replay` expects at most 2 arguments, but got more: %s", strings.Join(args[2:], " "))
+	}
+
+	f, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	_, connections, err := capture.Read(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	replayer := capture.NewReplayer(capture.Exchanges(connections))
+
+	var listenType, listenAddr string
+	if len(args) == 2 {
+		listenType, listenAddr, err = SplitURL(args[1])
+	} else {
+		var cleanUp func()
+		listenType, listenAddr, cleanUp, err = ListenAddress()
+		if cleanUp != nil {
+			defer cleanUp()
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	l, err := net.Listen(listenType, listenAddr)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	go replayer.Serve(l)
+
+	fmt.Fprintf(ctx.Stderr, "Replaying %d recorded requests at %s://%s\n", replayer.Len(), listenType, listenAddr)
+
+	ctx.WaitForSignal()
+
+	fmt.Fprintln(ctx.Stderr, "\nStopping replay")
+	return nil
+}
+
+func RunRun(cmd *Command, ctx *Context, args []string) error {
+	if len(args) == 0 {
+		return cmd.UsageError(ctx, "`deploy run` expects a command to run")
+	}
+
+	commandPath, err := exec.LookPath(args[0])
+	if err != nil {
+		return fmt.Errorf("Can't find `%s` in $PATH", args[0])
+	}
+
+	hostName, err := hostFlag(cmd, ctx)
+	if err != nil {
+		return err
+	}
+
+	return WithDockerProxy(ctx, "", hostName, func(listenURL string) error {
+		if err := CallCommand(ctx, commandPath, args[1:], listenURL); err != nil {
+			return fmt.Errorf("%s exited with error", args[0])
+		}
+		return nil
+	})
+}
+
+func RunIP(cmd *Command, ctx *Context, args []string) error {
+	if len(args) > 1 {
+		return cmd.UsageError(ctx, "`deploy ip` expects at most 1 argument, but got more: %s", strings.Join(args[1:], " "))
+	}
+
+	hostName, _ := GetHostName(args)
+
+	host, err := LookupHost(ctx, hostName)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(ctx.Stdout, host.IPAddress)
+	return nil
+}
+
+// hostFlag returns the name of the host given with -H, or of the one whose
+// labels match the selector given with -l.
+func hostFlag(cmd *Command, ctx *Context) (string, error) {
+	hostName := ctx.String("H")
+	if ctx.String("l") == "" {
+		return hostName, nil
+	}
+	if hostName != "" {
+		return "", cmd.UsageError(ctx, "`deploy %s` takes either -H or -l, not both", cmd.Name())
+	}
+	selector, err := labels.ParseSelector(ctx.String("l"))
+	if err != nil {
+		return "", cmd.UsageError(ctx, "%s", err)
+	}
+
+	names, err := selectHostNames(ctx, selector)
+	if err != nil {
+		return "", err
+	}
+	if len(names) > 1 {
+		return "", fmt.Errorf("%d hosts match %s: %s.\nPick one with -H, or narrow down -l.", len(names), selector, strings.Join(names, ", "))
+	}
+	return names[0], nil
+}
+
+// selectHostNames returns the names of the hosts in the local inventory
+// whose labels match selector, or an error if none do.
+func selectHostNames(ctx *Context, selector labels.Selector) ([]string, error) {
+	httpClient, err := ctx.NewAPIClient()
+	if err != nil {
+		return nil, err
+	}
+	hosts, err := hostInventory(ctx, httpClient).Hosts(httpClient)
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for _, host := range SelectHosts(hosts, selector) {
+		names = append(names, host.Name)
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("No hosts match %s.\nYou can view your hosts and their labels with `deploy hosts`.", selector)
+	}
+	return names, nil
+}
+
+func WithDockerProxy(ctx *Context, listenURL, hostName string, callback func(string) error) error {
+	return WithHostProxy(ctx, listenURL, hostName, nil, func(p *proxy.Proxy, listenURL string) error {
+		return callback(listenURL)
+	})
+}
+
+// How many handshaken connections a proxy keeps ready for the host, and how
+// long they're kept before the host's daemon might give up on them.
+var (
+	ProxyPoolSize    = 2
+	ProxyPoolMaxIdle = 30 * time.Second
+)
+
+// WithHostProxy starts a local proxy which forwards connections to the Docker
+// daemon on the named host over TLS, and calls callback once it's listening.
+// The proxy is stopped when callback returns. If tap isn't nil, it's shown
+// all the traffic the proxy forwards.
+func WithHostProxy(ctx *Context, listenURL, hostName string, tap proxy.Tap, callback func(*proxy.Proxy, string) error) error {
+	if hostName == "" {
+		hostName = "default"
+	}
+
+	var (
+		listenType string
+		listenAddr string
+		err        error
+	)
+
+	if listenURL == "" {
+		var cleanUp func()
+		listenType, listenAddr, cleanUp, err = ListenAddress()
+		if err != nil {
+			return err
+		}
+		// Deferred before the proxy's stopped, so it runs after.
+		defer cleanUp()
+		listenURL = fmt.Sprintf("%s://%s", listenType, listenAddr)
+	} else {
+		listenType, listenAddr, err = SplitURL(listenURL)
+		if err != nil {
+			return err
+		}
+	}
+
+	host, err := LookupHost(ctx, hostName)
+	if err != nil {
+		return err
+	}
+
+	destination := HostAddress(host)
+	ctx.Debugf("Proxying %s to %s at %s", listenURL, GetHumanHostName(hostName), destination)
+
+	config, err := tlsconfig.GetTLSConfig(host, ctx.TLSOptions())
+	if err != nil {
+		return err
+	}
+
+	knownHosts := tlsconfig.NewKnownHosts(tlsconfig.GetKnownHostsPath())
+	knownHosts.Added = func(host, fingerprint string) {
+		fmt.Fprintf(ctx.Stderr, "Added %s (%s) to the list of known hosts.\n", host, fingerprint)
+	}
+	knownHosts.Pin(config, destination)
+
+	d, err := dialer.FromEnvironment()
+	if err != nil {
+		return err
+	}
+
+	dial := func() (net.Conn, error) {
+		conn, err := d.DialTLS("tcp", destination, config)
+		if changed, ok := err.(*tlsconfig.HostChangedError); ok {
+			return nil, fmt.Errorf("%s\nIf you know why, you can accept the new certificate with `deploy hosts trust %s`.", changed, hostName)
+		}
+		return conn, err
+	}
+
+	pool := proxy.NewPool(
+		dial,
+		ProxyPoolSize,
+		ProxyPoolMaxIdle,
+	)
+
+	p := proxy.NewWithPool(
+		func() (net.Listener, error) { return net.Listen(listenType, listenAddr) },
+		pool,
+	)
+	p.Tap = tap
+	p.Stderr = ctx.Stderr
+
+	go p.Start()
+	defer p.Stop()
+
+	if err := <-p.ErrorChannel; err != nil {
+		return err
+	}
+
+	return callback(p, listenURL)
+}
+
+// DetachProxy starts 'deploy proxy' in a new session with its output going to
+// a log file, and waits for it to report that it's listening.
+func DetachProxy(ctx *Context, hostName, listenURL, recordFile string) error {
+	dir, err := daemon.Dir()
+	if err != nil {
+		return err
+	}
+
+	state, err := daemon.Get(dir, hostName)
+	if err != nil {
+		return err
+	}
+	if state != nil {
+		return fmt.Errorf("A proxy to %s is already running at %s (pid %d).\nYou can stop it with `deploy proxy stop %s`.", GetHumanHostName(hostName), state.ListenURL, state.PID, hostName)
+	}
+
+	// The background process has no terminal to prompt on, so make sure
+	// we're logged in before starting it, and pass it the passphrase for
+	// the client key, if it needs one.
+	if _, err := ctx.NewAPIClient(); err != nil {
+		return err
+	}
+	if err := unlockClientKey(ctx, hostName); err != nil {
+		return err
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	logPath := daemon.LogFilePath(dir, hostName)
+	logFile, err := os.OpenFile(logPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer logFile.Close()
+
+	args := []string{"proxy", "-daemon", "-H", hostName}
+	if ctx.Config.DebugTLS {
+		args = append([]string{"--debug-tls"}, args...)
+	}
+	if ctx.Config.InsecureAPI {
+		args = append([]string{"--insecure-api"}, args...)
+	}
+	if ctx.Config.Debug {
+		args = append([]string{"--debug"}, args...)
+	}
+	if ctx.Config.Context != "" {
+		args = append([]string{"--context", ctx.Config.Context}, args...)
+	}
+	if recordFile != "" {
+		// The background process doesn't share our working directory.
+		recordPath, err := filepath.Abs(recordFile)
+		if err != nil {
+			return err
+		}
+		args = append(args, "-record", recordPath)
+	}
+	if listenURL != "" {
+		args = append(args, listenURL)
+	}
+
+	child := exec.Command(executable, args...)
+	child.Stdout = logFile
+	child.Stderr = logFile
+	if passphrases := ctx.Keys.Passphrases(); len(passphrases) > 0 {
+		child.Stdin = bytes.NewReader(append(bytes.Join(passphrases, []byte("\n")), '\n'))
+	}
+	child.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := child.Start(); err != nil {
+		return err
+	}
+
+	exited := make(chan error, 1)
+	go func() { exited <- child.Wait() }()
+
+	timeout := time.After(30 * time.Second)
+	for {
+		select {
+		case <-exited:
+			return fmt.Errorf("The proxy to %s exited while starting up. See %s for details.", GetHumanHostName(hostName), logPath)
+		case <-timeout:
+			child.Process.Kill()
+			return fmt.Errorf("Timed out waiting for the proxy to %s to start. See %s for details.", GetHumanHostName(hostName), logPath)
+		case <-time.After(100 * time.Millisecond):
+		}
+
+		state, err := daemon.Get(dir, hostName)
+		if err != nil {
+			return err
+		}
+		if state != nil && state.ListenURL != "" {
+			fmt.Fprintf(ctx.Stderr, "Started proxy at %s (pid %d)\n", state.ListenURL, state.PID)
+			return nil
+		}
+	}
+}
+
+// ServeDetachedProxy runs in the process started by DetachProxy. It holds the
+// host's pidfile locked and keeps its state file up to date until it's signalled.
+func ServeDetachedProxy(ctx *Context, hostName, listenURL, recordFile string) error {
+	dir, err := daemon.Dir()
+	if err != nil {
+		return err
+	}
+
+	pidFile, err := daemon.WritePID(dir, hostName)
+	if err != nil {
+		return err
+	}
+	defer pidFile.Remove()
+
+	// DetachProxy sends the passphrases for the client key on stdin, one to
+	// a line, since there's no terminal to ask on.
+	passphrases := bufio.NewReader(ctx.Stdin)
+	ctx.Keys = &tlsconfig.Keys{Stderr: ctx.Stderr, Prompt: func() ([]byte, error) {
+		line, err := passphrases.ReadBytes('\n')
+		if err != nil {
+			return nil, errors.New("The client key is encrypted, and no passphrase was given for it")
+		}
+		return bytes.TrimSuffix(line, []byte("\n")), nil
+	}}
+
+	tap, stopRecording, err := StartRecording(ctx, recordFile, hostName)
+	if err != nil {
+		return err
+	}
+	defer stopRecording()
+
+	return WithHostProxy(ctx, listenURL, hostName, tap, func(p *proxy.Proxy, listenURL string) error {
+		state := &daemon.State{
+			Host:      hostName,
+			PID:       os.Getpid(),
+			ListenURL: listenURL,
+			Socket:    daemon.SocketPath(listenURL),
+			StartedAt: time.Now(),
+		}
+		if err := daemon.WriteState(dir, state); err != nil {
+			return err
+		}
+		fmt.Fprintf(ctx.Stderr, "%s Started proxy to %s at %s\n", time.Now().Format(time.RFC3339), hostName, listenURL)
+
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case sig := <-c:
+				fmt.Fprintf(ctx.Stderr, "%s Stopping proxy (%s)\n", time.Now().Format(time.RFC3339), sig)
+				return nil
+			case <-ticker.C:
+				saved := p.Pool.Stats().HandshakesSaved()
+				if p.Accepted() == state.Connections && p.Active() == state.Active && saved == state.HandshakesSaved {
+					continue
+				}
+				state.Connections = p.Accepted()
+				state.Active = p.Active()
+				state.HandshakesSaved = saved
+				if err := daemon.WriteState(dir, state); err != nil {
+					fmt.Fprintf(ctx.Stderr, "error writing proxy state: %s\n", err)
+				}
+			}
+		}
+	})
+}
+
+// StartRecording creates a capture file for a proxy to hostName. It returns
+// a nil Tap if filename is empty.
+func StartRecording(ctx *Context, filename, hostName string) (proxy.Tap, func(), error) {
+	if filename == "" {
+		return nil, func() {}, nil
+	}
+
+	recorder, f, err := capture.Create(filename, hostName)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	fmt.Fprintf(ctx.Stderr, "Warning: recording decrypted traffic to %s. It will contain everything sent to the host, including credentials.\n", filename)
+
+	return recorder, func() {
+		if err := recorder.Err(); err != nil {
+			fmt.Fprintf(ctx.Stderr, "Error writing recording to %s: %s\n", filename, err)
+		}
+		f.Close()
+	}, nil
+}
+
+// ListenAddress returns a Unix socket in a new temporary directory, and a
+// function which removes the directory once the socket's closed.
+func ListenAddress() (string, string, func(), error) {
+	dir, err := ioutil.TempDir("", "deploy-")
+	if err != nil {
+		return "", "", nil, err
+	}
+
+	return "unix", path.Join(dir, "deploy.sock"), func() { os.RemoveAll(dir) }, nil
+}
+
+func SplitURL(specifiedURL string) (string, string, error) {
+	u, err := url.Parse(specifiedURL)
+	if err != nil {
+		return "", "", err
+	}
+
+	switch u.Scheme {
+	case "unix":
+		return u.Scheme, u.Path, nil
+	case "tcp":
+		return u.Scheme, u.Host, nil
+	}
+
+	return "", "", fmt.Errorf("Unsupported URL %q: expected a unix:// or tcp:// URL", specifiedURL)
+}
+
+func CallDocker(ctx *Context, args []string, dockerHost string) error {
+	dockerPath := GetDockerPath()
+	if dockerPath == "" {
+		return errors.New("Can't find `docker` executable in $PATH.\nYou might need to install it: http://docs.docker.io/en/latest/installation/#installation-list")
+	}
+
+	return CallCommand(ctx, dockerPath, args, dockerHost)
+}
+
+// CallCommand runs a command with DOCKER_HOST pointing at a proxy.
+func CallCommand(ctx *Context, commandPath string, args []string, dockerHost string) error {
+	cmd := exec.Command(commandPath, args...)
+	cmd.Env = []string{"DOCKER_HOST=" + dockerHost}
+	for _, env := range os.Environ() {
+		// The proxy takes care of TLS, so docker talks to it in the clear.
+		if !strings.HasPrefix(env, "DOCKER_HOST=") && !strings.HasPrefix(env, "DOCKER_TLS_VERIFY=") && !strings.HasPrefix(env, "DOCKER_CERT_PATH=") {
+			cmd.Env = append(cmd.Env, env)
+		}
+	}
+	ctx.Debugf("Running %s %s with DOCKER_HOST=%s", commandPath, strings.Join(args, " "), dockerHost)
+	cmd.Stdin = ctx.Stdin
+	cmd.Stdout = ctx.Stdout
+	cmd.Stderr = ctx.Stderr
+	return cmd.Run()
+}
+
+func GetDockerPath() string {
+	for _, dir := range strings.Split(os.Getenv("PATH"), ":") {
+		dockerPath := path.Join(dir, "docker")
+		_, err := os.Stat(dockerPath)
+		if err == nil {
+			return dockerPath
+		}
+	}
+	return ""
+}
+
+func GetHostName(args []string) (string, string) {
+	hostName := "default"
+
+	if len(args) > 0 {
+		hostName = args[0]
+	}
+
+	return hostName, GetHumanHostName(hostName)
+}
+
+func GetHumanHostName(hostName string) string {
+	if hostName == "default" {
+		return "default host"
+	} else {
+		return fmt.Sprintf("host '%s'", hostName)
+	}
+}
+
+func GetHostSize(sizeString string) (int, string) {
+	bytes, err := utils.RAMInBytes(sizeString)
+	if err != nil {
+		return -1, sizeString
+	}
+
+	megs := bytes / (1024 * 1024)
+	if megs < 1 {
+		return -1, sizeString
+	}
+
+	return int(megs), sizeString
+}
+
+// HostAddress returns the address of a host's Docker daemon.
+func HostAddress(host *api.Host) string {
+	return fmt.Sprintf("%s:%d", host.IPAddress, host.Port)
+}
+
+func GetHost(ctx *Context, hostName string) (*api.Host, error) {
+	httpClient, err := ctx.NewAPIClient()
+	if err != nil {
+		return nil, err
+	}
+
+	host, err := httpClient.GetHost(hostName)
+	if err != nil {
+		// HACK. api.go should decode JSON and return a specific type of error for this case.
+		if strings.Contains(err.Error(), "Not found") {
+			return nil, hostNotFound(hostName)
+		}
+
+		return nil, err
+	}
+
+	return host, nil
+}
+
+// LookupHost is like GetHost, but looks the host up in the local inventory
+// of hosts, which is only checked with the API once it's older than
+// inventory.DefaultTTL, and is used as it is if the API can't be reached.
+func LookupHost(ctx *Context, hostName string) (*api.Host, error) {
+	httpClient, err := ctx.NewAPIClient()
+	if err != nil {
+		return nil, err
+	}
+
+	host, err := hostInventory(ctx, httpClient).Host(httpClient, hostName)
+	if err == inventory.ErrNotFound {
+		return nil, hostNotFound(hostName)
+	}
+	return host, err
+}
+
+// unlockClientKey loads the client key for a host, so that if it's
+// encrypted, its passphrase is asked for now, while there's a terminal to ask
+// on. Problems finding the host are left for connecting to it to report.
+func unlockClientKey(ctx *Context, hostName string) error {
+	host, err := LookupHost(ctx, hostName)
+	if err != nil {
+		return nil
+	}
+	_, err = tlsconfig.LoadClientCertificate(host, ctx.TLSOptions())
+	return err
+}
+
+func hostNotFound(hostName string) error {
+	humanName := GetHumanHostName(hostName)
+	return fmt.Errorf("%s doesn't seem to be running.\nYou can create it with `deploy hosts create %s`.", utils.Capitalize(humanName), hostName)
+}
+
+// hostInventory returns the local inventory of the hosts of httpClient's
+// API, which --refresh makes check with the API every time.
+func hostInventory(ctx *Context, httpClient *api.HTTPClient) *inventory.Inventory {
+	inv := inventory.ForAPI(httpClient)
+	inv.Refresh = ctx.Config.Refresh
+	inv.Stderr = ctx.Stderr
+	return inv
+}
+
+// forgetHosts empties the local inventory of hosts, after they've been
+// changed.
+func forgetHosts(ctx *Context, httpClient *api.HTTPClient) {
+	if err := hostInventory(ctx, httpClient).Forget(); err != nil {
+		fmt.Fprintf(ctx.Stderr, "Warning: %s\n", err)
+	}
+}
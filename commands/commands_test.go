@@ -0,0 +1,377 @@
+package commands
+
+import (
+	"bytes"
+	"crypto/x509"
+	"github.com/bbbacsa/deploy.io/api"
+	"github.com/bbbacsa/deploy.io/api/apitest"
+	"github.com/bbbacsa/deploy.io/dialer"
+	"github.com/bbbacsa/deploy.io/dockertest"
+	"github.com/bbbacsa/deploy.io/proxy"
+	"github.com/bbbacsa/deploy.io/tlsconfig"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// When run as "docker", the test binary acts like the docker command-line
+// tool.
+func TestMain(m *testing.M) {
+	if os.Getenv("DEPLOY_TEST_FAKE_DOCKER") == "1" {
+		if err := dockertest.RunCLI(os.Args[1:], os.Getenv("DOCKER_HOST"), os.Stdin, os.Stdout); err != nil {
+			os.Stderr.WriteString(err.Error() + "\n")
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// testEnvironment is a fake API with one user, whose default host is a fake
+// daemon, and a fake docker on $PATH.
+type testEnvironment struct {
+	API    *apitest.Server
+	Daemon *dockertest.Daemon
+	Host   apitest.Host
+	Key    string
+	Dir    string
+}
+
+func newTestEnvironment(t *testing.T) *testEnvironment {
+	env := &testEnvironment{API: apitest.NewServer()}
+
+	dir, err := ioutil.TempDir("", "deploy-commands-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	env.Dir = dir
+
+	env.API.SetEnv(t)
+	env.Key = env.API.AddUser("bfirsh", "secret")
+	env.Host = env.API.AddHost("bfirsh", "default", 512)
+
+	env.Daemon, err = dockertest.NewDaemon(env.API.CA, func(cert *x509.Certificate) bool {
+		return env.API.IsClientCertValid(env.Host.ID, cert)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	env.Daemon.AddContainer(dockertest.Container{Id: "abc123", Image: "busybox", Names: []string{"/web"}})
+	if err := env.API.SetHostAddress("bfirsh", "default", env.Daemon.Addr); err != nil {
+		t.Fatal(err)
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(executable, path.Join(dir, "docker")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Proxies listen on sockets in $TMPDIR.
+	if err := os.Mkdir(path.Join(dir, "tmp"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("HOME", dir)
+	t.Setenv("TMPDIR", path.Join(dir, "tmp"))
+	t.Setenv("PATH", dir+":"+os.Getenv("PATH"))
+	t.Setenv("DEPLOY_TEST_FAKE_DOCKER", "1")
+	return env
+}
+
+// APIClient returns a client for the fake API, logged in as its user.
+func (env *testEnvironment) APIClient() (*api.HTTPClient, error) {
+	return &api.HTTPClient{BaseURL: env.API.URL, Username: "bfirsh", Key: env.Key}, nil
+}
+
+// contextAPIClient is like APIClient, but talks to the API named by
+// --context instead, if it's set.
+func (env *testEnvironment) contextAPIClient(config *Config) (*api.HTTPClient, error) {
+	if config.Context == "" {
+		return env.APIClient()
+	}
+	if err := api.CheckBaseURL(config.Context, config.InsecureAPI); err != nil {
+		return nil, err
+	}
+	return &api.HTTPClient{BaseURL: config.Context, Username: "bfirsh", Key: env.Key}, nil
+}
+
+// Context returns a Context which reads stdin and writes to buffers. Long
+// running commands stop as soon as they've started.
+func (env *testEnvironment) Context(stdin string) (*Context, *syncBuffer, *syncBuffer) {
+	stdout, stderr := &syncBuffer{}, &syncBuffer{}
+	config := &Config{}
+	return &Context{
+		Stdin:         strings.NewReader(stdin),
+		Stdout:        stdout,
+		Stderr:        stderr,
+		NewAPIClient:  func() (*api.HTTPClient, error) { return env.contextAPIClient(config) },
+		WaitForSignal: func() {},
+		Keys:          &tlsconfig.Keys{Stderr: stderr},
+		Config:        config,
+	}, stdout, stderr
+}
+
+func (env *testEnvironment) Close() {
+	env.Daemon.Close()
+	env.API.Close()
+	os.RemoveAll(env.Dir)
+}
+
+// syncBuffer is a buffer which a command and the processes and goroutines
+// it starts can all write to at once.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestDocker(t *testing.T) {
+	env := newTestEnvironment(t)
+	defer env.Close()
+
+	ctx, stdout, _ := env.Context("")
+	if err := Docker.Execute(ctx, []string{"version"}); err != nil {
+		t.Fatal(err)
+	}
+	if output := stdout.String(); !strings.Contains(output, "Server version: "+dockertest.Version) {
+		t.Errorf("expected the daemon's version, got %q", output)
+	}
+
+	requests := env.Daemon.Requests()
+	if len(requests) != 1 || requests[0] != "GET /version" {
+		t.Errorf("expected a GET request to /version, got %v", requests)
+	}
+
+	// The host was pinned on first use.
+	knownHosts := tlsconfig.NewKnownHosts(tlsconfig.GetKnownHostsPath())
+	if _, ok, _ := knownHosts.Lookup(env.Daemon.Addr); !ok {
+		t.Errorf("expected %s to be in known_hosts", env.Daemon.Addr)
+	}
+}
+
+func TestRun(t *testing.T) {
+	env := newTestEnvironment(t)
+	defer env.Close()
+
+	ctx, stdout, _ := env.Context("")
+	if err := Run.Execute(ctx, []string{"docker", "ps"}); err != nil {
+		t.Fatal(err)
+	}
+	if output := stdout.String(); output != "abc123 /web\n" {
+		t.Errorf("expected the daemon's containers, got %q", output)
+	}
+}
+
+func TestProxyAttach(t *testing.T) {
+	env := newTestEnvironment(t)
+	defer env.Close()
+
+	ctx, _, _ := env.Context("")
+	err := WithHostProxy(ctx, "", "default", nil, func(p *proxy.Proxy, listenURL string) error {
+		client, err := dockertest.NewClient(listenURL)
+		if err != nil {
+			return err
+		}
+
+		var output strings.Builder
+		if err := dockertest.RunCLI([]string{"attach", "abc123"}, listenURL, strings.NewReader("hello\n"), &output); err != nil {
+			return err
+		}
+		if output.String() != "hello\n" {
+			t.Errorf("expected the container to echo hello, got %q", output.String())
+		}
+
+		resp, err := client.Do("GET", "/_ping")
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != 200 {
+			t.Errorf("expected the daemon to answer a ping, got %s", resp.Status)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRevokedClientCertificate(t *testing.T) {
+	env := newTestEnvironment(t)
+	defer env.Close()
+
+	// The CLI fetches the host after this, so it gets the new certificate.
+	httpClient, _ := env.APIClient()
+	if _, _, err := httpClient.RotateCertificates("default", nil); err != nil {
+		t.Fatal(err)
+	}
+	ctx, _, _ := env.Context("")
+	if err := Docker.Execute(ctx, []string{"ps"}); err != nil {
+		t.Fatalf("expected the new certificate to be accepted, got %v", err)
+	}
+
+	// A host with a revoked certificate is refused.
+	host, _ := env.API.Host("bfirsh", "default")
+	if _, _, err := httpClient.RotateCertificates("default", nil); err != nil {
+		t.Fatal(err)
+	}
+	old := &api.Host{ID: host.ID, Name: host.Name, URL: host.URL, IPAddress: host.IPAddress, Port: int64(host.Port), ClientCert: host.ClientCert, ClientKey: host.ClientKey, CACert: host.CACert}
+	config, err := tlsconfig.GetTLSConfig(old, &tlsconfig.Options{Keys: &tlsconfig.Keys{}, Stderr: ioutil.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := dialer.FromEnvironment()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := d.DialTLS("tcp", HostAddress(old), config)
+	if err == nil {
+		// With TLS 1.3 the server's refusal arrives after the handshake.
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err = conn.Read(make([]byte, 1))
+		conn.Close()
+	}
+	if err == nil || isTimeout(err) {
+		t.Errorf("expected a revoked certificate to be refused, got %v", err)
+	}
+}
+
+func TestHostNamesCache(t *testing.T) {
+	env := newTestEnvironment(t)
+	defer env.Close()
+
+	ctx, _, _ := env.Context("")
+	names, err := hostNames(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(names, " ") != "default" {
+		t.Fatalf("expected [default], got %v", names)
+	}
+
+	// Hosts created elsewhere aren't seen until the cache expires.
+	env.API.AddHost("bfirsh", "web", 512)
+	if names, _ := hostNames(ctx); strings.Join(names, " ") != "default" {
+		t.Errorf("expected the cached [default], got %v", names)
+	}
+
+	// Ones created with deploy are seen straight away.
+	if err := Root.Execute(ctx, []string{"hosts", "create", "db"}); err != nil {
+		t.Fatal(err)
+	}
+	if names, _ := hostNames(ctx); strings.Join(names, " ") != "db default web" {
+		t.Errorf("expected [db default web], got %v", names)
+	}
+}
+
+func TestIPWhenAPIIsDown(t *testing.T) {
+	env := newTestEnvironment(t)
+	defer env.Close()
+
+	ctx, stdout, _ := env.Context("")
+	if err := Root.Execute(ctx, []string{"ip"}); err != nil {
+		t.Fatal(err)
+	}
+	ip := stdout.String()
+
+	// Within the TTL, the API isn't asked at all.
+	requests := len(env.API.Requests())
+	ctx, stdout, _ = env.Context("")
+	if err := Root.Execute(ctx, []string{"ip"}); err != nil {
+		t.Fatal(err)
+	}
+	if stdout.String() != ip || len(env.API.Requests()) != requests {
+		t.Errorf("expected %q from the inventory without asking the API, got %q after %d requests", ip, stdout.String(), len(env.API.Requests())-requests)
+	}
+
+	// With --refresh it is, and when it can't be reached, the inventory is
+	// used anyway, with a warning.
+	env.API.SetUnreachable(true)
+	ctx, stdout, stderr := env.Context("")
+	if err := Root.Execute(ctx, []string{"ip", "--refresh"}); err != nil {
+		t.Fatal(err)
+	}
+	if stdout.String() != ip {
+		t.Errorf("expected %q, got %q", ip, stdout.String())
+	}
+	if !strings.Contains(stderr.String(), "Warning: couldn't reach the Deploy.IO API") {
+		t.Errorf("expected a warning, got %q", stderr.String())
+	}
+
+	// Hosts that aren't in it are an error, as when the API is up.
+	ctx, _, _ = env.Context("")
+	if err := Root.Execute(ctx, []string{"ip", "nothere"}); err == nil {
+		t.Error("expected an error for a host that isn't in the inventory")
+	}
+}
+
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
+func TestPrefixWriter(t *testing.T) {
+	var buffer bytes.Buffer
+	w := &prefixWriter{w: &buffer, prefix: "web | ", mu: new(sync.Mutex)}
+	for _, s := range []string{"one\ntw", "o\n", "", "thr", "ee"} {
+		if _, err := w.Write([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if expected := "web | one\nweb | two\n"; buffer.String() != expected {
+		t.Errorf("expected %q before flushing, got %q", expected, buffer.String())
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if expected := "web | one\nweb | two\nweb | three\n"; buffer.String() != expected {
+		t.Errorf("expected %q, got %q", expected, buffer.String())
+	}
+}
+
+func TestCallCommandLeavesEnvironmentAlone(t *testing.T) {
+	t.Setenv("DOCKER_HOST", "tcp://example.com:2376")
+	t.Setenv("DOCKER_TLS_VERIFY", "1")
+	t.Setenv("DOCKER_CERT_PATH", "/home/me/.docker")
+
+	var stdout bytes.Buffer
+	ctx := &Context{Stdin: strings.NewReader(""), Stdout: &stdout, Stderr: ioutil.Discard, Config: &Config{}}
+	if err := CallCommand(ctx, "/usr/bin/env", nil, "unix:///tmp/proxy.sock"); err != nil {
+		t.Fatal(err)
+	}
+
+	env := strings.Split(stdout.String(), "\n")
+	for _, name := range []string{"DOCKER_TLS_VERIFY", "DOCKER_CERT_PATH"} {
+		for _, variable := range env {
+			if strings.HasPrefix(variable, name+"=") {
+				t.Errorf("expected %s not to be passed on, got %s", name, variable)
+			}
+		}
+	}
+	if !strings.Contains(stdout.String(), "DOCKER_HOST=unix:///tmp/proxy.sock\n") {
+		t.Errorf("expected DOCKER_HOST to point at the proxy, got %q", stdout.String())
+	}
+
+	if os.Getenv("DOCKER_HOST") != "tcp://example.com:2376" || os.Getenv("DOCKER_TLS_VERIFY") != "1" || os.Getenv("DOCKER_CERT_PATH") != "/home/me/.docker" {
+		t.Error("expected deploy's own environment to be left alone")
+	}
+}
@@ -0,0 +1,267 @@
+package commands
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+)
+
+// A Completion is something a word on the command line could be completed
+// to, with an optional description for shells that show one.
+type Completion struct {
+	Value       string
+	Description string
+}
+
+var CompletionScript = &Command{
+	UsageLine: "completion SHELL",
+	Short:     "Print a shell completion script",
+	Long: `Print a script which completes deploy's commands, options and host names
+in SHELL, which can be bash, zsh or fish.
+
+To load it in every bash or zsh shell, add this to ~/.bashrc or ~/.zshrc:
+
+    source <(deploy completion bash)
+
+For fish, save it with your other completions:
+
+    $ deploy completion fish > ~/.config/fish/completions/deploy.fish
+
+Host names come from the local inventory of hosts in ~/.deploy/cache, so
+they're only fetched from the API once a minute.
+`,
+	Complete: func(ctx *Context, args []string) []Completion {
+		if len(args) > 0 {
+			return nil
+		}
+		return []Completion{{Value: "bash"}, {Value: "fish"}, {Value: "zsh"}}
+	},
+}
+
+// CompleteLine is what the completion scripts run. It prints what the
+// last of its arguments could be completed to, one per line, followed by a
+// tab and a description if there is one.
+var CompleteLine = &Command{
+	UsageLine: "__complete [WORD...] PARTIAL",
+	Short:     "Complete a command line",
+	Hidden:    true,
+	RawArgs:   true,
+}
+
+func RunCompletionScript(cmd *Command, ctx *Context, args []string) error {
+	if len(args) != 1 {
+		return cmd.UsageError(ctx, "`deploy completion` expects 1 argument, but got %d", len(args))
+	}
+	script, ok := completionScripts[args[0]]
+	if !ok {
+		return cmd.UsageError(ctx, "Unsupported shell %q: expected bash, zsh or fish", args[0])
+	}
+	_, err := fmt.Fprint(ctx.Stdout, script)
+	return err
+}
+
+func RunCompleteLine(cmd *Command, ctx *Context, args []string) error {
+	if len(args) == 0 {
+		args = []string{""}
+	}
+	// There's nobody to answer a prompt while the shell's waiting.
+	ctx.Config.NoPrompt = true
+
+	for _, completion := range Completions(ctx, args[:len(args)-1], args[len(args)-1]) {
+		if completion.Description != "" {
+			fmt.Fprintf(ctx.Stdout, "%s\t%s\n", completion.Value, completion.Description)
+		} else {
+			fmt.Fprintln(ctx.Stdout, completion.Value)
+		}
+	}
+	return nil
+}
+
+// Completions returns what partial could be completed to, after words, on a
+// deploy command line. Global flags in words are applied to ctx.Config, so
+// e.g. host names come from the API given by --context.
+func Completions(ctx *Context, words []string, partial string) []Completion {
+	cmd := Root
+	flags := cmd.FlagSet(ctx)
+	positional := []string{}
+	var pending *flag.Flag
+
+	for _, word := range words {
+		if pending != nil {
+			flags.Set(pending.Name, word)
+			pending = nil
+			continue
+		}
+		if len(positional) == 0 && strings.HasPrefix(word, "-") && word != "-" {
+			name := strings.TrimLeft(word, "-")
+			if i := strings.Index(name, "="); i >= 0 {
+				flags.Set(name[:i], name[i+1:])
+			} else if f := flags.Lookup(name); f != nil && !isBoolFlag(f) {
+				pending = f
+			}
+			continue
+		}
+		if len(positional) == 0 {
+			if subcommand := cmd.Subcommand(word); subcommand != nil && !subcommand.Hidden {
+				cmd = subcommand
+				flags = cmd.FlagSet(ctx)
+				continue
+			}
+		}
+		positional = append(positional, word)
+	}
+
+	candidates := []Completion{}
+	switch {
+	case pending != nil:
+		candidates = completeFlagValue(ctx, pending)
+	case len(positional) == 0 && strings.HasPrefix(partial, "-"):
+		flags.VisitAll(func(f *flag.Flag) {
+			if f.Usage == "" {
+				return
+			}
+			name := "-" + f.Name
+			if len(f.Name) > 1 {
+				name = "-" + name
+			}
+			_, usage := flag.UnquoteUsage(f)
+			candidates = append(candidates, Completion{Value: name, Description: usage})
+		})
+	default:
+		if len(positional) == 0 {
+			for _, subcommand := range cmd.Subcommands {
+				if !subcommand.Hidden {
+					candidates = append(candidates, Completion{Value: subcommand.Name(), Description: subcommand.Short})
+				}
+			}
+		}
+		if cmd.Complete != nil {
+			candidates = append(candidates, cmd.Complete(ctx, positional)...)
+		}
+	}
+
+	completions := []Completion{}
+	for _, candidate := range candidates {
+		if strings.HasPrefix(candidate.Value, partial) {
+			completions = append(completions, candidate)
+		}
+	}
+	return completions
+}
+
+// completeFlagValue returns what a flag's value could be, going by the name
+// of its value in its usage, e.g. `HOST`.
+func completeFlagValue(ctx *Context, f *flag.Flag) []Completion {
+	name, _ := flag.UnquoteUsage(f)
+	switch name {
+	case "HOST":
+		return completeHostName(ctx, nil)
+	case "FORMAT":
+		return []Completion{{Value: "table"}, {Value: "json"}}
+	case "MEMORY":
+		return []Completion{{Value: "512M"}, {Value: "1G"}, {Value: "2G"}, {Value: "4G"}, {Value: "8G"}}
+	}
+	return nil
+}
+
+func isBoolFlag(f *flag.Flag) bool {
+	b, ok := f.Value.(interface {
+		IsBoolFlag() bool
+	})
+	return ok && b.IsBoolFlag()
+}
+
+// completeHostName completes the first argument of commands which take a
+// host name.
+func completeHostName(ctx *Context, args []string) []Completion {
+	if len(args) > 0 {
+		return nil
+	}
+	names, err := hostNames(ctx)
+	if err != nil {
+		ctx.Debugf("Can't complete host names: %s", err)
+		return nil
+	}
+	completions := []Completion{}
+	for _, name := range names {
+		completions = append(completions, Completion{Value: name})
+	}
+	return completions
+}
+
+// hostNames returns the names of the user's hosts, from the local inventory.
+func hostNames(ctx *Context) ([]string, error) {
+	httpClient, err := ctx.NewAPIClient()
+	if err != nil {
+		return nil, err
+	}
+	hosts, err := hostInventory(ctx, httpClient).Hosts(httpClient)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, host := range hosts {
+		names = append(names, host.Name)
+	}
+	return names, nil
+}
+
+var completionScripts = map[string]string{
+	"bash": `# bash completion for deploy. To load it in every shell, add this to
+# ~/.bashrc:
+#
+#     source <(deploy completion bash)
+
+_deploy() {
+	local IFS=$'\n'
+	COMPREPLY=($(deploy __complete "${COMP_WORDS[@]:1:COMP_CWORD-1}" "${COMP_WORDS[COMP_CWORD]}" 2>/dev/null | cut -f1))
+}
+
+complete -o default -F _deploy deploy
+`,
+
+	"zsh": `#compdef deploy
+# zsh completion for deploy. To load it in every shell, add this to
+# ~/.zshrc, after compinit:
+#
+#     source <(deploy completion zsh)
+
+_deploy() {
+	local -a candidates
+	local line
+	for line in "${(@f)$(deploy __complete "${(@)words[2,CURRENT-1]}" "${words[CURRENT]}" 2>/dev/null)}"; do
+		[[ -n $line ]] || continue
+		if [[ $line == *$'\t'* ]]; then
+			candidates+=("${${line%%$'\t'*}//:/\\:}:${line#*$'\t'}")
+		else
+			candidates+=("${line//:/\\:}")
+		fi
+	done
+	if (( ${#candidates} )); then
+		_describe -t values deploy candidates
+	else
+		_files
+	fi
+}
+
+compdef _deploy deploy
+`,
+
+	"fish": `# fish completion for deploy. To load it in every shell, run:
+#
+#     deploy completion fish > ~/.config/fish/completions/deploy.fish
+
+function __deploy_complete
+	set -l words (commandline -opc)
+	set -e words[1]
+	set -l candidates (deploy __complete $words (commandline -ct) 2>/dev/null)
+	if test (count $candidates) -eq 0
+		__fish_complete_path (commandline -ct)
+	else
+		printf '%s\n' $candidates
+	end
+end
+
+complete -c deploy -f -a '(__deploy_complete)'
+`,
+}
@@ -0,0 +1,234 @@
+package commands
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/bbbacsa/deploy.io/api"
+	"github.com/bbbacsa/deploy.io/authenticator"
+	"github.com/bbbacsa/deploy.io/constants"
+	"github.com/bbbacsa/deploy.io/tlsconfig"
+	"github.com/bbbacsa/deploy.io/vendor/code.google.com/p/gopass"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+)
+
+// Context is what a command runs with. Commands read and write through it,
+// rather than os.Stdin, os.Stdout and os.Stderr, and get their API client
+// from it, so that they can be run from tests.
+type Context struct {
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+
+	// NewAPIClient returns a client for the Deploy.IO API, asking the user
+	// to log in if they haven't already.
+	NewAPIClient func() (*api.HTTPClient, error)
+
+	// WaitForSignal blocks until the user asks a long-running command,
+	// like 'deploy proxy', to stop.
+	WaitForSignal func()
+
+	// Keys loads the client keys for hosts, asking the user for the
+	// passphrase of any that are encrypted.
+	Keys *tlsconfig.Keys
+
+	Config *Config
+
+	// Flags holds the flags of the command being run.
+	Flags *flag.FlagSet
+
+	stdin *bufio.Reader
+}
+
+// Config holds the options set by the global flags.
+type Config struct {
+	// Context is the URL of the API to use. The default is
+	// DEPLOY_API_URL, or Deploy.IO's own.
+	Context string
+
+	Debug       bool
+	DebugTLS    bool
+	InsecureAPI bool
+
+	// Refresh makes commands fetch hosts from the API, rather than the
+	// local inventory.
+	Refresh bool
+
+	// Format is how lists are printed: "table" or "json".
+	Format string
+
+	// NoPrompt is set when there's nobody to ask to log in, e.g. when
+	// completing a command line in the shell.
+	NoPrompt bool
+}
+
+func (c *Config) globalFlags(flags *flag.FlagSet) {
+	flags.StringVar(&c.Context, "context", c.Context, "Use the API at `URL`, rather than $DEPLOY_API_URL")
+	flags.BoolVar(&c.Debug, "debug", c.Debug, "Print what deploy is doing to stderr")
+	flags.BoolVar(&c.DebugTLS, "debug-tls", c.DebugTLS, "Write TLS secrets to $SSLKEYLOGFILE, for debugging")
+	flags.StringVar(&c.Format, "format", c.Format, "Print lists as `FORMAT`, either table or json (default table)")
+	flags.BoolVar(&c.InsecureAPI, "insecure-api", c.InsecureAPI, "Allow a plain http:// API URL, which sends your key unencrypted")
+	flags.BoolVar(&c.Refresh, "refresh", c.Refresh, "Fetch hosts from the API, rather than ~/.deploy/cache")
+}
+
+func (c *Config) check() error {
+	switch c.Format {
+	case "", "table", "json":
+		return nil
+	}
+	return fmt.Errorf("Unsupported format %q: expected table or json", c.Format)
+}
+
+// NewContext returns a Context for the process's own stdin, stdout and
+// stderr, which logs in to the API as the user.
+func NewContext() *Context {
+	ctx := &Context{
+		Stdin:         os.Stdin,
+		Stdout:        os.Stdout,
+		Stderr:        os.Stderr,
+		WaitForSignal: WaitForSignal,
+		Config:        &Config{},
+	}
+	ctx.NewAPIClient = func() (*api.HTTPClient, error) {
+		return authenticator.AuthenticateContext(ctx.Config.Context, &authenticator.Options{
+			In:          ctx.Stdin,
+			Out:         ctx.Stdout,
+			NoPrompt:    ctx.Config.NoPrompt,
+			InsecureAPI: ctx.Config.InsecureAPI,
+		})
+	}
+	ctx.Keys = &tlsconfig.Keys{Stderr: ctx.Stderr, Prompt: func() ([]byte, error) {
+		passphrase, err := gopass.GetPassTo(ctx.Stderr, "Passphrase for the client key: ")
+		if err != nil {
+			return nil, err
+		}
+		return []byte(passphrase), nil
+	}}
+	return ctx
+}
+
+// TLSOptions returns the options to connect to hosts with.
+func (ctx *Context) TLSOptions() *tlsconfig.Options {
+	return &tlsconfig.Options{
+		Keys:        ctx.Keys,
+		Stderr:      ctx.Stderr,
+		DebugKeyLog: ctx.Config.DebugTLS,
+	}
+}
+
+// String returns the value of one of the command's string flags.
+func (ctx *Context) String(name string) string {
+	return ctx.Flags.Lookup(name).Value.String()
+}
+
+// Bool returns the value of one of the command's bool flags.
+func (ctx *Context) Bool(name string) bool {
+	return ctx.Flags.Lookup(name).Value.(flag.Getter).Get().(bool)
+}
+
+// Int returns the value of one of the command's int flags.
+func (ctx *Context) Int(name string) int {
+	return ctx.Flags.Lookup(name).Value.(flag.Getter).Get().(int)
+}
+
+// Debugf writes a line to stderr if --debug is set.
+func (ctx *Context) Debugf(format string, args ...interface{}) {
+	if ctx.Config.Debug {
+		fmt.Fprintf(ctx.Stderr, "Debug: "+format+"\n", args...)
+	}
+}
+
+// Confirm asks the user a yes or no question, returning true if they answer
+// yes.
+func (ctx *Context) Confirm(question string) bool {
+	fmt.Fprintf(ctx.Stdout, "%s [yN] ", question)
+
+	if ctx.stdin == nil {
+		ctx.stdin = bufio.NewReader(ctx.Stdin)
+	}
+	answer, _ := ctx.stdin.ReadString('\n')
+	return strings.ToLower(strings.TrimSpace(answer)) == "y"
+}
+
+// PrintList prints rows under headers as a table, or as a JSON array of
+// objects with --format json. The JSON keys are the headers in lower case,
+// with underscores for spaces.
+func (ctx *Context) PrintList(headers []string, rows [][]string) error {
+	if ctx.Config.Format == "json" {
+		objects := []map[string]string{}
+		for _, row := range rows {
+			object := map[string]string{}
+			for i, header := range headers {
+				object[strings.Replace(strings.ToLower(header), " ", "_", -1)] = row[i]
+			}
+			objects = append(objects, object)
+		}
+		data, err := json.MarshalIndent(objects, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(ctx.Stdout, "%s\n", data)
+		return err
+	}
+
+	writer := tabwriter.NewWriter(ctx.Stdout, 20, 1, 3, ' ', 0)
+	fmt.Fprintln(writer, strings.Join(headers, "\t"))
+	for _, row := range rows {
+		fmt.Fprintln(writer, strings.Join(row, "\t"))
+	}
+	return writer.Flush()
+}
+
+// ExitError is returned by a command to exit with a status other than 1.
+// Its message, if it has one, is printed first.
+type ExitError struct {
+	Code    int
+	Message string
+}
+
+func (e *ExitError) Error() string {
+	return e.Message
+}
+
+// ExitCode returns the status to exit with after a command returns err.
+func ExitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	if exitErr, ok := err.(*ExitError); ok {
+		return exitErr.Code
+	}
+	return 1
+}
+
+// Execute runs the command line args, without the program name, printing
+// any error to ctx.Stderr, and returns the status to exit with.
+func Execute(ctx *Context, args []string) int {
+	err := Main(ctx, args)
+	if err != nil && err.Error() != "" {
+		fmt.Fprintln(ctx.Stderr, err)
+	}
+	return ExitCode(err)
+}
+
+// Main runs the command line args, without the program name.
+func Main(ctx *Context, args []string) error {
+	if len(args) > 0 && args[0] == "--version" {
+		fmt.Fprintf(ctx.Stdout, "Deploy %s\n", constants.Version)
+		return nil
+	}
+	return Root.Execute(ctx, args)
+}
+
+func WaitForSignal() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
+	<-c
+	signal.Stop(c)
+}
@@ -0,0 +1,192 @@
+package commands
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/bbbacsa/deploy.io/labels"
+	"io"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// dockerHosts returns the names of the hosts given to 'deploy docker' with
+// -H, which can be a list separated by commas or a label selector, or with
+// -l. It returns a single empty name if neither was given, for the default
+// host.
+func dockerHosts(cmd *Command, ctx *Context) ([]string, error) {
+	hostNames, selector := ctx.String("H"), ctx.String("l")
+	if strings.ContainsAny(hostNames, "=!") {
+		if selector != "" {
+			return nil, cmd.UsageError(ctx, "`deploy docker` takes either -H or -l, not both")
+		}
+		hostNames, selector = "", hostNames
+	}
+
+	if selector != "" {
+		if hostNames != "" {
+			return nil, cmd.UsageError(ctx, "`deploy docker` takes either -H or -l, not both")
+		}
+		s, err := labels.ParseSelector(selector)
+		if err != nil {
+			return nil, cmd.UsageError(ctx, "%s", err)
+		}
+		return selectHostNames(ctx, s)
+	}
+
+	names := []string{}
+	seen := map[string]bool{}
+	for _, name := range strings.Split(hostNames, ",") {
+		name = strings.TrimSpace(name)
+		if seen[name] || (name == "" && strings.Contains(hostNames, ",")) {
+			continue
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		return nil, cmd.UsageError(ctx, "-H doesn't name any hosts")
+	}
+	return names, nil
+}
+
+// runDockerOnHosts runs a docker command against each of hostNames, up to
+// parallel at a time, with each line of their output prefixed by the host's
+// name. With group, each host's output is held back until its command has
+// finished, then printed together. Once every host is done, it summarises
+// which ones the command failed on.
+func runDockerOnHosts(ctx *Context, hostNames []string, args []string, parallel int, group bool) error {
+	width := 0
+	for _, name := range hostNames {
+		if len(name) > width {
+			width = len(name)
+		}
+	}
+
+	// Asking to log in, or for the passphrase of a client key, from several
+	// hosts at once would be a mess, so do it before starting.
+	if _, err := ctx.NewAPIClient(); err != nil {
+		return err
+	}
+	for _, name := range hostNames {
+		if err := unlockClientKey(ctx, name); err != nil {
+			return err
+		}
+	}
+
+	var (
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		results = make([]error, len(hostNames))
+		jobs    = make(chan int)
+	)
+	for i := 0; i < parallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				prefix := fmt.Sprintf("%-*s | ", width, hostNames[i])
+				results[i] = runDockerOnHost(ctx, &mu, hostNames[i], prefix, args, group)
+			}
+		}()
+	}
+	for i := range hostNames {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	fmt.Fprintln(ctx.Stderr)
+	failed := 0
+	for i, name := range hostNames {
+		status := "ok"
+		if results[i] != nil {
+			failed++
+			status = strings.SplitN(results[i].Error(), "\n", 2)[0]
+		}
+		fmt.Fprintf(ctx.Stderr, "%-*s  %s\n", width, name, status)
+	}
+	fmt.Fprintf(ctx.Stderr, "\nDone: %d succeeded, %d failed.\n", len(hostNames)-failed, failed)
+	if failed > 0 {
+		return &ExitError{Code: 1}
+	}
+	return nil
+}
+
+// runDockerOnHost runs a docker command against one host, for
+// runDockerOnHosts. mu is held while writing to ctx's stdout or stderr.
+func runDockerOnHost(ctx *Context, mu *sync.Mutex, hostName, prefix string, args []string, group bool) error {
+	var outBuffer, errBuffer bytes.Buffer
+	stdout := &prefixWriter{w: ctx.Stdout, prefix: prefix, mu: mu}
+	stderr := &prefixWriter{w: ctx.Stderr, prefix: prefix, mu: mu}
+	if group {
+		stdout = &prefixWriter{w: &outBuffer, prefix: prefix, mu: new(sync.Mutex)}
+		stderr = &prefixWriter{w: &errBuffer, prefix: prefix, mu: new(sync.Mutex)}
+	}
+
+	// The host's proxy and docker command write through their own context,
+	// and there's nobody to read stdin for them.
+	hostCtx := *ctx
+	hostCtx.Stdin = strings.NewReader("")
+	hostCtx.Stdout, hostCtx.Stderr = stdout, stderr
+
+	err := WithDockerProxy(&hostCtx, "", hostName, func(listenURL string) error {
+		return CallDocker(&hostCtx, args, listenURL)
+	})
+	if _, ok := err.(*exec.ExitError); err != nil && !ok {
+		fmt.Fprintln(stderr, err)
+	}
+	stdout.Flush()
+	stderr.Flush()
+
+	if group {
+		mu.Lock()
+		io.Copy(ctx.Stdout, &outBuffer)
+		io.Copy(ctx.Stderr, &errBuffer)
+		mu.Unlock()
+	}
+	return err
+}
+
+// prefixWriter writes each line written to it to w, starting with prefix.
+// Writers that share mu write whole lines at a time, so lines from
+// different writers aren't mixed up.
+type prefixWriter struct {
+	w      io.Writer
+	prefix string
+	mu     *sync.Mutex
+
+	// partial is the start of a line that hasn't been finished yet.
+	partial []byte
+}
+
+func (p *prefixWriter) Write(data []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.partial = append(p.partial, data...)
+	for {
+		i := bytes.IndexByte(p.partial, '\n')
+		if i < 0 {
+			break
+		}
+		if _, err := fmt.Fprintf(p.w, "%s%s", p.prefix, p.partial[:i+1]); err != nil {
+			return len(data), err
+		}
+		p.partial = p.partial[i+1:]
+	}
+	return len(data), nil
+}
+
+// Flush writes the end of a last line that wasn't finished with a newline.
+func (p *prefixWriter) Flush() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.partial) == 0 {
+		return nil
+	}
+	_, err := fmt.Fprintf(p.w, "%s%s\n", p.prefix, p.partial)
+	p.partial = nil
+	return err
+}
@@ -0,0 +1,258 @@
+package commands
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+type goldenCase struct {
+	name string
+	// $HOME in args is replaced with the test's home directory, and $API
+	// with the fake API's URL.
+	args  []string
+	stdin string
+
+	// Files to write first, relative to $HOME. $API is replaced with the
+	// fake API's URL.
+	files map[string]string
+
+	// Commands to run first, whose output isn't checked.
+	setup [][]string
+
+	// Set for tables, whose columns are as wide as values that change
+	// between runs.
+	columns bool
+}
+
+var goldenCases = []goldenCase{
+	{name: "version", args: []string{"--version"}},
+	{name: "usage", args: []string{}},
+	{name: "unknown-command", args: []string{"nope"}},
+	{name: "unknown-flag", args: []string{"--nope", "hosts"}},
+	{name: "did-you-mean", args: []string{"hsots"}},
+	{name: "did-you-mean-nested", args: []string{"hosts", "crate", "web"}},
+	{name: "unknown-format", args: []string{"--format", "xml", "hosts"}},
+	{name: "context-not-url", args: []string{"--context", "staging", "ip"}},
+	{name: "context", args: []string{"hosts", "--context", "$API"}},
+	{name: "debug", args: []string{"--debug", "ip"}},
+
+	{name: "hosts", args: []string{"hosts"}},
+	{name: "hosts-ls", args: []string{"hosts", "ls"}},
+	{name: "hosts-unknown", args: []string{"hosts", "nope"}},
+	{name: "hosts-ls-json", args: []string{"--format", "json", "hosts", "ls"}},
+	{name: "hosts-json", args: []string{"hosts", "--format", "json"}},
+	{name: "hosts-ls-too-many", args: []string{"hosts", "ls", "web"}},
+	{name: "hosts-create", args: []string{"hosts", "create", "-m", "1G", "web"}},
+	{name: "hosts-create-labels", args: []string{"hosts", "create", "--label", "env=prod", "--label", "team=web", "web"}},
+	{name: "hosts-create-invalid-label", args: []string{"hosts", "create", "--label", "env", "web"}},
+	{name: "hosts-create-exists", args: []string{"hosts", "create"}},
+	{name: "hosts-create-invalid-name", args: []string{"hosts", "create", "Not-Valid"}},
+	{name: "hosts-create-invalid-size", args: []string{"hosts", "create", "-m", "3", "web"}},
+	{name: "hosts-create-too-many", args: []string{"hosts", "create", "web", "db"}},
+	{name: "hosts-rm", args: []string{"hosts", "rm", "-f"}},
+	{name: "hosts-rm-confirm", args: []string{"hosts", "rm"}, stdin: "y\n"},
+	{name: "hosts-rm-cancel", args: []string{"hosts", "rm"}, stdin: "n\n"},
+	{name: "hosts-rm-missing", args: []string{"hosts", "rm", "-f", "nothere"}},
+	{name: "hosts-rm-bad-flag", args: []string{"hosts", "rm", "-x"}},
+	{name: "hosts-rm-selector", args: []string{"hosts", "rm", "-l", "env=dev"}, stdin: "y\n", setup: labelledHosts},
+	{name: "hosts-rm-selector-no-match", args: []string{"hosts", "rm", "-f", "-l", "env=staging"}, setup: labelledHosts},
+	{name: "hosts-rm-selector-and-name", args: []string{"hosts", "rm", "-l", "env=dev", "web"}},
+	{name: "hosts-selector", args: []string{"hosts", "-l", "env=prod"}, setup: labelledHosts},
+	{name: "hosts-ls-selector", args: []string{"hosts", "ls", "-l", "env!=prod,!team"}, setup: labelledHosts},
+	{name: "hosts-ls-invalid-selector", args: []string{"hosts", "ls", "-l", "env=a b"}},
+	{name: "hosts-flag-before-command", args: []string{"hosts", "-l", "env=dev", "rm", "-f"}},
+	{name: "hosts-label", args: []string{"hosts", "label", "web", "env=staging", "team-", "owner=ops"}, setup: labelledHosts},
+	{name: "hosts-label-show", args: []string{"hosts", "label", "web"}, setup: labelledHosts},
+	{name: "hosts-label-none", args: []string{"hosts", "label", "default"}},
+	{name: "hosts-label-invalid", args: []string{"hosts", "label", "web", "env"}},
+	{name: "hosts-label-missing", args: []string{"hosts", "label", "nothere", "env=prod"}},
+	{name: "hosts-trust", args: []string{"hosts", "trust"}, stdin: "y\n"},
+	{name: "hosts-trust-force", args: []string{"hosts", "trust", "-f"}},
+	{name: "hosts-trust-unchanged", args: []string{"hosts", "trust"}, setup: [][]string{{"hosts", "trust", "-f"}}},
+	{name: "hosts-certs", args: []string{"hosts", "certs"}},
+	{name: "hosts-certs-request", args: []string{"hosts", "certs", "request"}},
+	{name: "hosts-certs-rotate", args: []string{"hosts", "certs", "rotate"}},
+	{name: "hosts-certs-rotate-local", args: []string{"hosts", "certs", "rotate"}, setup: [][]string{{"hosts", "certs", "request"}}},
+
+	{name: "certs", args: []string{"certs"}},
+	{name: "certs-trust", args: []string{"certs", "trust"}, columns: true},
+	{name: "certs-trust-unknown", args: []string{"certs", "trust", "nope"}},
+	{name: "certs-unknown", args: []string{"certs", "tust"}},
+
+	{name: "docker", args: []string{"docker", "version"}},
+	{name: "docker-host", args: []string{"docker", "-H", "default", "ps"}},
+	{name: "docker-missing-host", args: []string{"docker", "-H", "nothere", "ps"}},
+	{name: "docker-selector", args: []string{"docker", "-l", "!env", "ps"}, setup: labelledHosts},
+	{name: "docker-selector-in-host", args: []string{"docker", "-H", "!env", "ps"}, setup: labelledHosts},
+	{name: "docker-hosts", args: []string{"docker", "-H", "default,nothere", "--parallel", "1", "ps"}},
+	{name: "docker-hosts-group", args: []string{"docker", "-H", "nothere, default", "--parallel", "1", "--group", "ps"}},
+	{name: "docker-hosts-same", args: []string{"docker", "-H", "default,default", "ps"}},
+	{name: "docker-hosts-empty", args: []string{"docker", "-H", ",", "ps"}},
+	{name: "docker-parallel-zero", args: []string{"docker", "-H", "default,nothere", "--parallel", "0", "ps"}},
+	{name: "docker-selector-no-match", args: []string{"docker", "-l", "env=staging", "ps"}, setup: labelledHosts},
+	{name: "docker-host-and-selector", args: []string{"docker", "-H", "web", "-l", "env=prod", "ps"}},
+
+	{name: "ip", args: []string{"ip"}},
+	{name: "ip-missing", args: []string{"ip", "nothere"}},
+
+	{name: "proxy", args: []string{"proxy"}, setup: [][]string{{"hosts", "trust", "-f"}}},
+	{name: "proxy-too-many", args: []string{"proxy", "unix:///a", "unix:///b"}},
+	{name: "proxy-ls", args: []string{"proxy", "ls"}},
+	{name: "proxy-ls-json", args: []string{"proxy", "ls", "--format", "json"}},
+	{name: "proxy-stop-all-and-host", args: []string{"proxy", "stop", "--all", "default"}},
+	{name: "proxy-replay", args: []string{"proxy", "replay"}},
+	{name: "proxy-replay-missing", args: []string{"proxy", "replay", "nothere.capture"}},
+
+	{name: "completion-bash", args: []string{"completion", "bash"}},
+	{name: "completion-zsh", args: []string{"completion", "zsh"}},
+	{name: "completion-fish", args: []string{"completion", "fish"}},
+	{name: "completion-unknown-shell", args: []string{"completion", "tcsh"}},
+	{name: "complete", args: []string{"__complete", ""}},
+	{name: "complete-prefix", args: []string{"__complete", "h"}},
+	{name: "complete-subcommand", args: []string{"__complete", "--debug", "hosts", "certs", ""}},
+	{name: "complete-flags", args: []string{"__complete", "hosts", "rm", "-"}},
+	{name: "complete-host-name", args: []string{"__complete", "hosts", "rm", ""}},
+	{name: "complete-host-flag", args: []string{"__complete", "docker", "-H", "d"}},
+	{name: "complete-format", args: []string{"__complete", "--format", ""}},
+	{name: "complete-after-host-name", args: []string{"__complete", "ip", "default", ""}},
+
+	{name: "plan", args: []string{"plan", "--manifest", "$HOME/deploy.yml"}, files: testManifest, setup: [][]string{{"hosts", "create", "old"}}},
+	{name: "plan-prune", args: []string{"plan", "--manifest", "$HOME/deploy.yml", "--prune"}, files: testManifest, setup: [][]string{{"hosts", "create", "old"}}},
+	{name: "plan-no-changes", args: []string{"plan", "--manifest", "$HOME/deploy.yml"}, files: map[string]string{"deploy.yml": "hosts:\n  - name: default\n"}},
+	{name: "plan-labels", args: []string{"plan", "--manifest", "$HOME/deploy.yml"}, files: map[string]string{"deploy.yml": "hosts:\n  - name: web\n    labels:\n      env: staging\n  - name: db\n  - name: default\n    labels:\n"}, setup: labelledHosts},
+	{name: "plan-region", args: []string{"plan", "--manifest", "$HOME/deploy.yml"}, files: map[string]string{"deploy.yml": "hosts:\n  - name: default\n    region: sfo1\n"}},
+	{name: "plan-invalid", args: []string{"plan", "--manifest", "$HOME/deploy.yml"}, files: map[string]string{"deploy.yml": "hosts:\n  - name: web\n    szie: 1G\n"}},
+	{name: "plan-missing", args: []string{"plan", "--manifest", "$HOME/deploy.yml"}},
+	{name: "plan-no-size", args: []string{"plan", "--manifest", "$HOME/deploy.yml"}, files: map[string]string{"deploy.yml": "hosts:\n  - name: default\n  - name: big\n  - name: web\n"}, setup: [][]string{{"hosts", "create", "-m", "1G", "big"}}},
+	{name: "plan-prune-no-hosts", args: []string{"plan", "--manifest", "$HOME/deploy.yml", "--prune"}, files: map[string]string{"deploy.yml": "hosts:\n"}},
+	{name: "apply-prune-no-hosts", args: []string{"apply", "-f", "--prune", "--manifest", "$HOME/deploy.yml"}, files: map[string]string{"deploy.yml": "# nothing yet\n"}},
+	{name: "apply", args: []string{"apply", "-f", "--prune", "--parallel", "1", "--manifest", "$HOME/deploy.yml"}, files: testManifest, setup: [][]string{{"hosts", "create", "old"}}},
+	{name: "apply-confirm", args: []string{"apply", "--prune", "--parallel", "1", "--manifest", "$HOME/deploy.yml"}, stdin: "y\n", files: testManifest, setup: [][]string{{"hosts", "create", "old"}}},
+	{name: "apply-cancel", args: []string{"apply", "--manifest", "$HOME/deploy.yml"}, stdin: "n\n", files: testManifest},
+	{name: "apply-failure", args: []string{"apply", "-f", "--parallel", "1", "--manifest", "$HOME/deploy.yml"}, files: map[string]string{"deploy.yml": "hosts:\n  - name: default\n    size: 3G\n  - name: web\n"}},
+	{name: "apply-no-changes", args: []string{"apply", "--manifest", "$HOME/deploy.yml"}, files: map[string]string{"deploy.yml": "hosts:\n  - name: default\n"}},
+	{name: "apply-parallel-zero", args: []string{"apply", "--parallel", "0"}},
+
+	{name: "run", args: []string{"run", "docker", "ps"}},
+	{name: "run-no-command", args: []string{"run"}},
+	{name: "run-missing", args: []string{"run", "nothere"}},
+}
+
+// labelledHosts are set up alongside the default host, which has no labels.
+var labelledHosts = [][]string{
+	{"hosts", "create", "--label", "env=prod", "--label", "team=web", "web"},
+	{"hosts", "create", "--label", "env=dev", "db"},
+}
+
+var testManifest = map[string]string{"deploy.yml": `# Keep the default host, bigger, and add two more.
+hosts:
+  - name: default
+    size: 1G
+  - name: web
+    size: 2G
+    region: sfo1
+    labels:
+      env: prod
+  - name: db
+`}
+
+// helpCases returns a case running 'COMMAND -h' for every command and
+// subcommand.
+func helpCases(parents []string, commands []*Command) []goldenCase {
+	cases := []goldenCase{}
+	for _, cmd := range commands {
+		if cmd.Hidden {
+			continue
+		}
+		names := append(append([]string{}, parents...), cmd.Name())
+		cases = append(cases, goldenCase{
+			name: "help-" + strings.Join(names, "-"),
+			args: append(append([]string{}, names...), "-h"),
+		})
+		cases = append(cases, helpCases(names, cmd.Subcommands)...)
+	}
+	return cases
+}
+
+func TestGolden(t *testing.T) {
+	cases := append([]goldenCase{{name: "help", args: []string{"-h"}}}, helpCases(nil, Root.Subcommands)...)
+	cases = append(cases, goldenCases...)
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			env := newTestEnvironment(t)
+			defer env.Close()
+
+			for name, content := range c.files {
+				filename := path.Join(env.Dir, name)
+				if err := os.MkdirAll(path.Dir(filename), 0700); err != nil {
+					t.Fatal(err)
+				}
+				if err := ioutil.WriteFile(filename, []byte(strings.Replace(content, "$API", env.API.URL, -1)), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, args := range c.setup {
+				ctx, _, stderr := env.Context("")
+				if code := Execute(ctx, args); code != 0 {
+					t.Fatalf("deploy %s exited with status %d: %s", strings.Join(args, " "), code, stderr)
+				}
+			}
+
+			args := []string{}
+			for _, arg := range c.args {
+				args = append(args, strings.Replace(strings.Replace(arg, "$HOME", env.Dir, -1), "$API", env.API.URL, -1))
+			}
+			ctx, stdout, stderr := env.Context(c.stdin)
+			code := Execute(ctx, args)
+			output := fmt.Sprintf("$ deploy %s\n--- stdout\n%s--- stderr\n%s--- exit status %d\n", strings.Join(c.args, " "), stdout, stderr, code)
+			output = env.normalize(output, c.columns)
+
+			goldenPath := path.Join("testdata", c.name+".golden")
+			if *update {
+				if err := ioutil.WriteFile(goldenPath, []byte(output), 0644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			expected, err := ioutil.ReadFile(goldenPath)
+			if err != nil {
+				t.Fatalf("%s (run 'go test -update' to create it)", err)
+			}
+			if output != string(expected) {
+				t.Errorf("output doesn't match %s (run 'go test -update' if it should).\nexpected:\n%s\ngot:\n%s", goldenPath, expected, output)
+			}
+		})
+	}
+}
+
+var (
+	tempDirPattern     = regexp.MustCompile(`\$HOME/tmp/deploy-[0-9]+`)
+	fingerprintPattern = regexp.MustCompile(`SHA256:[A-Za-z0-9+/]{43}`)
+	datePattern        = regexp.MustCompile(`\b\d{4}-\d{2}-\d{2}\b`)
+	columnsPattern     = regexp.MustCompile(` {3,}`)
+)
+
+// normalize replaces what changes from one run to the next with
+// placeholders.
+func (env *testEnvironment) normalize(output string, columns bool) string {
+	output = strings.Replace(output, path.Dir(os.Getenv("DEPLOY_CA_BUNDLE")), "$APITEST", -1)
+	output = strings.Replace(output, env.Dir, "$HOME", -1)
+	output = strings.Replace(output, env.API.URL, "$API", -1)
+	output = strings.Replace(output, env.Daemon.Addr, "$DAEMON", -1)
+	output = tempDirPattern.ReplaceAllString(output, "$$HOME/tmp/deploy-$$RANDOM")
+	output = fingerprintPattern.ReplaceAllString(output, "SHA256:$$FINGERPRINT")
+	output = datePattern.ReplaceAllString(output, "$$DATE")
+	if columns {
+		output = columnsPattern.ReplaceAllString(output, "   ")
+	}
+	return output
+}
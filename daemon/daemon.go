@@ -0,0 +1,348 @@
+// Package daemon keeps track of proxies running in the background.
+//
+// Every detached proxy owns two files in ~/.deploy/proxies, both named after
+// the host it forwards to: a pidfile holding the process ID, and a JSON state
+// file describing where the proxy listens and how busy it is. The proxy holds
+// an exclusive flock on its pidfile for as long as it runs, so a proxy is
+// running exactly when its pidfile is locked, whatever has become of the PID
+// in it. The files are removed when the proxy shuts down cleanly; if the
+// process dies without doing so, List and Get notice the lock has gone and
+// clean up after it.
+package daemon
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/bbbacsa/deploy.io/utils"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+type State struct {
+	Host            string    `json:"host"`
+	PID             int       `json:"pid"`
+	ListenURL       string    `json:"listen_url"`
+	Socket          string    `json:"socket,omitempty"`
+	StartedAt       time.Time `json:"started_at"`
+	Connections     int64     `json:"connections"`
+	Active          int64     `json:"active"`
+	HandshakesSaved int64     `json:"handshakes_saved"`
+}
+
+func (s *State) Uptime() time.Duration {
+	return time.Since(s.StartedAt)
+}
+
+// Dir returns the directory pidfiles and state files live in, creating it if
+// necessary. It can be overridden with DEPLOY_PROXY_DIR.
+func Dir() (string, error) {
+	dir := os.Getenv("DEPLOY_PROXY_DIR")
+	if dir == "" {
+		dir = path.Join(os.Getenv("HOME"), ".deploy", "proxies")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+func PIDFilePath(dir, host string) string {
+	return path.Join(dir, host+".pid")
+}
+
+func StateFilePath(dir, host string) string {
+	return path.Join(dir, host+".json")
+}
+
+func LogFilePath(dir, host string) string {
+	return path.Join(dir, host+".log")
+}
+
+// SocketPath returns the filesystem path of a unix:// listen URL, or "" for
+// any other kind of URL.
+func SocketPath(listenURL string) string {
+	u, err := url.Parse(listenURL)
+	if err != nil || u.Scheme != "unix" {
+		return ""
+	}
+	return u.Path
+}
+
+// A PIDFile is the locked pidfile of the proxy running in this process.
+type PIDFile struct {
+	dir  string
+	host string
+	file *os.File
+}
+
+// WritePID records the current process as the proxy for host, locking the
+// pidfile until Remove is called. It fails if another proxy holds it.
+func WritePID(dir, host string) (*PIDFile, error) {
+	pidFile := PIDFilePath(dir, host)
+	for {
+		f, err := os.OpenFile(pidFile, os.O_RDWR|os.O_CREATE, 0600)
+		if err != nil {
+			return nil, err
+		}
+		if err := lockPIDFile(f); err != nil {
+			f.Close()
+			if err == syscall.EWOULDBLOCK {
+				pid, _ := readPID(pidFile)
+				return nil, fmt.Errorf("A proxy to %s is already running (pid %d)", host, pid)
+			}
+			return nil, err
+		}
+
+		// The proxy that held the lock before us may have removed the file
+		// while we were waiting for it, in which case ours is no use.
+		if !isCurrent(f, pidFile) {
+			f.Close()
+			continue
+		}
+
+		if err := f.Truncate(0); err != nil {
+			f.Close()
+			return nil, err
+		}
+		if _, err := f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0); err != nil {
+			f.Close()
+			return nil, err
+		}
+		return &PIDFile{dir: dir, host: host, file: f}, nil
+	}
+}
+
+// lockPIDFile locks f exclusively. Get locks pidfiles for a moment to see if
+// they're stale, so a lock that's held is tried a few more times before
+// giving up.
+func lockPIDFile(f *os.File) error {
+	var err error
+	for attempt := 0; attempt < 20; attempt++ {
+		err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err != syscall.EWOULDBLOCK {
+			return err
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return err
+}
+
+// Remove deletes the proxy's files, and then gives up the lock.
+func (p *PIDFile) Remove() {
+	Remove(p.dir, p.host)
+	p.file.Close()
+}
+
+// isCurrent reports whether f is still the file at filename.
+func isCurrent(f *os.File, filename string) bool {
+	opened, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	current, err := os.Stat(filename)
+	return err == nil && os.SameFile(opened, current)
+}
+
+// WriteState atomically replaces the state file for state.Host.
+func WriteState(dir string, state *State) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return utils.WriteFileAtomic(StateFilePath(dir, state.Host), data, 0600)
+}
+
+// Remove deletes every file belonging to the proxy for host, including its
+// Unix socket if it had one. It mustn't be called unless the pidfile is locked
+// by the caller, or missing.
+func Remove(dir, host string) {
+	if state, err := readState(StateFilePath(dir, host)); err == nil && state.Socket != "" {
+		os.Remove(state.Socket)
+	}
+	os.Remove(StateFilePath(dir, host))
+	os.Remove(PIDFilePath(dir, host))
+}
+
+// Get returns the state of the running proxy for host, or nil if there isn't
+// one. Files left behind by a proxy that is no longer running are removed.
+func Get(dir, host string) (*State, error) {
+	f, err := os.Open(PIDFilePath(dir, host))
+	if os.IsNotExist(err) {
+		if _, err := os.Stat(StateFilePath(dir, host)); err == nil {
+			Remove(dir, host)
+		}
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == nil {
+		// Nobody holds the lock, so the proxy is gone. Its files are removed
+		// while we hold it, so that a new proxy can't lose its own.
+		if isCurrent(f, PIDFilePath(dir, host)) {
+			Remove(dir, host)
+		}
+		return nil, nil
+	}
+	if err != syscall.EWOULDBLOCK {
+		return nil, err
+	}
+
+	pid, err := readPID(PIDFilePath(dir, host))
+	if err != nil {
+		// Still writing its PID.
+		return &State{Host: host}, nil
+	}
+	state, err := readState(StateFilePath(dir, host))
+	if os.IsNotExist(err) {
+		// Still starting up.
+		return &State{Host: host, PID: pid}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if state.PID != pid {
+		// Left behind by an earlier proxy, and not yet replaced.
+		return &State{Host: host, PID: pid}, nil
+	}
+	return state, nil
+}
+
+// List returns every running proxy, sorted by host name, cleaning up stale
+// files along the way.
+func List(dir string) ([]*State, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := map[string]bool{}
+	states := []*State{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, ".") {
+			continue
+		}
+		var host string
+		if strings.HasSuffix(name, ".pid") {
+			host = strings.TrimSuffix(name, ".pid")
+		} else if strings.HasSuffix(name, ".json") {
+			host = strings.TrimSuffix(name, ".json")
+		} else {
+			continue
+		}
+		if seen[host] {
+			continue
+		}
+		seen[host] = true
+
+		state, err := Get(dir, host)
+		if err != nil {
+			return nil, err
+		}
+		if state != nil {
+			states = append(states, state)
+		}
+	}
+
+	sort.Sort(byHost(states))
+	return states, nil
+}
+
+// Stop asks the proxy for host to shut down and waits up to timeout for it
+// to exit, killing it if it doesn't. A process is only signalled while the
+// pidfile it wrote is still locked, so a PID that's been reused by something
+// else is left alone.
+func Stop(dir, host string, timeout time.Duration) error {
+	state, err := Get(dir, host)
+	if err != nil {
+		return err
+	}
+	if state == nil || state.PID <= 0 {
+		return fmt.Errorf("No proxy to %s is running", host)
+	}
+
+	if err := signal(dir, host, state.PID, syscall.SIGTERM); err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(timeout)
+	for IsRunning(dir, host) {
+		if time.Now().After(deadline) {
+			if err := signal(dir, host, state.PID, syscall.SIGKILL); err != nil {
+				return err
+			}
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// Clean up after a proxy that had to be killed.
+	_, err = Get(dir, host)
+	return err
+}
+
+// signal sends sig to pid, if it's still the running proxy for host.
+func signal(dir, host string, pid int, sig syscall.Signal) error {
+	if !IsRunning(dir, host) {
+		return nil
+	}
+	if current, err := readPID(PIDFilePath(dir, host)); err != nil || current != pid {
+		return nil
+	}
+	if err := syscall.Kill(pid, sig); err != nil && err != syscall.ESRCH {
+		return err
+	}
+	return nil
+}
+
+// IsRunning reports whether a proxy holds the pidfile for host.
+func IsRunning(dir, host string) bool {
+	f, err := os.Open(PIDFilePath(dir, host))
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_SH|syscall.LOCK_NB); err != nil {
+		return err == syscall.EWOULDBLOCK
+	}
+	syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+	return false
+}
+
+func readPID(pidFile string) (int, error) {
+	data, err := ioutil.ReadFile(pidFile)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(data)))
+}
+
+func readState(stateFile string) (*State, error) {
+	data, err := ioutil.ReadFile(stateFile)
+	if err != nil {
+		return nil, err
+	}
+	var state State
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+type byHost []*State
+
+func (s byHost) Len() int           { return len(s) }
+func (s byHost) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byHost) Less(i, j int) bool { return s[i].Host < s[j].Host }
@@ -0,0 +1,133 @@
+package daemon
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStalePIDFileIsCleanedUp(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deploy-daemon-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	socket := path.Join(dir, "deploy.sock")
+	ioutil.WriteFile(socket, nil, 0600)
+
+	// PIDs are capped well below this on every platform we build for.
+	ioutil.WriteFile(PIDFilePath(dir, "crashed"), []byte("999999999\n"), 0600)
+	WriteState(dir, &State{Host: "crashed", PID: 999999999, ListenURL: "unix://" + socket, Socket: socket})
+
+	states, err := List(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(states) != 0 {
+		t.Errorf("expected no running proxies, got %d", len(states))
+	}
+
+	for _, file := range []string{PIDFilePath(dir, "crashed"), StateFilePath(dir, "crashed"), socket} {
+		if _, err := os.Stat(file); !os.IsNotExist(err) {
+			t.Errorf("expected %s to be removed", file)
+		}
+	}
+}
+
+func TestListRunningProxy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deploy-daemon-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	pidFile, err := WritePID(dir, "default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pidFile.Remove()
+	started := time.Now().Add(-time.Minute)
+	WriteState(dir, &State{Host: "default", PID: os.Getpid(), ListenURL: "tcp://localhost:1234", StartedAt: started, Connections: 3})
+
+	states, err := List(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(states) != 1 {
+		t.Fatalf("expected 1 running proxy, got %d", len(states))
+	}
+	if states[0].Host != "default" || states[0].Connections != 3 {
+		t.Errorf("unexpected state: %#v", states[0])
+	}
+	if states[0].Uptime() < time.Minute {
+		t.Errorf("expected uptime of at least a minute, got %s", states[0].Uptime())
+	}
+}
+
+func TestUnlockedPIDFileIsStale(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deploy-daemon-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The PID belongs to a live process, this one, as it would if the
+	// proxy's PID had been reused. Stop mustn't signal it.
+	ioutil.WriteFile(PIDFilePath(dir, "reused"), []byte(strconv.Itoa(os.Getpid())+"\n"), 0600)
+	WriteState(dir, &State{Host: "reused", PID: os.Getpid()})
+
+	if err := Stop(dir, "reused", time.Second); err == nil {
+		t.Error("expected there to be no proxy to stop")
+	}
+	if IsRunning(dir, "reused") {
+		t.Error("expected the proxy not to be running")
+	}
+	for _, file := range []string{PIDFilePath(dir, "reused"), StateFilePath(dir, "reused")} {
+		if _, err := os.Stat(file); !os.IsNotExist(err) {
+			t.Errorf("expected %s to be removed", file)
+		}
+	}
+}
+
+func TestWritePIDOnlyOnce(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deploy-daemon-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	pidFile, err := WritePID(dir, "default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := WritePID(dir, "default"); err == nil || !strings.Contains(err.Error(), "already running") {
+		t.Errorf("expected the second proxy to be refused, got %v", err)
+	}
+	if !IsRunning(dir, "default") {
+		t.Error("expected the proxy to be running")
+	}
+
+	pidFile.Remove()
+	if IsRunning(dir, "default") {
+		t.Error("expected the proxy to have stopped")
+	}
+	pidFile, err = WritePID(dir, "default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pidFile.Remove()
+}
+
+func TestSocketPath(t *testing.T) {
+	if p := SocketPath("unix:///tmp/deploy-1/deploy.sock"); p != "/tmp/deploy-1/deploy.sock" {
+		t.Errorf("expected /tmp/deploy-1/deploy.sock, got %q", p)
+	}
+	if p := SocketPath("tcp://localhost:1234"); p != "" {
+		t.Errorf("expected no socket path for a TCP URL, got %q", p)
+	}
+}
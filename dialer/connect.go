@@ -0,0 +1,67 @@
+package dialer
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// connectHTTP asks an HTTP proxy to open a tunnel to addr with the CONNECT
+// method, authenticating with the proxy URL's credentials if it has any.
+func connectHTTP(conn net.Conn, proxy *url.URL, addr string) (net.Conn, error) {
+	req := "CONNECT " + addr + " HTTP/1.1\r\nHost: " + addr + "\r\n"
+	if proxy.User != nil {
+		password, _ := proxy.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(proxy.User.Username() + ":" + password))
+		req += "Proxy-Authorization: Basic " + credentials + "\r\n"
+	}
+	req += "\r\n"
+
+	if _, err := conn.Write([]byte(req)); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: "CONNECT"})
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't read response from proxy %s: %s", proxy.Host, err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		status := strings.TrimSpace(strings.TrimPrefix(resp.Status, fmt.Sprintf("%d", resp.StatusCode)))
+		if resp.StatusCode == http.StatusProxyAuthRequired {
+			return nil, fmt.Errorf("Proxy %s requires authentication: %d %s", proxy.Host, resp.StatusCode, status)
+		}
+		return nil, fmt.Errorf("Proxy %s refused to connect to %s: %d %s", proxy.Host, addr, resp.StatusCode, status)
+	}
+
+	if br.Buffered() > 0 {
+		return &bufferedConn{conn, br}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn is a connection whose first bytes have already been read into
+// a buffer.
+type bufferedConn struct {
+	net.Conn
+	br *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.br.Read(b)
+}
+
+func (c *bufferedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface {
+		CloseWrite() error
+	}); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
@@ -0,0 +1,240 @@
+// Package dialer opens TCP connections to Deploy.IO's API and hosts, going
+// through an HTTP CONNECT or SOCKS5 proxy when one is configured.
+//
+// The proxy is taken from DEPLOY_EGRESS_PROXY if it's set, and otherwise from
+// HTTPS_PROXY or ALL_PROXY (in either case). Addresses matching NO_PROXY are
+// always dialled directly. Set DEPLOY_EGRESS_PROXY=direct to ignore the
+// standard variables altogether.
+package dialer
+
+import (
+	"fmt"
+	"github.com/bbbacsa/deploy.io/vendor/crypto/tls"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+type Dialer struct {
+	// Proxy is the proxy to dial through, or nil to dial directly. Its
+	// scheme must be http, socks5 or socks5h, and it may carry a username
+	// and password.
+	Proxy *url.URL
+
+	// NoProxy lists hosts which are dialled directly, in the format of the
+	// NO_PROXY environment variable.
+	NoProxy string
+
+	Timeout time.Duration
+}
+
+var DefaultTimeout = 30 * time.Second
+
+// FromEnvironment returns a Dialer configured from the environment. It
+// returns an error if the configured proxy URL can't be used.
+func FromEnvironment() (*Dialer, error) {
+	d := &Dialer{
+		NoProxy: getenv("NO_PROXY"),
+		Timeout: DefaultTimeout,
+	}
+
+	proxyURL := os.Getenv("DEPLOY_EGRESS_PROXY")
+	if proxyURL == "direct" {
+		return d, nil
+	}
+	if proxyURL == "" {
+		proxyURL = getenv("HTTPS_PROXY")
+	}
+	if proxyURL == "" {
+		proxyURL = getenv("ALL_PROXY")
+	}
+	if proxyURL == "" {
+		return d, nil
+	}
+
+	proxy, err := ParseProxyURL(proxyURL)
+	if err != nil {
+		return nil, err
+	}
+	d.Proxy = proxy
+	return d, nil
+}
+
+// ParseProxyURL parses a proxy URL, assuming http:// if no scheme is given as
+// curl does.
+func ParseProxyURL(proxyURL string) (*url.URL, error) {
+	if !strings.Contains(proxyURL, "://") {
+		proxyURL = "http://" + proxyURL
+	}
+
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid proxy URL %q: %s", proxyURL, err)
+	}
+
+	switch u.Scheme {
+	case "http", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("Unsupported proxy URL %q: expected an http://, socks5:// or socks5h:// URL", proxyURL)
+	}
+
+	if u.Host == "" {
+		return nil, fmt.Errorf("Invalid proxy URL %q: no host", proxyURL)
+	}
+	if _, _, err := net.SplitHostPort(u.Host); err != nil {
+		if u.Scheme == "http" {
+			u.Host = net.JoinHostPort(u.Host, "80")
+		} else {
+			u.Host = net.JoinHostPort(u.Host, "1080")
+		}
+	}
+
+	return u, nil
+}
+
+// ProxyFor returns the proxy to use for addr, or nil if it should be dialled
+// directly.
+func (d *Dialer) ProxyFor(addr string) *url.URL {
+	if d.Proxy == nil || !useProxy(d.NoProxy, addr) {
+		return nil
+	}
+	return d.Proxy
+}
+
+// Dial connects to addr, which must be a host:port pair, through the
+// configured proxy if there is one. Only TCP is supported.
+func (d *Dialer) Dial(network, addr string) (net.Conn, error) {
+	if network != "tcp" && network != "tcp4" && network != "tcp6" {
+		return nil, fmt.Errorf("dialer: unsupported network %q", network)
+	}
+
+	proxy := d.ProxyFor(addr)
+	if proxy == nil {
+		return net.DialTimeout(network, addr, d.timeout())
+	}
+
+	conn, err := net.DialTimeout("tcp", proxy.Host, d.timeout())
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't connect to proxy %s: %s", proxy.Host, err)
+	}
+
+	if d.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(d.Timeout))
+	}
+
+	var tunnel net.Conn
+	switch proxy.Scheme {
+	case "http":
+		tunnel, err = connectHTTP(conn, proxy, addr)
+	case "socks5", "socks5h":
+		tunnel, err = connectSOCKS5(conn, proxy, addr)
+	default:
+		err = fmt.Errorf("Unsupported proxy scheme %q", proxy.Scheme)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	tunnel.SetDeadline(time.Time{})
+	return tunnel, nil
+}
+
+// DialTLS connects to addr like Dial, then performs a TLS handshake. As with
+// tls.Dial, the server name is taken from addr if config doesn't set one.
+func (d *Dialer) DialTLS(network, addr string, config *tls.Config) (*tls.Conn, error) {
+	rawConn, err := d.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			rawConn.Close()
+			return nil, err
+		}
+		config = config.Clone()
+		config.ServerName = host
+	}
+
+	conn := tls.Client(rawConn, config)
+	if err := conn.Handshake(); err != nil {
+		rawConn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (d *Dialer) timeout() time.Duration {
+	if d.Timeout == 0 {
+		return DefaultTimeout
+	}
+	return d.Timeout
+}
+
+// useProxy reports whether addr should be dialled through the proxy, given a
+// NO_PROXY value: a comma-separated list of host names, domain suffixes
+// (optionally with a leading dot), IP addresses or CIDR blocks, or "*".
+func useProxy(noProxy, addr string) bool {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	host = strings.ToLower(host)
+
+	if host == "localhost" {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if ip != nil && ip.IsLoopback() {
+		return false
+	}
+
+	for _, entry := range strings.Split(noProxy, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" {
+			continue
+		}
+		if entry == "*" {
+			return false
+		}
+
+		if _, cidr, err := net.ParseCIDR(entry); err == nil {
+			if ip != nil && cidr.Contains(ip) {
+				return false
+			}
+			continue
+		}
+
+		if entryHost, entryPort, err := net.SplitHostPort(entry); err == nil {
+			if entryPort != port {
+				continue
+			}
+			entry = entryHost
+		}
+
+		if entryIP := net.ParseIP(entry); entryIP != nil {
+			if ip != nil && entryIP.Equal(ip) {
+				return false
+			}
+			continue
+		}
+
+		entry = strings.TrimPrefix(entry, "*")
+		if host == strings.TrimPrefix(entry, ".") || strings.HasSuffix(host, "."+strings.TrimPrefix(entry, ".")) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func getenv(name string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return os.Getenv(strings.ToLower(name))
+}
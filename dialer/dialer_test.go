@@ -0,0 +1,302 @@
+package dialer
+
+import (
+	"bufio"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+)
+
+// startEchoServer returns the address of a server which echoes back
+// everything it receives.
+func startEchoServer(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return l
+}
+
+// standInProxy accepts connections, lets handshake decide where they're
+// going, and then splices them to target.
+type standInProxy struct {
+	net.Listener
+	requested chan string
+}
+
+func startStandInProxy(t *testing.T, target string, handshake func(net.Conn, *bufio.Reader) (string, bool)) *standInProxy {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &standInProxy{l, make(chan string, 10)}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				addr, ok := handshake(conn, br)
+				if !ok {
+					return
+				}
+				p.requested <- addr
+				upstream, err := net.Dial("tcp", target)
+				if err != nil {
+					return
+				}
+				defer upstream.Close()
+				go io.Copy(upstream, br)
+				io.Copy(conn, upstream)
+			}()
+		}
+	}()
+	return p
+}
+
+func httpConnectHandshake(credentials string) func(net.Conn, *bufio.Reader) (string, bool) {
+	return func(conn net.Conn, br *bufio.Reader) (string, bool) {
+		req, err := http.ReadRequest(br)
+		if err != nil || req.Method != "CONNECT" {
+			return "", false
+		}
+		if credentials != "" && req.Header.Get("Proxy-Authorization") != "Basic "+base64.StdEncoding.EncodeToString([]byte(credentials)) {
+			io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+			return "", false
+		}
+		io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+		return req.Host, true
+	}
+}
+
+func socks5Handshake(username, password string) func(net.Conn, *bufio.Reader) (string, bool) {
+	return func(conn net.Conn, br *bufio.Reader) (string, bool) {
+		header := make([]byte, 2)
+		if _, err := io.ReadFull(br, header); err != nil {
+			return "", false
+		}
+		methods := make([]byte, header[1])
+		io.ReadFull(br, methods)
+
+		if username == "" {
+			conn.Write([]byte{5, 0})
+		} else {
+			conn.Write([]byte{5, 2})
+			auth := make([]byte, 2)
+			io.ReadFull(br, auth)
+			user := make([]byte, auth[1])
+			io.ReadFull(br, user)
+			passLen := make([]byte, 1)
+			io.ReadFull(br, passLen)
+			pass := make([]byte, passLen[0])
+			io.ReadFull(br, pass)
+			if string(user) != username || string(pass) != password {
+				conn.Write([]byte{1, 1})
+				return "", false
+			}
+			conn.Write([]byte{1, 0})
+		}
+
+		req := make([]byte, 4)
+		io.ReadFull(br, req)
+		var host string
+		switch req[3] {
+		case 1:
+			ip := make([]byte, 4)
+			io.ReadFull(br, ip)
+			host = net.IP(ip).String()
+		case 3:
+			length := make([]byte, 1)
+			io.ReadFull(br, length)
+			name := make([]byte, length[0])
+			io.ReadFull(br, name)
+			host = string(name)
+		default:
+			return "", false
+		}
+		port := make([]byte, 2)
+		io.ReadFull(br, port)
+
+		conn.Write([]byte{5, 0, 0, 1, 127, 0, 0, 1, 0, 0})
+		return net.JoinHostPort(host, strconv.Itoa(int(port[0])<<8|int(port[1]))), true
+	}
+}
+
+func assertEcho(t *testing.T, conn net.Conn) {
+	defer conn.Close()
+	if _, err := io.WriteString(conn, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "hello" {
+		t.Errorf("expected hello, got %q", buf)
+	}
+}
+
+func mustParseProxyURL(t *testing.T, proxyURL string) *url.URL {
+	u, err := ParseProxyURL(proxyURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func TestDialThroughHTTPConnect(t *testing.T) {
+	echo := startEchoServer(t)
+	defer echo.Close()
+	proxy := startStandInProxy(t, echo.Addr().String(), httpConnectHandshake("alice:s3cret"))
+	defer proxy.Close()
+
+	d := &Dialer{Proxy: mustParseProxyURL(t, "http://alice:s3cret@"+proxy.Addr().String())}
+	conn, err := d.Dial("tcp", "host.example.com:2376")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr := <-proxy.requested; addr != "host.example.com:2376" {
+		t.Errorf("expected proxy to be asked for host.example.com:2376, got %s", addr)
+	}
+	assertEcho(t, conn)
+}
+
+func TestDialThroughHTTPConnectWithBadCredentials(t *testing.T) {
+	proxy := startStandInProxy(t, "", httpConnectHandshake("alice:s3cret"))
+	defer proxy.Close()
+
+	d := &Dialer{Proxy: mustParseProxyURL(t, "http://alice:wrong@"+proxy.Addr().String())}
+	if _, err := d.Dial("tcp", "host.example.com:2376"); err == nil {
+		t.Error("expected an error when the proxy rejects our credentials")
+	}
+}
+
+func TestDialThroughSOCKS5(t *testing.T) {
+	echo := startEchoServer(t)
+	defer echo.Close()
+
+	for _, credentials := range []string{"", "bob:hunter2"} {
+		username, password := "", ""
+		proxyURL := "socks5h://"
+		if credentials != "" {
+			username, password = "bob", "hunter2"
+			proxyURL += credentials + "@"
+		}
+
+		proxy := startStandInProxy(t, echo.Addr().String(), socks5Handshake(username, password))
+		d := &Dialer{Proxy: mustParseProxyURL(t, proxyURL+proxy.Addr().String())}
+
+		conn, err := d.Dial("tcp", "host.example.com:2376")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if addr := <-proxy.requested; addr != "host.example.com:2376" {
+			t.Errorf("expected proxy to be asked for host.example.com:2376, got %s", addr)
+		}
+		assertEcho(t, conn)
+		proxy.Close()
+	}
+}
+
+func TestDialThroughSOCKS5SendsIPAddresses(t *testing.T) {
+	echo := startEchoServer(t)
+	defer echo.Close()
+	proxy := startStandInProxy(t, echo.Addr().String(), socks5Handshake("", ""))
+	defer proxy.Close()
+
+	d := &Dialer{Proxy: mustParseProxyURL(t, "socks5://"+proxy.Addr().String())}
+	conn, err := d.Dial("tcp", "104.131.158.124:2376")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr := <-proxy.requested; addr != "104.131.158.124:2376" {
+		t.Errorf("expected proxy to be asked for 104.131.158.124:2376, got %s", addr)
+	}
+	assertEcho(t, conn)
+}
+
+func TestNoProxy(t *testing.T) {
+	tests := []struct {
+		noProxy string
+		addr    string
+		proxied bool
+	}{
+		{"", "api.deploy.io:443", true},
+		{"", "localhost:8001", false},
+		{"", "127.0.0.1:8001", false},
+		{"*", "api.deploy.io:443", false},
+		{"deploy.io", "api.deploy.io:443", false},
+		{".deploy.io", "api.deploy.io:443", false},
+		{"deploy.io", "deploy.io:443", false},
+		{"deploy.io", "notdeploy.io:443", true},
+		{"api.deploy.io:8001", "api.deploy.io:443", true},
+		{"api.deploy.io:443", "api.deploy.io:443", false},
+		{"104.131.158.124", "104.131.158.124:2376", false},
+		{"104.131.0.0/16", "104.131.158.124:2376", false},
+		{"10.0.0.0/8", "104.131.158.124:2376", true},
+		{"example.com, deploy.io", "api.deploy.io:443", false},
+	}
+
+	for _, test := range tests {
+		if proxied := useProxy(test.noProxy, test.addr); proxied != test.proxied {
+			t.Errorf("NO_PROXY=%q, %s: expected proxied=%v, got %v", test.noProxy, test.addr, test.proxied, proxied)
+		}
+	}
+}
+
+func TestFromEnvironment(t *testing.T) {
+	for _, name := range []string{"DEPLOY_EGRESS_PROXY", "HTTPS_PROXY", "https_proxy", "ALL_PROXY", "all_proxy", "NO_PROXY", "no_proxy"} {
+		t.Setenv(name, "")
+	}
+
+	t.Setenv("ALL_PROXY", "socks5://proxy.corp:1081")
+	d, err := FromEnvironment()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Proxy == nil || d.Proxy.String() != "socks5://proxy.corp:1081" {
+		t.Errorf("expected ALL_PROXY to be used, got %v", d.Proxy)
+	}
+
+	t.Setenv("https_proxy", "proxy.corp")
+	d, err = FromEnvironment()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Proxy == nil || d.Proxy.String() != "http://proxy.corp:80" {
+		t.Errorf("expected https_proxy to take precedence, got %v", d.Proxy)
+	}
+
+	t.Setenv("DEPLOY_EGRESS_PROXY", "direct")
+	d, err = FromEnvironment()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Proxy != nil {
+		t.Errorf("expected DEPLOY_EGRESS_PROXY=direct to disable the proxy, got %v", d.Proxy)
+	}
+
+	t.Setenv("DEPLOY_EGRESS_PROXY", "ftp://proxy.corp")
+	if _, err := FromEnvironment(); err == nil {
+		t.Error("expected an unsupported proxy scheme to be rejected")
+	}
+}
@@ -0,0 +1,185 @@
+package dialer
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+)
+
+// SOCKS5 constants from RFC 1928 and RFC 1929.
+const (
+	socks5Version = 5
+
+	socks5AuthNone         = 0
+	socks5AuthPassword     = 2
+	socks5AuthNoAcceptable = 0xff
+
+	socks5PasswordVersion = 1
+
+	socks5Connect = 1
+
+	socks5AddrIPv4   = 1
+	socks5AddrDomain = 3
+	socks5AddrIPv6   = 4
+)
+
+var errProxyClosed = errors.New("proxy closed the connection")
+
+var socks5Errors = map[byte]string{
+	1: "general SOCKS server failure",
+	2: "connection not allowed by ruleset",
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "TTL expired",
+	7: "command not supported",
+	8: "address type not supported",
+}
+
+// connectSOCKS5 asks a SOCKS5 proxy to connect to addr. With the socks5h
+// scheme the proxy resolves host names; with socks5 they're resolved locally.
+func connectSOCKS5(conn net.Conn, proxy *url.URL, addr string) (net.Conn, error) {
+	host, portString, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil || port < 1 || port > 0xffff {
+		return nil, fmt.Errorf("Invalid port in address %q", addr)
+	}
+
+	methods := []byte{socks5AuthNone}
+	if proxy.User != nil {
+		methods = append(methods, socks5AuthPassword)
+	}
+	greeting := append([]byte{socks5Version, byte(len(methods))}, methods...)
+	if _, err := conn.Write(greeting); err != nil {
+		return nil, err
+	}
+
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return nil, socks5ReadError(proxy, err)
+	}
+	if reply[0] != socks5Version {
+		return nil, fmt.Errorf("Proxy %s isn't a SOCKS5 proxy", proxy.Host)
+	}
+
+	switch reply[1] {
+	case socks5AuthNone:
+	case socks5AuthPassword:
+		if proxy.User == nil {
+			return nil, fmt.Errorf("Proxy %s requires authentication", proxy.Host)
+		}
+		if err := socks5Authenticate(conn, proxy); err != nil {
+			return nil, err
+		}
+	case socks5AuthNoAcceptable:
+		return nil, fmt.Errorf("Proxy %s requires authentication", proxy.Host)
+	default:
+		return nil, fmt.Errorf("Proxy %s chose an unsupported authentication method (%d)", proxy.Host, reply[1])
+	}
+
+	req := []byte{socks5Version, socks5Connect, 0}
+	ip := net.ParseIP(host)
+	if ip == nil && proxy.Scheme == "socks5" {
+		ips, err := net.LookupIP(host)
+		if err != nil {
+			return nil, err
+		}
+		if len(ips) == 0 {
+			return nil, fmt.Errorf("No addresses found for %s", host)
+		}
+		ip = ips[0]
+	}
+	if ip == nil {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("Host name %q is too long for SOCKS5", host)
+		}
+		req = append(req, socks5AddrDomain, byte(len(host)))
+		req = append(req, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(req, socks5AddrIPv4)
+		req = append(req, ip4...)
+	} else {
+		req = append(req, socks5AddrIPv6)
+		req = append(req, ip.To16()...)
+	}
+	req = append(req, byte(port>>8), byte(port))
+
+	if _, err := conn.Write(req); err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, socks5ReadError(proxy, err)
+	}
+	if header[0] != socks5Version {
+		return nil, fmt.Errorf("Proxy %s sent an invalid SOCKS5 reply", proxy.Host)
+	}
+	if header[1] != 0 {
+		reason, ok := socks5Errors[header[1]]
+		if !ok {
+			reason = fmt.Sprintf("error %d", header[1])
+		}
+		return nil, fmt.Errorf("Proxy %s couldn't connect to %s: %s", proxy.Host, addr, reason)
+	}
+
+	// Discard the address the proxy bound to.
+	var boundLen int
+	switch header[3] {
+	case socks5AddrIPv4:
+		boundLen = net.IPv4len
+	case socks5AddrIPv6:
+		boundLen = net.IPv6len
+	case socks5AddrDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return nil, socks5ReadError(proxy, err)
+		}
+		boundLen = int(length[0])
+	default:
+		return nil, fmt.Errorf("Proxy %s sent an invalid SOCKS5 reply", proxy.Host)
+	}
+	if _, err := io.ReadFull(conn, make([]byte, boundLen+2)); err != nil {
+		return nil, socks5ReadError(proxy, err)
+	}
+
+	return conn, nil
+}
+
+func socks5Authenticate(conn net.Conn, proxy *url.URL) error {
+	username := proxy.User.Username()
+	password, _ := proxy.User.Password()
+	if len(username) > 255 || len(password) > 255 {
+		return errors.New("SOCKS5 usernames and passwords can't be longer than 255 bytes")
+	}
+
+	req := []byte{socks5PasswordVersion, byte(len(username))}
+	req = append(req, username...)
+	req = append(req, byte(len(password)))
+	req = append(req, password...)
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return socks5ReadError(proxy, err)
+	}
+	if reply[1] != 0 {
+		return fmt.Errorf("Proxy %s rejected the username and password", proxy.Host)
+	}
+	return nil
+}
+
+func socks5ReadError(proxy *url.URL, err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = errProxyClosed
+	}
+	return fmt.Errorf("Couldn't read response from proxy %s: %s", proxy.Host, err)
+}
@@ -0,0 +1,166 @@
+package dockertest
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Client talks plain HTTP to a Docker daemon, or a proxy to one, at a
+// DOCKER_HOST style unix:// or tcp:// URL.
+type Client struct {
+	network string
+	address string
+}
+
+func NewClient(dockerHost string) (*Client, error) {
+	u, err := url.Parse(dockerHost)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "unix":
+		return &Client{"unix", u.Path}, nil
+	case "tcp":
+		return &Client{"tcp", u.Host}, nil
+	}
+	return nil, fmt.Errorf("dockertest: unsupported DOCKER_HOST %q", dockerHost)
+}
+
+// Do sends a request with no body, and returns the response.
+func (c *Client) Do(method, path string) (*http.Response, error) {
+	conn, err := net.Dial(c.network, c.address)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(method, "http://docker/v"+APIVersion+path, nil)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body = &closeBoth{resp.Body, conn}
+	return resp, nil
+}
+
+// Attach attaches to a container, returning the hijacked connection.
+// Anything written to it is echoed back by the fake daemon.
+func (c *Client) Attach(id string) (net.Conn, io.Reader, error) {
+	conn, err := net.Dial(c.network, c.address)
+	if err != nil {
+		return nil, nil, err
+	}
+	req, err := http.NewRequest("POST", "http://docker/v"+APIVersion+"/containers/"+id+"/attach?stream=1&stdin=1&stdout=1", nil)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "tcp")
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols && resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, nil, fmt.Errorf("dockertest: attach to %s: %s", id, resp.Status)
+	}
+	return conn, reader, nil
+}
+
+// RunCLI acts like the docker command-line tool, for the few commands tests
+// need:
+//
+//	version      print the daemon's version
+//	ps           list containers, one ID and name per line
+//	attach ID    copy stdin to the container and its output to stdout
+func RunCLI(args []string, dockerHost string, stdin io.Reader, stdout io.Writer) error {
+	client, err := NewClient(dockerHost)
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		return fmt.Errorf("dockertest: no command")
+	}
+
+	switch args[0] {
+	case "version":
+		var version map[string]string
+		if err := client.getJSON("/version", &version); err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "Server version: %s\nServer API version: %s\n", version["Version"], version["ApiVersion"])
+	case "ps":
+		var containers []Container
+		if err := client.getJSON("/containers/json", &containers); err != nil {
+			return err
+		}
+		for _, container := range containers {
+			fmt.Fprintf(stdout, "%s %s\n", container.Id, strings.Join(container.Names, ","))
+		}
+	case "attach":
+		if len(args) != 2 {
+			return fmt.Errorf("dockertest: attach expects a container ID")
+		}
+		conn, reader, err := client.Attach(args[1])
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		go func() {
+			io.Copy(conn, stdin)
+			if tcpConn, ok := conn.(interface {
+				CloseWrite() error
+			}); ok {
+				tcpConn.CloseWrite()
+			}
+		}()
+		io.Copy(stdout, reader)
+	default:
+		return fmt.Errorf("dockertest: unknown command %q", args[0])
+	}
+	return nil
+}
+
+func (c *Client) getJSON(path string, v interface{}) error {
+	resp, err := c.Do("GET", path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("dockertest: GET %s: %s", path, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+type closeBoth struct {
+	io.ReadCloser
+	conn net.Conn
+}
+
+func (c *closeBoth) Close() error {
+	c.ReadCloser.Close()
+	return c.conn.Close()
+}
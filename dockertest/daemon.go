@@ -0,0 +1,268 @@
+// Package dockertest provides a fake Docker daemon, served over TLS with
+// client certificates as hosts' daemons are, and a minimal client for it,
+// for testing the CLI end to end without a network.
+//
+// The daemon implements just enough of the Docker Remote API for the CLI's
+// tests: /_ping, /version, /containers/json and attaching to a container,
+// which hijacks the connection and echoes back whatever's sent to it.
+package dockertest
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Version is the Docker version the daemon says it is.
+const Version = "1.3.0"
+
+// APIVersion is the Remote API version the daemon says it speaks.
+const APIVersion = "1.15"
+
+// CA is a throwaway certificate authority.
+type CA struct {
+	Cert *x509.Certificate
+	Key  crypto.Signer
+	PEM  []byte
+}
+
+// NewCA creates a CA called commonName that's valid for a year.
+func NewCA(commonName string) (*CA, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &CA{Cert: cert, Key: key, PEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}, nil
+}
+
+// IssueServer issues a server certificate for 127.0.0.1 and localhost.
+func (ca *CA) IssueServer() (tls.Certificate, error) {
+	return ca.issue(&x509.Certificate{
+		Subject:     pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+		DNSNames:    []string{"localhost"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+}
+
+// IssueClient issues a client certificate.
+func (ca *CA) IssueClient(commonName string) (tls.Certificate, error) {
+	return ca.issue(&x509.Certificate{
+		Subject:     pkix.Name{CommonName: commonName},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+}
+
+// SignClient issues a client certificate for pub, a key generated
+// elsewhere, e.g. from a certificate request.
+func (ca *CA) SignClient(commonName string, pub crypto.PublicKey) (*x509.Certificate, error) {
+	return ca.sign(&x509.Certificate{
+		Subject:     pkix.Name{CommonName: commonName},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, pub)
+}
+
+func (ca *CA) issue(template *x509.Certificate) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	cert, err := ca.sign(template, &key.PublicKey)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{cert.Raw}, PrivateKey: key}, nil
+}
+
+func (ca *CA) sign(template *x509.Certificate, pub crypto.PublicKey) (*x509.Certificate, error) {
+	var err error
+	template.SerialNumber, err = rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(365 * 24 * time.Hour)
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.Cert, pub, ca.Key)
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(der)
+}
+
+// Container is a container the daemon lists, as /containers/json returns
+// it.
+type Container struct {
+	Id      string
+	Image   string
+	Command string
+	Names   []string
+	Status  string
+}
+
+// Daemon is a fake Docker daemon which only accepts connections with a
+// client certificate signed by its CA.
+type Daemon struct {
+	// Addr is the address the daemon is listening on.
+	Addr string
+
+	listener  net.Listener
+	authorize func(*x509.Certificate) bool
+
+	mu         sync.Mutex
+	containers []Container
+	requests   []string
+}
+
+// NewDaemon starts a daemon with a certificate signed by ca. If authorize
+// isn't nil, a client certificate signed by ca is only accepted if authorize
+// returns true for it too. Close the daemon when you're done.
+func NewDaemon(ca *CA, authorize func(*x509.Certificate) bool) (*Daemon, error) {
+	serverCert, err := ca.IssueServer()
+	if err != nil {
+		return nil, err
+	}
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.Cert)
+
+	d := &Daemon{authorize: authorize}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+		// Unlike VerifyPeerCertificate, this is called for resumed
+		// sessions too, so a revoked certificate can't resume one.
+		VerifyConnection: func(state tls.ConnectionState) error {
+			cert := state.PeerCertificates[0]
+			if d.authorize != nil && !d.authorize(cert) {
+				return fmt.Errorf("dockertest: client certificate %s isn't authorized", cert.SerialNumber)
+			}
+			return nil
+		},
+	}
+
+	d.listener, err = tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		return nil, err
+	}
+	d.Addr = d.listener.Addr().String()
+
+	// Refused handshakes are expected, so there's no need to log them.
+	server := &http.Server{Handler: d, ErrorLog: log.New(ioutil.Discard, "", 0)}
+	go server.Serve(d.listener)
+	return d, nil
+}
+
+// Close stops the daemon listening.
+func (d *Daemon) Close() error {
+	return d.listener.Close()
+}
+
+// AddContainer adds a container for the daemon to list, and to be attached
+// to.
+func (d *Daemon) AddContainer(container Container) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.containers = append(d.containers, container)
+}
+
+// Requests returns the method and path of every request the daemon has got,
+// e.g. "GET /version", without the API version prefix.
+func (d *Daemon) Requests() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]string(nil), d.requests...)
+}
+
+var versionPrefix = regexp.MustCompile(`^/v[0-9.]+/`)
+
+func (d *Daemon) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	urlPath := versionPrefix.ReplaceAllString(r.URL.Path, "/")
+
+	d.mu.Lock()
+	d.requests = append(d.requests, r.Method+" "+urlPath)
+	containers := append([]Container{}, d.containers...)
+	d.mu.Unlock()
+
+	switch {
+	case urlPath == "/_ping" && r.Method == "GET":
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, "OK")
+	case urlPath == "/version" && r.Method == "GET":
+		writeJSON(w, map[string]string{
+			"Version":    Version,
+			"ApiVersion": APIVersion,
+			"Os":         "linux",
+			"Arch":       "amd64",
+		})
+	case urlPath == "/containers/json" && r.Method == "GET":
+		writeJSON(w, containers)
+	case strings.HasPrefix(urlPath, "/containers/") && strings.HasSuffix(urlPath, "/attach") && r.Method == "POST":
+		id := strings.TrimSuffix(strings.TrimPrefix(urlPath, "/containers/"), "/attach")
+		for _, container := range containers {
+			if container.Id == id {
+				attach(w)
+				return
+			}
+		}
+		http.Error(w, fmt.Sprintf("No such container: %s", id), http.StatusNotFound)
+	default:
+		http.Error(w, "404 page not found", http.StatusNotFound)
+	}
+}
+
+// attach hijacks the connection, as the real daemon does, and echoes back
+// everything the client sends until it closes its side.
+func attach(w http.ResponseWriter) {
+	conn, buf, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer conn.Close()
+
+	fmt.Fprint(buf, "HTTP/1.1 101 UPGRADED\r\nContent-Type: application/vnd.docker.raw-stream\r\nConnection: Upgrade\r\nUpgrade: tcp\r\n\r\n")
+	buf.Flush()
+
+	io.Copy(conn, buf)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
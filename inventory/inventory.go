@@ -0,0 +1,253 @@
+// Package inventory keeps a copy of the user's hosts, as the Deploy.IO API
+// last listed them, in ~/.deploy/cache. Commands which only need to look a
+// host up, like 'deploy ip' and 'deploy docker', use it to save a round trip
+// to the API, and to keep working while the API is down.
+//
+// Each account's hosts are kept in a directory named after a hash of the
+// API's URL, the username and a fingerprint of the API key, so that logging
+// in as someone else never shows the hosts of whoever logged in before.
+// hosts.json holds the hosts without their certificates and keys, along with
+// the ETag the API listed them with and when they were fetched. The
+// certificates and keys are kept apart, in certs/ID.json for each host. The
+// directories are created 0700, files are written 0600, and certificate
+// files readable by anyone else are ignored.
+package inventory
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/bbbacsa/deploy.io/api"
+	"github.com/bbbacsa/deploy.io/utils"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// DefaultTTL is how long hosts are used for before checking with the API
+// that they haven't changed.
+var DefaultTTL = time.Minute
+
+// ErrNotFound is returned by Host when the user has no host by that name.
+var ErrNotFound = errors.New("Not found")
+
+type Inventory struct {
+	Dir string
+	TTL time.Duration
+
+	// Refresh makes every lookup check with the API, however recently the
+	// hosts were fetched.
+	Refresh bool
+
+	// Stderr, if not nil, is warned when the API can't be reached and hosts
+	// are looked up in an old copy instead.
+	Stderr io.Writer
+}
+
+// GetDir returns the directory inventories are kept in.
+func GetDir() string {
+	return path.Join(os.Getenv("HOME"), ".deploy", "cache")
+}
+
+// ForAPI returns the inventory of the hosts client's account has with its
+// API.
+func ForAPI(client *api.HTTPClient) *Inventory {
+	h := md5.New()
+	fmt.Fprintf(h, "%s\n%s\n%x", client.BaseURL, client.Username, sha256.Sum256([]byte(client.Key)))
+	return &Inventory{Dir: path.Join(GetDir(), fmt.Sprintf("%x", h.Sum(nil))), TTL: DefaultTTL}
+}
+
+// record is what's saved in hosts.json.
+type record struct {
+	ETag    string
+	Fetched time.Time
+	Hosts   []*api.Host
+}
+
+// certs is what's saved in a host's certificate file.
+type certs struct {
+	ClientCert string
+	ClientKey  string
+	CACert     string
+}
+
+// Hosts returns the user's hosts, fetching them from client's API if they
+// were last fetched more than TTL ago.
+func (inv *Inventory) Hosts(client *api.HTTPClient) ([]*api.Host, error) {
+	hosts, _, err := inv.hosts(client, inv.Refresh)
+	return hosts, err
+}
+
+// Host returns the host called name, or with the ID name. If it isn't in
+// the inventory, the API is asked again, in case the host is new.
+func (inv *Inventory) Host(client *api.HTTPClient, name string) (*api.Host, error) {
+	hosts, asked, err := inv.hosts(client, inv.Refresh)
+	if err != nil {
+		return nil, err
+	}
+	if host := find(hosts, name); host != nil {
+		return host, nil
+	}
+	if !asked {
+		if hosts, _, err = inv.hosts(client, true); err != nil {
+			return nil, err
+		}
+		if host := find(hosts, name); host != nil {
+			return host, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// Forget deletes the inventory, so that hosts are fetched again next time.
+// Call it after changing hosts.
+func (inv *Inventory) Forget() error {
+	return os.RemoveAll(inv.Dir)
+}
+
+// hosts returns the user's hosts, and whether the API was asked for them.
+func (inv *Inventory) hosts(client *api.HTTPClient, refresh bool) ([]*api.Host, bool, error) {
+	saved, err := inv.load()
+	if err != nil {
+		return nil, false, err
+	}
+	if saved != nil && !refresh && time.Since(saved.Fetched) < inv.TTL {
+		return saved.Hosts, false, nil
+	}
+
+	etag := ""
+	if saved != nil {
+		etag = saved.ETag
+	}
+	hosts, etag, err := client.GetHostsIfNoneMatch(etag)
+	switch {
+	case err == api.ErrNotModified && saved != nil:
+		saved.Fetched = time.Now()
+	case err != nil && saved != nil && api.IsUnreachable(err):
+		if inv.Stderr != nil {
+			fmt.Fprintf(inv.Stderr, "Warning: couldn't reach the Deploy.IO API, so using your hosts as of %s ago: %s\n", strings.ToLower(utils.HumanDuration(time.Since(saved.Fetched))), err)
+		}
+		return saved.Hosts, true, nil
+	case err != nil:
+		return nil, true, err
+	default:
+		saved = &record{ETag: etag, Fetched: time.Now(), Hosts: hosts}
+	}
+
+	if err := inv.save(saved); err != nil {
+		return nil, true, err
+	}
+	return saved.Hosts, true, nil
+}
+
+func find(hosts []*api.Host, name string) *api.Host {
+	for _, host := range hosts {
+		if host.Name == name || (host.ID != "" && host.ID == name) {
+			return host
+		}
+	}
+	return nil
+}
+
+// load returns what's saved, with the certificates put back, or nil if
+// there's nothing usable saved.
+func (inv *Inventory) load() (*record, error) {
+	data, err := ioutil.ReadFile(path.Join(inv.Dir, "hosts.json"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var saved record
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, nil
+	}
+
+	for _, host := range saved.Hosts {
+		filename := inv.certsPath(host)
+		info, err := os.Stat(filename)
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if info.Mode().Perm()&0077 != 0 {
+			if inv.Stderr != nil {
+				fmt.Fprintf(inv.Stderr, "Warning: ignoring cached certificates %s, which are accessible by other users\n", filename)
+			}
+			return nil, nil
+		}
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		var c certs
+		if err := json.Unmarshal(data, &c); err != nil {
+			return nil, nil
+		}
+		host.ClientCert, host.ClientKey, host.CACert = c.ClientCert, c.ClientKey, c.CACert
+	}
+	return &saved, nil
+}
+
+// save writes the certificates first, so that hosts.json never names a
+// host whose certificates haven't been written, then removes any left over
+// from hosts that have gone.
+func (inv *Inventory) save(saved *record) error {
+	certDir := path.Join(inv.Dir, "certs")
+	if err := os.MkdirAll(certDir, 0700); err != nil {
+		return err
+	}
+
+	filenames := map[string]bool{}
+	stripped := []*api.Host{}
+	for _, host := range saved.Hosts {
+		data, err := json.Marshal(certs{ClientCert: host.ClientCert, ClientKey: host.ClientKey, CACert: host.CACert})
+		if err != nil {
+			return err
+		}
+		filename := inv.certsPath(host)
+		if err := utils.WriteFileAtomic(filename, data, 0600); err != nil {
+			return err
+		}
+		filenames[path.Base(filename)] = true
+
+		h := *host
+		h.ClientCert, h.ClientKey, h.CACert = "", "", ""
+		stripped = append(stripped, &h)
+	}
+
+	data, err := json.MarshalIndent(record{ETag: saved.ETag, Fetched: saved.Fetched, Hosts: stripped}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := utils.WriteFileAtomic(path.Join(inv.Dir, "hosts.json"), data, 0600); err != nil {
+		return err
+	}
+
+	infos, err := ioutil.ReadDir(certDir)
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		if !filenames[info.Name()] && !strings.HasPrefix(info.Name(), ".tmp-") {
+			os.Remove(path.Join(certDir, info.Name()))
+		}
+	}
+	return nil
+}
+
+func (inv *Inventory) certsPath(host *api.Host) string {
+	name := host.ID
+	if name == "" {
+		name = host.Name
+	}
+	return path.Join(inv.Dir, "certs", path.Base(name)+".json")
+}
@@ -0,0 +1,248 @@
+package inventory
+
+import (
+	"bytes"
+	"github.com/bbbacsa/deploy.io/api"
+	"github.com/bbbacsa/deploy.io/api/apitest"
+	"github.com/bbbacsa/deploy.io/dockertest"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestInventory(t *testing.T) (*Inventory, *apitest.Server, *api.HTTPClient, func()) {
+	server := apitest.NewServer()
+	server.SetEnv(t)
+	key := server.AddUser("bfirsh", "secret")
+	server.AddHost("bfirsh", "default", 512)
+
+	dir, err := ioutil.TempDir("", "deploy-inventory-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	inv := &Inventory{Dir: path.Join(dir, "cache"), TTL: time.Hour}
+	client := &api.HTTPClient{BaseURL: server.URL, Username: "bfirsh", Key: key}
+	return inv, server, client, func() {
+		server.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// hostsRequests returns the If-None-Match header of every request the
+// server got for the list of hosts.
+func hostsRequests(server *apitest.Server) []string {
+	etags := []string{}
+	for _, request := range server.Requests() {
+		if request.Method == "GET" && request.Path == "/hosts" {
+			etags = append(etags, request.Header.Get("If-None-Match"))
+		}
+	}
+	return etags
+}
+
+func TestHostIsCached(t *testing.T) {
+	inv, server, client, done := newTestInventory(t)
+	defer done()
+
+	host, err := inv.Host(client, "default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if host.ClientCert == "" || host.ClientKey == "" || host.CACert == "" {
+		t.Fatalf("expected the host's certificates, got %+v", host)
+	}
+
+	cached, err := inv.Host(client, "default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cached, host) {
+		t.Errorf("expected the cached host to be %+v, got %+v", host, cached)
+	}
+	if requests := hostsRequests(server); len(requests) != 1 {
+		t.Errorf("expected the API to be asked once, got %d requests", len(requests))
+	}
+
+	// The certificates aren't in hosts.json, but in their own file which
+	// nobody else can read.
+	data, err := ioutil.ReadFile(path.Join(inv.Dir, "hosts.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("PRIVATE KEY")) || bytes.Contains(data, []byte("CERTIFICATE")) {
+		t.Errorf("expected hosts.json not to contain certificates or keys, got %s", data)
+	}
+	info, err := os.Stat(path.Join(inv.Dir, "certs", host.ID+".json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("expected the certificates to be 0600, got %o", info.Mode().Perm())
+	}
+}
+
+func TestNewHostIsFetched(t *testing.T) {
+	inv, server, client, done := newTestInventory(t)
+	defer done()
+
+	if _, err := inv.Hosts(client); err != nil {
+		t.Fatal(err)
+	}
+	server.AddHost("bfirsh", "web", 512)
+	if _, err := inv.Host(client, "web"); err != nil {
+		t.Errorf("expected a host that isn't cached yet to be fetched, got %v", err)
+	}
+	if _, err := inv.Host(client, "nothere"); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestRevalidate(t *testing.T) {
+	inv, server, client, done := newTestInventory(t)
+	defer done()
+	inv.TTL = 0
+
+	for i := 0; i < 2; i++ {
+		if _, err := inv.Host(client, "default"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	server.AddHost("bfirsh", "web", 512)
+	hosts, err := inv.Hosts(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hosts) != 2 {
+		t.Errorf("expected 2 hosts, got %d", len(hosts))
+	}
+
+	// The second request said which hosts it had, and got 304 Not Modified,
+	// so the third said the same.
+	requests := hostsRequests(server)
+	if len(requests) != 3 || requests[0] != "" || requests[1] == "" || requests[2] != requests[1] {
+		t.Errorf("expected the first request to have no If-None-Match and the others the same one, got %q", requests)
+	}
+}
+
+func TestUnreachable(t *testing.T) {
+	inv, server, client, done := newTestInventory(t)
+	defer done()
+	var stderr bytes.Buffer
+	inv.Stderr = &stderr
+	inv.Refresh = true
+
+	server.SetUnreachable(true)
+	if _, err := inv.Hosts(client); err == nil || !api.IsUnreachable(err) {
+		t.Fatalf("expected the API to be unreachable with nothing cached, got %v", err)
+	}
+
+	server.SetUnreachable(false)
+	if _, err := inv.Hosts(client); err != nil {
+		t.Fatal(err)
+	}
+	server.SetUnreachable(true)
+	host, err := inv.Host(client, "default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if host.Name != "default" || host.ClientKey == "" {
+		t.Errorf("expected the cached host, got %+v", host)
+	}
+	if !strings.Contains(stderr.String(), "Warning: couldn't reach the Deploy.IO API") {
+		t.Errorf("expected a warning, got %q", stderr.String())
+	}
+}
+
+func TestUntrustedCertificateIsAnError(t *testing.T) {
+	inv, _, client, done := newTestInventory(t)
+	defer done()
+	var stderr bytes.Buffer
+	inv.Stderr = &stderr
+	inv.Refresh = true
+
+	if _, err := inv.Hosts(client); err != nil {
+		t.Fatal(err)
+	}
+
+	// Trust another CA instead of the server's.
+	ca, err := dockertest.NewCA("untrusted CA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bundle := path.Join(path.Dir(inv.Dir), "ca.pem")
+	if err := ioutil.WriteFile(bundle, ca.PEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("DEPLOY_CA_BUNDLE", bundle)
+	client = &api.HTTPClient{BaseURL: client.BaseURL, Username: client.Username, Key: client.Key}
+
+	if _, err := inv.Host(client, "default"); err == nil || api.IsUnreachable(err) {
+		t.Errorf("expected the certificate error, got %v", err)
+	}
+	if stderr.Len() > 0 {
+		t.Errorf("expected no warning about using cached hosts, got %q", stderr.String())
+	}
+}
+
+func TestForget(t *testing.T) {
+	inv, server, client, done := newTestInventory(t)
+	defer done()
+
+	if _, err := inv.Hosts(client); err != nil {
+		t.Fatal(err)
+	}
+	if err := inv.Forget(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := inv.Hosts(client); err != nil {
+		t.Fatal(err)
+	}
+	if requests := hostsRequests(server); len(requests) != 2 || requests[1] != "" {
+		t.Errorf("expected the hosts to be fetched again from scratch, got %q", requests)
+	}
+}
+
+func TestForAPIIsPerAccount(t *testing.T) {
+	client := &api.HTTPClient{BaseURL: "https://api.deploy.io", Username: "bfirsh", Key: "key"}
+	dir := ForAPI(client).Dir
+	if other := ForAPI(&api.HTTPClient{BaseURL: client.BaseURL, Username: client.Username, Key: client.Key}).Dir; other != dir {
+		t.Errorf("expected the same account to have the same inventory, got %s and %s", dir, other)
+	}
+	for _, other := range []*api.HTTPClient{
+		{BaseURL: "https://staging.deploy.io", Username: "bfirsh", Key: "key"},
+		{BaseURL: client.BaseURL, Username: "aanand", Key: "key"},
+		{BaseURL: client.BaseURL, Username: "bfirsh", Key: "another-key"},
+	} {
+		if ForAPI(other).Dir == dir {
+			t.Errorf("expected %s at %s with key %q to have its own inventory", other.Username, other.BaseURL, other.Key)
+		}
+	}
+}
+
+func TestInsecureCertificatesAreIgnored(t *testing.T) {
+	inv, server, client, done := newTestInventory(t)
+	defer done()
+	var stderr bytes.Buffer
+	inv.Stderr = &stderr
+
+	host, err := inv.Host(client, "default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(path.Join(inv.Dir, "certs", host.ID+".json"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := inv.Host(client, "default"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(stderr.String(), "accessible by other users") {
+		t.Errorf("expected a warning, got %q", stderr.String())
+	}
+	if requests := hostsRequests(server); len(requests) != 2 {
+		t.Errorf("expected the hosts to be fetched again, got %d requests", len(requests))
+	}
+}
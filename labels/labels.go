@@ -0,0 +1,185 @@
+// Package labels parses the labels set on hosts, like env=prod, and the
+// selectors that pick hosts by their labels, like env=prod,team!=data.
+//
+// Keys and values are letters, numbers, '-', '_' and '.', starting and
+// ending with a letter or number. Keys can also have a prefix ending in '/',
+// e.g. deploy.io/owner. Values can be empty.
+package labels
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var (
+	validKey   = regexp.MustCompile(`^([a-z0-9]([a-z0-9.-]*[a-z0-9])?/)?[A-Za-z0-9]([A-Za-z0-9_.-]*[A-Za-z0-9])?$`)
+	validValue = regexp.MustCompile(`^([A-Za-z0-9]([A-Za-z0-9_.-]*[A-Za-z0-9])?)?$`)
+)
+
+func CheckKey(key string) error {
+	if !validKey.MatchString(key) || len(key) > 253 {
+		return fmt.Errorf("Invalid label key %q: keys are letters, numbers, '-', '_' and '.', starting and ending with a letter or number", key)
+	}
+	return nil
+}
+
+func CheckValue(value string) error {
+	if !validValue.MatchString(value) || len(value) > 63 {
+		return fmt.Errorf("Invalid label value %q: values are letters, numbers, '-', '_' and '.', starting and ending with a letter or number", value)
+	}
+	return nil
+}
+
+// ParseLabel parses KEY=VALUE.
+func ParseLabel(s string) (key, value string, err error) {
+	i := strings.Index(s, "=")
+	if i < 0 {
+		return "", "", fmt.Errorf("Expected a label as KEY=VALUE, got %q", s)
+	}
+	key, value = s[:i], s[i+1:]
+	if err := CheckKey(key); err != nil {
+		return "", "", err
+	}
+	if err := CheckValue(value); err != nil {
+		return "", "", err
+	}
+	return key, value, nil
+}
+
+// ParseChanges parses changes to a host's labels: KEY=VALUE sets a label,
+// and KEY- removes one.
+func ParseChanges(args []string) (set map[string]string, remove []string, err error) {
+	set = map[string]string{}
+	for _, arg := range args {
+		if strings.HasSuffix(arg, "-") && !strings.Contains(arg, "=") {
+			key := strings.TrimSuffix(arg, "-")
+			if err := CheckKey(key); err != nil {
+				return nil, nil, err
+			}
+			remove = append(remove, key)
+			continue
+		}
+		key, value, err := ParseLabel(arg)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Expected KEY=VALUE to set a label or KEY- to remove one, got %q", arg)
+		}
+		set[key] = value
+	}
+	for _, key := range remove {
+		if _, ok := set[key]; ok {
+			return nil, nil, fmt.Errorf("Label %s is both set and removed", key)
+		}
+	}
+	return set, remove, nil
+}
+
+// String formats labels as KEY=VALUE pairs, sorted by key and separated by
+// commas.
+func String(labels map[string]string) string {
+	keys := []string{}
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	pairs := []string{}
+	for _, key := range keys {
+		pairs = append(pairs, key+"="+labels[key])
+	}
+	return strings.Join(pairs, ",")
+}
+
+// A Requirement is one part of a selector.
+type Requirement struct {
+	Key string
+	// Op is "=", "!=", "exists" or "!exists".
+	Op    string
+	Value string
+}
+
+func (r Requirement) Matches(labels map[string]string) bool {
+	value, ok := labels[r.Key]
+	switch r.Op {
+	case "=":
+		return ok && value == r.Value
+	case "!=":
+		return !ok || value != r.Value
+	case "exists":
+		return ok
+	}
+	return !ok
+}
+
+func (r Requirement) String() string {
+	switch r.Op {
+	case "exists":
+		return r.Key
+	case "!exists":
+		return "!" + r.Key
+	}
+	return r.Key + r.Op + r.Value
+}
+
+// A Selector matches labels that meet all of its requirements. The empty
+// selector matches everything.
+type Selector []Requirement
+
+// ParseSelector parses requirements separated by commas, each of which is
+// one of:
+//
+//	KEY=VALUE   (or KEY==VALUE) the label is set to VALUE
+//	KEY!=VALUE  the label isn't set to VALUE, or isn't set at all
+//	KEY         the label is set
+//	!KEY        the label isn't set
+func ParseSelector(s string) (Selector, error) {
+	selector := Selector{}
+	if strings.TrimSpace(s) == "" {
+		return selector, nil
+	}
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		var r Requirement
+		switch {
+		case strings.Contains(part, "!="):
+			i := strings.Index(part, "!=")
+			r = Requirement{Key: part[:i], Op: "!=", Value: part[i+2:]}
+		case strings.Contains(part, "=="):
+			i := strings.Index(part, "==")
+			r = Requirement{Key: part[:i], Op: "=", Value: part[i+2:]}
+		case strings.Contains(part, "="):
+			i := strings.Index(part, "=")
+			r = Requirement{Key: part[:i], Op: "=", Value: part[i+1:]}
+		case strings.HasPrefix(part, "!"):
+			r = Requirement{Key: part[1:], Op: "!exists"}
+		default:
+			r = Requirement{Key: part, Op: "exists"}
+		}
+		r.Key, r.Value = strings.TrimSpace(r.Key), strings.TrimSpace(r.Value)
+		if err := CheckKey(r.Key); err != nil {
+			return nil, fmt.Errorf("Invalid selector %q: %s", s, err)
+		}
+		if err := CheckValue(r.Value); err != nil {
+			return nil, fmt.Errorf("Invalid selector %q: %s", s, err)
+		}
+		selector = append(selector, r)
+	}
+	return selector, nil
+}
+
+func (s Selector) Matches(labels map[string]string) bool {
+	for _, r := range s {
+		if !r.Matches(labels) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s Selector) String() string {
+	parts := []string{}
+	for _, r := range s {
+		parts = append(parts, r.String())
+	}
+	return strings.Join(parts, ",")
+}
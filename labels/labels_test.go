@@ -0,0 +1,74 @@
+package labels
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseChanges(t *testing.T) {
+	set, remove, err := ParseChanges([]string{"env=prod", "team-", "deploy.io/owner=ben", "empty="})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := map[string]string{"env": "prod", "deploy.io/owner": "ben", "empty": ""}; !reflect.DeepEqual(set, expected) {
+		t.Errorf("expected to set %v, got %v", expected, set)
+	}
+	if expected := []string{"team"}; !reflect.DeepEqual(remove, expected) {
+		t.Errorf("expected to remove %v, got %v", expected, remove)
+	}
+
+	for _, args := range [][]string{{"env"}, {"=prod"}, {"env=pr od"}, {"-env=prod"}, {"env=prod", "env-"}, {"-"}} {
+		if _, _, err := ParseChanges(args); err == nil {
+			t.Errorf("expected an error for %q", args)
+		}
+	}
+}
+
+func TestString(t *testing.T) {
+	if s := String(map[string]string{"team": "web", "env": "prod"}); s != "env=prod,team=web" {
+		t.Errorf("expected env=prod,team=web, got %s", s)
+	}
+	if s := String(nil); s != "" {
+		t.Errorf("expected nothing, got %s", s)
+	}
+}
+
+func TestSelector(t *testing.T) {
+	labels := map[string]string{"env": "prod", "team": "web"}
+	cases := map[string]bool{
+		"":                      true,
+		"env=prod":              true,
+		"env==prod":             true,
+		"env=staging":           false,
+		"env=prod,team!=data":   true,
+		"env=prod, team!=web":   false,
+		"owner!=ben":            true,
+		"team":                  true,
+		"owner":                 false,
+		"!owner":                true,
+		"!team":                 false,
+		"env=prod,team,!owner":  true,
+		"env=prod,team=web,x=y": false,
+	}
+	for s, expected := range cases {
+		selector, err := ParseSelector(s)
+		if err != nil {
+			t.Errorf("%q: %s", s, err)
+			continue
+		}
+		if selector.Matches(labels) != expected {
+			t.Errorf("expected %q matching %v to be %v", s, labels, expected)
+		}
+	}
+
+	selector, _ := ParseSelector("env==prod, team!=data,owner,!old")
+	if s := selector.String(); s != "env=prod,team!=data,owner,!old" {
+		t.Errorf("expected env=prod,team!=data,owner,!old, got %s", s)
+	}
+
+	for _, s := range []string{"env=prod,", "=prod", "env=a b", "!", "env!=pr*d"} {
+		if _, err := ParseSelector(s); err == nil {
+			t.Errorf("expected an error for %q", s)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+// Package manifest reads deploy.yml, which lists the hosts you want, so
+// that 'deploy plan' and 'deploy apply' can make the hosts you have match:
+//
+//	hosts:
+//	  - name: web
+//	    size: 1G
+//	    region: nyc1
+//	    labels:
+//	      env: prod
+//	  - name: db
+//	    size: 4G
+//
+// Only name is required. New hosts are DefaultSize unless size is given, and
+// region defaults to wherever the API puts new hosts.
+package manifest
+
+import (
+	"fmt"
+	"github.com/bbbacsa/deploy.io/labels"
+	"github.com/bbbacsa/deploy.io/utils"
+	"github.com/bbbacsa/deploy.io/vendor/gopkg.in/yaml.v2"
+	"io/ioutil"
+	"regexp"
+	"sort"
+)
+
+// DefaultSize is how much RAM, in MB, a host is created with if the manifest
+// doesn't give its size.
+const DefaultSize = 512
+
+type Manifest struct {
+	Hosts []Host
+}
+
+type Host struct {
+	Name string
+	// Size is how much RAM the host should have, in MB, or 0 if it isn't
+	// given, in which case an existing host is left the size it is.
+	Size   int
+	Region string
+	// Labels is nil if the host's labels aren't given, in which case they're
+	// left alone.
+	Labels map[string]string
+}
+
+var validName = regexp.MustCompile(`^[a-z0-9_]+$`)
+
+// Load reads and parses a manifest file.
+func Load(filename string) (*Manifest, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	m, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err)
+	}
+	return m, nil
+}
+
+// hostText holds the scalars of a host as they're written, e.g. a label
+// value of 1.10 rather than the number 1.1.
+type hostText struct {
+	Name   string
+	Size   string
+	Region string
+	Labels map[string]string
+}
+
+func Parse(data []byte) (*Manifest, error) {
+	// The document is read twice: loosely, to check its shape and which keys
+	// it has, and then into hostText for the values.
+	var document interface{}
+	if err := yaml.UnmarshalStrict(data, &document); err != nil {
+		return nil, err
+	}
+	if document == nil {
+		return &Manifest{Hosts: []Host{}}, nil
+	}
+	top, ok := stringKeys(document)
+	if !ok {
+		return nil, fmt.Errorf("expected 'hosts:' at the top")
+	}
+	if err := checkKeys(top, "the top", "hosts"); err != nil {
+		return nil, err
+	}
+
+	m := &Manifest{Hosts: []Host{}}
+	items, ok := top["hosts"].([]interface{})
+	if !ok && top["hosts"] != nil {
+		return nil, fmt.Errorf("expected hosts to be a list")
+	}
+	for i, item := range items {
+		if err := checkHost(item); err != nil {
+			return nil, fmt.Errorf("host %d: %s", i+1, err)
+		}
+	}
+
+	var text struct {
+		Hosts []hostText
+	}
+	if err := yaml.Unmarshal(data, &text); err != nil {
+		return nil, err
+	}
+	names := map[string]bool{}
+	for i, item := range items {
+		fields, _ := stringKeys(item)
+		host, err := parseHost(text.Hosts[i], fields)
+		if err != nil {
+			return nil, fmt.Errorf("host %d: %s", i+1, err)
+		}
+		if names[host.Name] {
+			return nil, fmt.Errorf("host %q is listed more than once", host.Name)
+		}
+		names[host.Name] = true
+		m.Hosts = append(m.Hosts, host)
+	}
+	return m, nil
+}
+
+// checkHost returns an error if a host in the document doesn't have the
+// shape of one.
+func checkHost(item interface{}) error {
+	fields, ok := stringKeys(item)
+	if !ok {
+		return fmt.Errorf("expected name, size, region and labels")
+	}
+	if err := checkKeys(fields, "a host", "name", "size", "region", "labels"); err != nil {
+		return err
+	}
+	for _, key := range []string{"name", "size", "region"} {
+		if !isScalar(fields[key]) {
+			return fmt.Errorf("expected %s to be a string", key)
+		}
+	}
+
+	name, _ := fields["name"].(string)
+	if hostLabels, ok := stringKeys(fields["labels"]); ok {
+		for key, value := range hostLabels {
+			if !isScalar(value) {
+				return fmt.Errorf("expected label %s of %s to be a string", key, name)
+			}
+		}
+	} else if fields["labels"] != nil {
+		return fmt.Errorf("expected the labels of %s to be 'key: value' pairs", name)
+	}
+	return nil
+}
+
+// parseHost checks the values of a host that checkHost has passed. fields
+// says which keys were given.
+func parseHost(text hostText, fields map[string]interface{}) (Host, error) {
+	host := Host{Name: text.Name, Region: text.Region}
+	if host.Name == "" {
+		return Host{}, fmt.Errorf("name is missing")
+	}
+	if !validName.MatchString(host.Name) {
+		return Host{}, fmt.Errorf("%q isn't a valid host name: names can only contain lowercase letters, numbers and underscores", host.Name)
+	}
+
+	if text.Size != "" {
+		bytes, err := utils.RAMInBytes(text.Size)
+		if err != nil || bytes < 1024*1024 {
+			return Host{}, fmt.Errorf("%q isn't a valid size for %s", text.Size, host.Name)
+		}
+		host.Size = int(bytes / (1024 * 1024))
+	}
+
+	if _, ok := fields["labels"]; ok {
+		// "labels:" with nothing under it removes them all.
+		host.Labels = map[string]string{}
+		for key, value := range text.Labels {
+			if err := labels.CheckKey(key); err != nil {
+				return Host{}, err
+			}
+			if err := labels.CheckValue(value); err != nil {
+				return Host{}, err
+			}
+			host.Labels[key] = value
+		}
+	}
+	return host, nil
+}
+
+// stringKeys returns value as a map with string keys, if it's a mapping.
+func stringKeys(value interface{}) (map[string]interface{}, bool) {
+	mapping, ok := value.(map[interface{}]interface{})
+	if !ok {
+		return nil, false
+	}
+	fields := map[string]interface{}{}
+	for key, value := range mapping {
+		fields[fmt.Sprint(key)] = value
+	}
+	return fields, true
+}
+
+// isScalar returns whether value is a string, number, bool or nothing, rather
+// than a mapping or a list.
+func isScalar(value interface{}) bool {
+	switch value.(type) {
+	case map[interface{}]interface{}, []interface{}:
+		return false
+	}
+	return true
+}
+
+// checkKeys returns an error if mapping has any key that isn't in keys, to
+// catch typos.
+func checkKeys(mapping map[string]interface{}, what string, keys ...string) error {
+	unknown := []string{}
+	for key := range mapping {
+		known := false
+		for _, k := range keys {
+			known = known || k == key
+		}
+		if !known {
+			unknown = append(unknown, key)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("unknown key %q in %s", unknown[0], what)
+	}
+	return nil
+}
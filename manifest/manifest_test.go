@@ -0,0 +1,97 @@
+package manifest
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	m, err := Parse([]byte(`# Our hosts
+hosts:
+  - name: web   # the front end
+    size: 1G
+    region: nyc1
+    labels:
+      env: prod
+      "team": 'web-and-api' # and more
+  - name: db
+    size: 4096M
+    labels:
+
+  - name: "worker"
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Host{
+		{Name: "web", Size: 1024, Region: "nyc1", Labels: map[string]string{"env": "prod", "team": "web-and-api"}},
+		{Name: "db", Size: 4096, Labels: map[string]string{}},
+		{Name: "worker"},
+	}
+	if !reflect.DeepEqual(m.Hosts, expected) {
+		t.Errorf("expected %+v, got %+v", expected, m.Hosts)
+	}
+}
+
+func TestParseUnindentedList(t *testing.T) {
+	m, err := Parse([]byte("hosts:\n- name: web\n-   name: db\n    size: 2G\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Hosts) != 2 || m.Hosts[0].Name != "web" || m.Hosts[1].Name != "db" || m.Hosts[1].Size != 2048 {
+		t.Errorf("expected web and a 2G db, got %+v", m.Hosts)
+	}
+}
+
+func TestParseEmpty(t *testing.T) {
+	for _, data := range []string{"", "# nothing\n", "hosts:\n"} {
+		m, err := Parse([]byte(data))
+		if err != nil {
+			t.Errorf("%q: %s", data, err)
+			continue
+		}
+		if len(m.Hosts) != 0 {
+			t.Errorf("%q: expected no hosts, got %+v", data, m.Hosts)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	cases := map[string]string{
+		"hosts:\n  - name: web\n    szie: 1G\n":                `host 1: unknown key "szie" in a host`,
+		"hosts:\n  - name: web\n  - name: web\n":               `host "web" is listed more than once`,
+		"hosts:\n  - size: 1G\n":                               "host 1: name is missing",
+		"hosts:\n  - name: Web\n":                              `host 1: "Web" isn't a valid host name`,
+		"hosts:\n  - name: web\n    size: lots\n":              `host 1: "lots" isn't a valid size for web`,
+		"hosts:\n\t- name: web\n":                              "yaml: line 2:",
+		"hosts: [web, db]\n":                                   "host 1: expected name, size, region and labels",
+		"hosts:\n  - name: web\n     size: 1G\n":               "yaml: line 3:",
+		"hosts:\n  - name: web\n    labels: prod\n":            "host 1: expected the labels of web to be 'key: value' pairs",
+		"hosts:\n  - name: 'web\n":                             "yaml: line 3:",
+		"hosts:\n  - web\n":                                    "host 1: expected name, size, region and labels",
+		"- name: web\n":                                        "expected 'hosts:' at the top",
+		"hosts:\n  - name: web\n  name: db\n":                  "yaml: line 2:",
+		"hosts:\n  - name: web\n    name: db\n":                `yaml: unmarshal errors:`,
+		"hosts:\n  - name: [web]\n":                           "host 1: expected name to be a string",
+		"hosts:\n  - name: web\n    labels:\n      - a\n":      "host 1: expected the labels of web to be 'key: value' pairs",
+		"hosts:\n  - name: web\n    labels:\n      env: a b\n": `host 1: Invalid label value "a b"`,
+	}
+	for data, expected := range cases {
+		_, err := Parse([]byte(data))
+		if err == nil || !strings.HasPrefix(err.Error(), expected) {
+			t.Errorf("%q: expected an error starting %q, got %v", data, expected, err)
+		}
+	}
+}
+
+func TestParseQuoted(t *testing.T) {
+	m, err := Parse([]byte("hosts:\n  - name: 'web' # d\n    labels:\n      \"e\": \"1.10\"\n      f: 1.10\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{"e": "1.10", "f": "1.10"}
+	if !reflect.DeepEqual(m.Hosts[0].Labels, expected) {
+		t.Errorf("expected %+v, got %+v", expected, m.Hosts[0].Labels)
+	}
+}
@@ -0,0 +1,223 @@
+package proxy
+
+import (
+	"github.com/bbbacsa/deploy.io/vendor/crypto/tls"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Pool keeps a few upstream connections dialled and handshaken ahead of time,
+// so that a local connection can be forwarded straight away instead of
+// waiting for a TLS handshake with a host on the other side of the world.
+//
+// The pool is filled when the proxy starts and topped up whenever a
+// connection is taken. Idle connections are dropped after MaxIdle and not
+// replaced until the next one is needed, so an unused proxy doesn't hold
+// connections open forever.
+type Pool struct {
+	DialFunc func() (net.Conn, error)
+	Size     int
+	MaxIdle  time.Duration
+
+	mu      sync.Mutex
+	idle    []*idleConn
+	dialing int
+	closed  bool
+
+	stats PoolStats
+}
+
+type idleConn struct {
+	conn    net.Conn
+	created time.Time
+}
+
+// PoolStats counts how upstream connections were obtained.
+type PoolStats struct {
+	Dials         int64 // upstream connections opened
+	Resumed       int64 // of those, how many resumed an earlier TLS session
+	Hits          int64 // local connections handed an already-handshaken connection
+	Misses        int64 // local connections which had to wait for a dial
+	ResumedMisses int64 // of those, how many waited for a resumed session
+}
+
+// HandshakesSaved returns the number of local connections which didn't wait
+// for a full TLS handshake, either because a warm connection was ready or
+// because the session they waited for was resumed.
+func (s PoolStats) HandshakesSaved() int64 {
+	return s.Hits + s.ResumedMisses
+}
+
+func NewPool(dialFunc func() (net.Conn, error), size int, maxIdle time.Duration) *Pool {
+	return &Pool{
+		DialFunc: dialFunc,
+		Size:     size,
+		MaxIdle:  maxIdle,
+	}
+}
+
+// Get returns a warm connection if one is available, and dials a new one
+// otherwise. Either way, the pool is topped back up in the background.
+func (p *Pool) Get() (net.Conn, error) {
+	conn := p.take()
+	if conn != nil {
+		atomic.AddInt64(&p.stats.Hits, 1)
+		p.Fill()
+		return conn, nil
+	}
+
+	atomic.AddInt64(&p.stats.Misses, 1)
+	p.Fill()
+	conn, err := p.dial()
+	if err == nil && didResume(conn) {
+		atomic.AddInt64(&p.stats.ResumedMisses, 1)
+	}
+	return conn, err
+}
+
+// Fill starts dialling in the background until Size connections are idle or
+// being dialled.
+func (p *Pool) Fill() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return
+	}
+
+	for len(p.idle)+p.dialing < p.Size {
+		p.dialing++
+		go p.warm()
+	}
+}
+
+// Close closes every idle connection. Connections already handed out are
+// unaffected.
+func (p *Pool) Close() {
+	p.mu.Lock()
+	idle := p.idle
+	p.idle = nil
+	p.closed = true
+	p.mu.Unlock()
+
+	for _, ic := range idle {
+		ic.conn.Close()
+	}
+}
+
+func (p *Pool) Stats() PoolStats {
+	return PoolStats{
+		Dials:   atomic.LoadInt64(&p.stats.Dials),
+		Resumed: atomic.LoadInt64(&p.stats.Resumed),
+		Hits:    atomic.LoadInt64(&p.stats.Hits),
+		Misses:  atomic.LoadInt64(&p.stats.Misses),
+
+		ResumedMisses: atomic.LoadInt64(&p.stats.ResumedMisses),
+	}
+}
+
+// take returns an idle connection that's still open, or nil if there isn't
+// one.
+func (p *Pool) take() net.Conn {
+	for {
+		conn := p.pop()
+		if conn == nil || isOpen(conn) {
+			return conn
+		}
+		conn.Close()
+	}
+}
+
+func (p *Pool) pop() net.Conn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for len(p.idle) > 0 {
+		ic := p.idle[0]
+		p.idle = p.idle[1:]
+		if p.MaxIdle > 0 && time.Since(ic.created) > p.MaxIdle {
+			go ic.conn.Close()
+			continue
+		}
+		return ic.conn
+	}
+	return nil
+}
+
+// How long isOpen waits to see whether the host has closed a connection.
+// If it has, the close is already there to be read, so it doesn't take long.
+var openCheckTimeout = time.Millisecond
+
+// isOpen returns whether the host is still at the other end of an idle
+// connection. Hosts don't send anything until they're sent a request, so
+// a connection that has something to read has either been closed, or
+// can't be used for a request anyway.
+func isOpen(conn net.Conn) bool {
+	if err := conn.SetReadDeadline(time.Now().Add(openCheckTimeout)); err != nil {
+		return false
+	}
+	var b [1]byte
+	_, err := conn.Read(b[:])
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return false
+	}
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
+func (p *Pool) warm() {
+	conn, err := p.dial()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.dialing--
+	if err != nil {
+		return
+	}
+	if p.closed {
+		conn.Close()
+		return
+	}
+
+	ic := &idleConn{conn, time.Now()}
+	p.idle = append(p.idle, ic)
+
+	if p.MaxIdle > 0 {
+		time.AfterFunc(p.MaxIdle, func() { p.expire(ic) })
+	}
+}
+
+func (p *Pool) expire(expired *idleConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for i, ic := range p.idle {
+		if ic == expired {
+			p.idle = append(p.idle[:i], p.idle[i+1:]...)
+			ic.conn.Close()
+			return
+		}
+	}
+}
+
+func (p *Pool) dial() (net.Conn, error) {
+	conn, err := p.DialFunc()
+	if err != nil {
+		return nil, err
+	}
+
+	atomic.AddInt64(&p.stats.Dials, 1)
+	if didResume(conn) {
+		atomic.AddInt64(&p.stats.Resumed, 1)
+	}
+
+	return conn, nil
+}
+
+func didResume(conn net.Conn) bool {
+	tlsConn, ok := conn.(*tls.Conn)
+	return ok && tlsConn.ConnectionState().DidResume
+}
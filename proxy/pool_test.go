@@ -0,0 +1,136 @@
+package proxy
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeDialer struct {
+	sync.Mutex
+	dials int
+	conns []net.Conn
+}
+
+func (d *fakeDialer) Dial() (net.Conn, error) {
+	d.Lock()
+	defer d.Unlock()
+	d.dials++
+	client, server := net.Pipe()
+	d.conns = append(d.conns, server)
+	return client, nil
+}
+
+func (d *fakeDialer) Dials() int {
+	d.Lock()
+	defer d.Unlock()
+	return d.dials
+}
+
+func waitForIdle(t *testing.T, p *Pool, n int) {
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		p.mu.Lock()
+		idle := len(p.idle)
+		p.mu.Unlock()
+		if idle == n {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %d idle connections", n)
+}
+
+func TestPoolServesWarmConnections(t *testing.T) {
+	d := &fakeDialer{}
+	p := NewPool(d.Dial, 2, 0)
+	defer p.Close()
+
+	p.Fill()
+	waitForIdle(t, p, 2)
+
+	if _, err := p.Get(); err != nil {
+		t.Fatal(err)
+	}
+	waitForIdle(t, p, 2)
+
+	stats := p.Stats()
+	if stats.Hits != 1 || stats.Misses != 0 {
+		t.Errorf("expected 1 hit and no misses, got %+v", stats)
+	}
+	if stats.HandshakesSaved() != 1 {
+		t.Errorf("expected 1 handshake saved, got %d", stats.HandshakesSaved())
+	}
+	if d.Dials() != 3 {
+		t.Errorf("expected 3 dials, got %d", d.Dials())
+	}
+}
+
+func TestPoolDialsWhenEmpty(t *testing.T) {
+	d := &fakeDialer{}
+	p := NewPool(d.Dial, 1, 0)
+	defer p.Close()
+
+	if _, err := p.Get(); err != nil {
+		t.Fatal(err)
+	}
+
+	stats := p.Stats()
+	if stats.Hits != 0 || stats.Misses != 1 {
+		t.Errorf("expected a miss, got %+v", stats)
+	}
+}
+
+func TestPoolExpiresIdleConnections(t *testing.T) {
+	d := &fakeDialer{}
+	p := NewPool(d.Dial, 1, 20*time.Millisecond)
+	defer p.Close()
+
+	p.Fill()
+	waitForIdle(t, p, 1)
+	waitForIdle(t, p, 0)
+
+	if _, err := p.Get(); err != nil {
+		t.Fatal(err)
+	}
+	if stats := p.Stats(); stats.Misses != 1 {
+		t.Errorf("expected an expired connection not to be used, got %+v", stats)
+	}
+}
+
+func TestPoolDropsClosedConnections(t *testing.T) {
+	d := &fakeDialer{}
+	p := NewPool(d.Dial, 2, 0)
+	defer p.Close()
+
+	p.Fill()
+	waitForIdle(t, p, 2)
+
+	d.Lock()
+	closed, open := d.conns[0], d.conns[1]
+	d.Unlock()
+	closed.Close()
+
+	conn, err := p.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go conn.Write([]byte("x"))
+	open.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := open.Read(make([]byte, 1)); err != nil {
+		t.Errorf("expected the open connection, but it wasn't written to: %s", err)
+	}
+	if stats := p.Stats(); stats.Hits != 1 {
+		t.Errorf("expected a hit, got %+v", stats)
+	}
+}
+
+func TestHandshakesSavedCountsConnectionsOnce(t *testing.T) {
+	// Two hits on warm connections, both of which resumed, and a miss
+	// which resumed too.
+	stats := PoolStats{Dials: 3, Resumed: 3, Hits: 2, Misses: 1, ResumedMisses: 1}
+	if saved := stats.HandshakesSaved(); saved != 3 {
+		t.Errorf("expected 3 handshakes saved, got %d", saved)
+	}
+}
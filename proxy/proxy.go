@@ -3,8 +3,9 @@ package proxy
 import (
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
-	"os"
+	"sync/atomic"
 )
 
 type Proxy struct {
@@ -13,6 +14,20 @@ type Proxy struct {
 	DialFunc     func() (net.Conn, error)
 
 	Listener *net.Listener
+
+	// Pool, if set, supplies warm upstream connections in place of DialFunc.
+	Pool *Pool
+
+	// Tap, if set, is shown everything forwarded in either direction.
+	Tap Tap
+
+	// Stderr is where problems forwarding connections are reported. New
+	// sets it to ioutil.Discard.
+	Stderr io.Writer
+
+	accepted int64
+	active   int64
+	stopped  int32
 }
 
 func New(listenFunc func() (net.Listener, error), dialFunc func() (net.Conn, error)) *Proxy {
@@ -21,7 +36,15 @@ func New(listenFunc func() (net.Listener, error), dialFunc func() (net.Conn, err
 	p.ErrorChannel = make(chan error)
 	p.ListenFunc = listenFunc
 	p.DialFunc = dialFunc
+	p.Stderr = ioutil.Discard
+
+	return p
+}
 
+// NewWithPool returns a proxy which takes its upstream connections from pool.
+func NewWithPool(listenFunc func() (net.Listener, error), pool *Pool) *Proxy {
+	p := New(listenFunc, pool.Get)
+	p.Pool = pool
 	return p
 }
 
@@ -35,9 +58,16 @@ func (p *Proxy) Start() {
 
 	p.ErrorChannel <- nil
 
+	if p.Pool != nil {
+		p.Pool.Fill()
+	}
+
 	for {
 		clientConn, err := listener.Accept()
 		if err != nil {
+			if atomic.LoadInt32(&p.stopped) == 1 {
+				return
+			}
 			panic(err)
 		}
 		go p.ForwardConnection(clientConn)
@@ -45,33 +75,85 @@ func (p *Proxy) Start() {
 }
 
 func (p *Proxy) Stop() {
-	if *p.Listener != nil {
+	atomic.StoreInt32(&p.stopped, 1)
+	if p.Listener != nil && *p.Listener != nil {
 		(*p.Listener).Close()
 	}
+	if p.Pool != nil {
+		p.Pool.Close()
+	}
+}
+
+// Accepted returns the number of connections accepted since the proxy started.
+func (p *Proxy) Accepted() int64 {
+	return atomic.LoadInt64(&p.accepted)
+}
+
+// Active returns the number of connections currently being forwarded.
+func (p *Proxy) Active() int64 {
+	return atomic.LoadInt64(&p.active)
+}
+
+// A Tap observes the traffic on each forwarded connection. Connections are
+// identified by the order they were accepted in, starting at 1. Calls for a
+// single connection may come from two goroutines at once.
+type Tap interface {
+	Open(id int64)
+	Data(id int64, fromClient bool, data []byte)
+	Close(id int64)
 }
 
 func (p *Proxy) ForwardConnection(clientConn net.Conn) {
+	id := atomic.AddInt64(&p.accepted, 1)
+	atomic.AddInt64(&p.active, 1)
+	defer atomic.AddInt64(&p.active, -1)
+
 	defer clientConn.Close()
 	serverConn, err := p.DialFunc()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "error connecting upstream: %s\n", err)
+		fmt.Fprintf(p.Stderr, "error connecting upstream: %s\n", err)
 		return
 	}
 	defer serverConn.Close()
+
+	var fromClient, fromServer net.Conn = clientConn, serverConn
+	if p.Tap != nil {
+		p.Tap.Open(id)
+		defer p.Tap.Close(id)
+		fromClient = &tappedConn{clientConn, p.Tap, id, true}
+		fromServer = &tappedConn{serverConn, p.Tap, id, false}
+	}
+
 	complete := make(chan bool)
-	go Copy(serverConn, clientConn, complete)
-	go Copy(clientConn, serverConn, complete)
+	go Copy(serverConn, fromClient, complete, p.Stderr)
+	go Copy(clientConn, fromServer, complete, p.Stderr)
 	<-complete
 	<-complete
 }
 
-func Copy(to net.Conn, from net.Conn, complete chan bool) {
+// tappedConn passes everything read from it to a Tap.
+type tappedConn struct {
+	net.Conn
+	tap        Tap
+	id         int64
+	fromClient bool
+}
+
+func (c *tappedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.tap.Data(c.id, c.fromClient, b[:n])
+	}
+	return n, err
+}
+
+func Copy(to net.Conn, from net.Conn, complete chan bool, stderr io.Writer) {
 	io.Copy(to, from)
-	CloseWrite(to)
+	CloseWrite(to, stderr)
 	complete <- true
 }
 
-func CloseWrite(conn net.Conn) {
+func CloseWrite(conn net.Conn, stderr io.Writer) {
 	cwConn, ok := conn.(interface {
 		CloseWrite() error
 	})
@@ -79,6 +161,6 @@ func CloseWrite(conn net.Conn) {
 	if ok {
 		cwConn.CloseWrite()
 	} else {
-		fmt.Fprintf(os.Stderr, "Connection doesn't implement CloseWrite()\n")
+		fmt.Fprintf(stderr, "Connection doesn't implement CloseWrite()\n")
 	}
 }
@@ -0,0 +1,193 @@
+package tlsconfig
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"github.com/bbbacsa/deploy.io/utils"
+	"github.com/bbbacsa/deploy.io/vendor/crypto/tls"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+)
+
+// CertStore keeps client certificates for keys that were generated on this
+// machine by 'deploy hosts certs request', so that unlike Host.ClientKey,
+// the server never sees them.
+//
+// Each host has one file, ID.pem, holding the certificate the API signed
+// followed by the private key, so that both are replaced at once. The
+// directory is created 0700, files are written 0600, and files readable by
+// anyone else are ignored. Pairs of ID.crt and ID.key, which the store used
+// to keep, are moved into ID.pem the first time they're loaded.
+type CertStore struct {
+	Dir string
+
+	// Stderr is where the store warns about files it ignores.
+	Stderr io.Writer
+}
+
+// GetCertDir returns the directory client certificates are stored in.
+func GetCertDir() string {
+	return path.Join(os.Getenv("HOME"), ".deploy", "certs")
+}
+
+func NewCertStore(dir string, stderr io.Writer) *CertStore {
+	return &CertStore{Dir: dir, Stderr: stderr}
+}
+
+// Load returns the PEM encoded certificate and key stored for a host, if
+// there are any.
+func (s *CertStore) Load(hostID string) (certPEMData, keyPEMData []byte, ok bool, err error) {
+	filename := s.path(hostID, ".pem")
+
+	info, err := os.Stat(filename)
+	if os.IsNotExist(err) {
+		return s.loadOld(hostID)
+	}
+	if err != nil {
+		return nil, nil, false, err
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		fmt.Fprintf(s.Stderr, "Warning: ignoring client certificate %s, which is accessible by other users\n", filename)
+		return nil, nil, false, nil
+	}
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type == "CERTIFICATE" {
+			certPEMData = append(certPEMData, pem.EncodeToMemory(block)...)
+		} else {
+			keyPEMData = append(keyPEMData, pem.EncodeToMemory(block)...)
+		}
+	}
+	if certPEMData == nil || keyPEMData == nil {
+		return nil, nil, false, fmt.Errorf("%s should contain a client certificate and its key", filename)
+	}
+	return certPEMData, keyPEMData, true, nil
+}
+
+// loadOld loads a certificate and key from the separate ID.crt and ID.key
+// files the store used to keep, and moves them into ID.pem. The two files
+// weren't replaced at once, so a certificate that doesn't match its key is
+// ignored.
+func (s *CertStore) loadOld(hostID string) (certPEMData, keyPEMData []byte, ok bool, err error) {
+	certPath, keyPath := s.path(hostID, ".crt"), s.path(hostID, ".key")
+
+	info, err := os.Stat(keyPath)
+	if os.IsNotExist(err) {
+		return nil, nil, false, nil
+	}
+	if err != nil {
+		return nil, nil, false, err
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		fmt.Fprintf(s.Stderr, "Warning: ignoring client key %s, which is accessible by other users\n", keyPath)
+		return nil, nil, false, nil
+	}
+
+	keyPEMData, err = ioutil.ReadFile(keyPath)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	certPEMData, err = ioutil.ReadFile(certPath)
+	if os.IsNotExist(err) {
+		return nil, nil, false, nil
+	}
+	if err != nil {
+		return nil, nil, false, err
+	}
+	if _, err := tls.X509KeyPair(certPEMData, keyPEMData); err != nil {
+		fmt.Fprintf(s.Stderr, "Warning: ignoring client certificate %s, which doesn't match its key\n", certPath)
+		return nil, nil, false, nil
+	}
+
+	if err := utils.WriteFileAtomic(s.path(hostID, ".pem"), append(append([]byte{}, certPEMData...), keyPEMData...), 0600); err != nil {
+		return nil, nil, false, err
+	}
+	if err := s.removeOld(hostID); err != nil {
+		return nil, nil, false, err
+	}
+	return certPEMData, keyPEMData, true, nil
+}
+
+// Save stores a host's certificate and key, replacing any that were there.
+// It's an error for the certificate not to match the key.
+func (s *CertStore) Save(hostID string, certPEMData, keyPEMData []byte) error {
+	if _, err := tls.X509KeyPair(certPEMData, keyPEMData); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.Dir, 0700); err != nil {
+		return err
+	}
+	if err := utils.WriteFileAtomic(s.path(hostID, ".pem"), append(append([]byte{}, certPEMData...), keyPEMData...), 0600); err != nil {
+		return err
+	}
+	return s.removeOld(hostID)
+}
+
+// Remove deletes a host's certificate and key, if there are any.
+func (s *CertStore) Remove(hostID string) error {
+	if err := os.Remove(s.path(hostID, ".pem")); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return s.removeOld(hostID)
+}
+
+// removeOld deletes a host's ID.crt and ID.key, if there are any.
+func (s *CertStore) removeOld(hostID string) error {
+	for _, filename := range []string{s.path(hostID, ".crt"), s.path(hostID, ".key")} {
+		if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// path returns the name of a host's file with the given extension. IDs come
+// from the API, so only their last element is used, to keep them in s.Dir.
+func (s *CertStore) path(hostID, ext string) string {
+	return path.Join(s.Dir, path.Base(hostID)+ext)
+}
+
+// GenerateKey generates a P-256 client key, returning it along with its PEM
+// encoded PKCS#8 form.
+func GenerateKey() (crypto.Signer, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// CreateCertificateRequest returns a PEM encoded certificate request for
+// key. The API decides what the certificate actually says, so the subject is
+// only a hint.
+func CreateCertificateRequest(key crypto.Signer, commonName string) ([]byte, error) {
+	template := &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: commonName},
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, template, key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}), nil
+}
@@ -0,0 +1,185 @@
+package tlsconfig
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"github.com/bbbacsa/deploy.io/dockertest"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+// signTestRequest plays the part of the API, signing a certificate request
+// with a throwaway CA.
+func signTestRequest(t *testing.T, csrPEMData []byte) []byte {
+	block, _ := pem.Decode(csrPEMData)
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		t.Fatalf("expected a PEM encoded certificate request, got %q", csrPEMData)
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := csr.CheckSignature(); err != nil {
+		t.Fatal(err)
+	}
+
+	ca, err := dockertest.NewCA("Test CA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := ca.SignClient(csr.Subject.CommonName, csr.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+}
+
+func TestCertStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deploy-certs-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certStore := NewCertStore(path.Join(dir, "certs"), ioutil.Discard)
+
+	if _, _, ok, err := certStore.Load("host-id"); ok || err != nil {
+		t.Fatalf("expected nothing to be stored, got %v, %v", ok, err)
+	}
+
+	key, keyPEMData, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	csrPEMData, err := CreateCertificateRequest(key, "myhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEMData := signTestRequest(t, csrPEMData)
+
+	if err := certStore.Save("host-id", certPEMData, keyPEMData); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path.Join(certStore.Dir, "host-id.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("expected mode 0600, got %o", info.Mode().Perm())
+	}
+
+	loadedCert, loadedKey, ok, err := certStore.Load("host-id")
+	if !ok || err != nil {
+		t.Fatalf("expected the certificate to be stored, got %v, %v", ok, err)
+	}
+	if _, err := LoadKeyPair(loadedCert, loadedKey, ioutil.Discard, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := certStore.Remove("host-id"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, ok, _ := certStore.Load("host-id"); ok {
+		t.Error("expected the certificate to be removed")
+	}
+}
+
+func TestCertStoreKeepsFilesInDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deploy-certs-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certStore := NewCertStore(path.Join(dir, "certs"), ioutil.Discard)
+
+	key, keyPEMData, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	csrPEMData, err := CreateCertificateRequest(key, "myhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEMData := signTestRequest(t, csrPEMData)
+
+	if err := certStore.Save("../host-id", certPEMData, keyPEMData); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path.Join(dir, "host-id.pem")); !os.IsNotExist(err) {
+		t.Errorf("expected nothing to be written outside the store, got %v", err)
+	}
+	if _, err := os.Stat(path.Join(certStore.Dir, "host-id.pem")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCertStoreRejectsMismatchedKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deploy-certs-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certStore := NewCertStore(dir, ioutil.Discard)
+
+	key, _, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	csrPEMData, err := CreateCertificateRequest(key, "myhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, otherKeyPEMData, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := certStore.Save("host-id", signTestRequest(t, csrPEMData), otherKeyPEMData); err == nil {
+		t.Error("expected a certificate for another key to be refused")
+	}
+	if _, _, ok, _ := certStore.Load("host-id"); ok {
+		t.Error("expected nothing to be stored")
+	}
+}
+
+func TestCertStoreMovesOldFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deploy-certs-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certStore := NewCertStore(dir, ioutil.Discard)
+
+	key, keyPEMData, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	csrPEMData, err := CreateCertificateRequest(key, "myhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEMData := signTestRequest(t, csrPEMData)
+	if err := ioutil.WriteFile(path.Join(dir, "host-id.crt"), certPEMData, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(dir, "host-id.key"), keyPEMData, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	loadedCert, loadedKey, ok, err := certStore.Load("host-id")
+	if !ok || err != nil {
+		t.Fatalf("expected the old files to be loaded, got %v, %v", ok, err)
+	}
+	if string(loadedCert) != string(certPEMData) || string(loadedKey) != string(keyPEMData) {
+		t.Error("expected the old certificate and key")
+	}
+	for _, name := range []string{"host-id.crt", "host-id.key"} {
+		if _, err := os.Stat(path.Join(dir, name)); !os.IsNotExist(err) {
+			t.Errorf("expected %s to be removed, got %v", name, err)
+		}
+	}
+	if _, _, ok, err := certStore.Load("host-id"); !ok || err != nil {
+		t.Errorf("expected the certificate to have moved to host-id.pem, got %v, %v", ok, err)
+	}
+}
@@ -0,0 +1,108 @@
+package tlsconfig
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"github.com/bbbacsa/deploy.io/trust"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ExpiryWarningWindow is how long before a certificate expires we start
+// warning about it. DEPLOY_CERT_WARNING_DAYS overrides it.
+var ExpiryWarningWindow = 30 * 24 * time.Hour
+
+// GetExpiryWarningWindow returns ExpiryWarningWindow, or the number of days
+// in DEPLOY_CERT_WARNING_DAYS if it's set. It warns on stderr if that isn't
+// a number of days.
+func GetExpiryWarningWindow(stderr io.Writer) time.Duration {
+	days := os.Getenv("DEPLOY_CERT_WARNING_DAYS")
+	if days == "" {
+		return ExpiryWarningWindow
+	}
+	n, err := strconv.Atoi(days)
+	if err != nil || n < 0 {
+		fmt.Fprintf(stderr, "Warning: ignoring DEPLOY_CERT_WARNING_DAYS=%q, which isn't a number of days\n", days)
+		return ExpiryWarningWindow
+	}
+	return time.Duration(n) * 24 * time.Hour
+}
+
+// ExpiryWarning returns a warning about cert if it has expired, or expires
+// within window of now, and "" if it doesn't. description says which
+// certificate it is, e.g. "the client certificate for host 'web'".
+func ExpiryWarning(cert *x509.Certificate, description string, now time.Time, window time.Duration) string {
+	notAfter := cert.NotAfter.UTC().Format("2006-01-02")
+	if now.After(cert.NotAfter) {
+		return fmt.Sprintf("Warning: %s expired on %s", description, notAfter)
+	}
+
+	left := cert.NotAfter.Sub(now)
+	if left > window {
+		return ""
+	}
+	days := int(left.Hours() / 24)
+	switch days {
+	case 0:
+		return fmt.Sprintf("Warning: %s expires today (%s)", description, notAfter)
+	case 1:
+		return fmt.Sprintf("Warning: %s expires tomorrow (%s)", description, notAfter)
+	}
+	return fmt.Sprintf("Warning: %s expires in %d days (%s)", description, days, notAfter)
+}
+
+// warnBuiltIn makes sure the built in CA is warned about once per process.
+var warnBuiltIn sync.Once
+
+// warnExpiring warns about the CA certificates in bundle and the client
+// certificate in clientCertPEMData that expire soon, on stderr.
+func warnExpiring(stderr io.Writer, bundle *trust.Bundle, clientCertPEMData []byte, hostName string) {
+	now := time.Now()
+	window := GetExpiryWarningWindow(stderr)
+
+	for _, entry := range bundle.Entries {
+		description := fmt.Sprintf("the CA certificate %q (%s)", entry.Cert.Subject.CommonName, entry.Source)
+		warning := ExpiryWarning(entry.Cert, description, now, window)
+		if warning == "" {
+			continue
+		}
+		warn := func() {
+			fmt.Fprintf(stderr, "%s.\nYou can add a current one to %s.\n", warning, trust.GetCADir())
+		}
+		// The built in CA is in every bundle, so say so only once, rather
+		// than for every host.
+		if entry.BuiltIn() {
+			warnBuiltIn.Do(warn)
+		} else {
+			warn()
+		}
+	}
+
+	if certs := parseCertificates(clientCertPEMData); len(certs) > 0 {
+		if warning := ExpiryWarning(certs[0], fmt.Sprintf("the client certificate for host '%s'", hostName), now, window); warning != "" {
+			fmt.Fprintf(stderr, "%s.\nYou can get a new one with `deploy hosts certs rotate %s`.\n", warning, hostName)
+		}
+	}
+}
+
+// parseCertificates returns the certificates in PEM data, skipping anything
+// that doesn't parse.
+func parseCertificates(pemData []byte) (certs []*x509.Certificate) {
+	for {
+		var block *pem.Block
+		block, pemData = pem.Decode(pemData)
+		if block == nil {
+			return
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		if cert, err := x509.ParseCertificate(block.Bytes); err == nil {
+			certs = append(certs, cert)
+		}
+	}
+}
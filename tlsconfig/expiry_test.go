@@ -0,0 +1,93 @@
+package tlsconfig
+
+import (
+	"bytes"
+	"crypto/x509"
+	"github.com/bbbacsa/deploy.io/dockertest"
+	"github.com/bbbacsa/deploy.io/trust"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestExpiryWarning(t *testing.T) {
+	now := time.Date(2015, 11, 1, 12, 0, 0, 0, time.UTC)
+	window := 30 * 24 * time.Hour
+
+	tests := []struct {
+		notAfter time.Time
+		expected string
+	}{
+		{now.Add(60 * 24 * time.Hour), ""},
+		{now.Add(31 * 24 * time.Hour), ""},
+		{now.Add(12*24*time.Hour + time.Hour), "expires in 12 days (2015-11-13)"},
+		{now.Add(30 * time.Hour), "expires tomorrow (2015-11-02)"},
+		{now.Add(time.Hour), "expires today (2015-11-01)"},
+		{now.Add(-24 * time.Hour), "expired on 2015-10-31"},
+	}
+
+	for _, test := range tests {
+		cert := &x509.Certificate{NotAfter: test.notAfter}
+		warning := ExpiryWarning(cert, "the test certificate", now, window)
+		if test.expected == "" {
+			if warning != "" {
+				t.Errorf("%s: expected no warning, got %q", test.notAfter, warning)
+			}
+			continue
+		}
+		if !strings.HasSuffix(warning, "the test certificate "+test.expected) {
+			t.Errorf("%s: expected a warning ending %q, got %q", test.notAfter, test.expected, warning)
+		}
+	}
+}
+
+func TestGetExpiryWarningWindow(t *testing.T) {
+	t.Setenv("DEPLOY_CERT_WARNING_DAYS", "")
+	if window := GetExpiryWarningWindow(ioutil.Discard); window != ExpiryWarningWindow {
+		t.Errorf("expected the default window, got %s", window)
+	}
+
+	t.Setenv("DEPLOY_CERT_WARNING_DAYS", "7")
+	if window := GetExpiryWarningWindow(ioutil.Discard); window != 7*24*time.Hour {
+		t.Errorf("expected 7 days, got %s", window)
+	}
+}
+
+func TestWarnExpiringBuiltInWithExtraCA(t *testing.T) {
+	home, err := ioutil.TempDir("", "deploy-expiry-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+	t.Setenv("HOME", home)
+	t.Setenv("DEPLOY_HOST_CA", "")
+	t.Setenv("DEPLOY_CA_BUNDLE", "")
+	t.Setenv("DEPLOY_CERT_WARNING_DAYS", "")
+
+	bundle, err := trust.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := dockertest.NewCA("Extra CA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bundle.AddPEM(ca.PEM, "extra"); err != nil {
+		t.Fatal(err)
+	}
+
+	warnBuiltIn = sync.Once{}
+	var stderr bytes.Buffer
+	warnExpiring(&stderr, bundle, nil, "web")
+	warnExpiring(&stderr, bundle, nil, "db")
+
+	if n := strings.Count(stderr.String(), "(built in)"); n != 1 {
+		t.Errorf("expected one warning about the built in CA, got %q", stderr.String())
+	}
+	if strings.Contains(stderr.String(), "Extra CA") {
+		t.Errorf("expected no warning about the extra CA, got %q", stderr.String())
+	}
+}
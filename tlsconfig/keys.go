@@ -0,0 +1,341 @@
+package tlsconfig
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/bbbacsa/deploy.io/vendor/crypto/tls"
+	"github.com/bbbacsa/deploy.io/vendor/golang.org/x/crypto/pbkdf2"
+	"hash"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+)
+
+// ErrIncorrectPassphrase is returned when an encrypted client key can't be
+// decrypted with the passphrase we were given.
+var ErrIncorrectPassphrase = errors.New("Incorrect passphrase for the client key")
+
+// PassphraseAttempts is how many times the user is asked for the passphrase
+// of an encrypted client key before giving up.
+var PassphraseAttempts = 3
+
+// Keys loads client key pairs, asking Prompt for the passphrase of any that
+// are encrypted. It remembers the passphrases that worked, so that the same
+// key, or another with the same passphrase, doesn't need asking for again.
+// It's safe to use from several goroutines, which take turns to prompt.
+type Keys struct {
+	Prompt func() ([]byte, error)
+
+	// Stderr is where the user is told that a passphrase was wrong.
+	Stderr io.Writer
+
+	mu          sync.Mutex
+	passphrases [][]byte
+}
+
+// LoadKeyPair is like the LoadKeyPair function, but tries the passphrases
+// that have worked before asking for another.
+func (k *Keys) LoadKeyPair(certPEMData, keyPEMData []byte) (tls.Certificate, error) {
+	block := findKeyBlock(keyPEMData)
+	if block == nil || !isEncrypted(block) {
+		return tls.X509KeyPair(certPEMData, keyPEMData)
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	for _, passphrase := range k.passphrases {
+		if decrypted, err := decryptKey(block, passphrase); err == nil {
+			return tls.X509KeyPair(certPEMData, pem.EncodeToMemory(decrypted))
+		}
+	}
+
+	var last []byte
+	stderr := k.Stderr
+	if stderr == nil {
+		stderr = ioutil.Discard
+	}
+	cert, err := LoadKeyPair(certPEMData, keyPEMData, stderr, func() ([]byte, error) {
+		if k.Prompt == nil {
+			return nil, errors.New("The client key is encrypted, and there's nobody to ask for its passphrase")
+		}
+		passphrase, err := k.Prompt()
+		last = passphrase
+		return passphrase, err
+	})
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	k.passphrases = append(k.passphrases, last)
+	return cert, nil
+}
+
+// Passphrases returns the passphrases that have worked so far.
+func (k *Keys) Passphrases() [][]byte {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return append([][]byte{}, k.passphrases...)
+}
+
+// LoadKeyPair parses a PEM encoded client certificate and private key. The
+// key may be PKCS#1, PKCS#8 or SEC1, and if it's encrypted, either the
+// OpenSSL way ("Proc-Type: 4,ENCRYPTED") or as an encrypted PKCS#8 key,
+// passphrase is called for the passphrase to decrypt it with. Wrong
+// passphrases are reported on stderr before asking again.
+func LoadKeyPair(certPEMData, keyPEMData []byte, stderr io.Writer, passphrase func() ([]byte, error)) (tls.Certificate, error) {
+	block := findKeyBlock(keyPEMData)
+	if block == nil || !isEncrypted(block) {
+		return tls.X509KeyPair(certPEMData, keyPEMData)
+	}
+
+	for attempt := 0; ; attempt++ {
+		password, err := passphrase()
+		if err != nil {
+			return tls.Certificate{}, err
+		}
+
+		decrypted, err := decryptKey(block, password)
+		if err == ErrIncorrectPassphrase && attempt+1 < PassphraseAttempts {
+			fmt.Fprintln(stderr, "Incorrect passphrase, please try again.")
+			continue
+		}
+		if err != nil {
+			return tls.Certificate{}, err
+		}
+		return tls.X509KeyPair(certPEMData, pem.EncodeToMemory(decrypted))
+	}
+}
+
+// findKeyBlock returns the private key in keyPEMData, skipping anything
+// before it, like the EC PARAMETERS 'openssl ecparam' writes.
+func findKeyBlock(keyPEMData []byte) *pem.Block {
+	for {
+		block, rest := pem.Decode(keyPEMData)
+		if block == nil {
+			return nil
+		}
+		if block.Type == "PRIVATE KEY" || strings.HasSuffix(block.Type, " PRIVATE KEY") {
+			return block
+		}
+		keyPEMData = rest
+	}
+}
+
+func isEncrypted(block *pem.Block) bool {
+	return block.Type == "ENCRYPTED PRIVATE KEY" || block.Headers["Proc-Type"] == "4,ENCRYPTED"
+}
+
+// decryptKey returns the unencrypted form of an encrypted key block.
+func decryptKey(block *pem.Block, password []byte) (*pem.Block, error) {
+	if block.Type == "ENCRYPTED PRIVATE KEY" {
+		der, err := decryptPKCS8(block.Bytes, password)
+		if err != nil {
+			return nil, err
+		}
+		return &pem.Block{Type: "PRIVATE KEY", Bytes: der}, nil
+	}
+
+	der, err := decryptPEM(block, password)
+	if err != nil {
+		return nil, err
+	}
+	return &pem.Block{Type: block.Type, Bytes: der}, nil
+}
+
+// The ciphers OpenSSL encrypts traditional PEM keys with, by their name in
+// the DEK-Info header.
+var pemCiphers = map[string]struct {
+	keyLen   int
+	newBlock func([]byte) (cipher.Block, error)
+}{
+	"DES-CBC":      {8, des.NewCipher},
+	"DES-EDE3-CBC": {24, des.NewTripleDESCipher},
+	"AES-128-CBC":  {16, aes.NewCipher},
+	"AES-192-CBC":  {24, aes.NewCipher},
+	"AES-256-CBC":  {32, aes.NewCipher},
+}
+
+// decryptPEM decrypts a key encrypted the way 'openssl rsa -aes128' and
+// 'openssl ec -aes128' do, with the key derived from the passphrase by
+// OpenSSL's EVP_BytesToKey.
+func decryptPEM(block *pem.Block, password []byte) ([]byte, error) {
+	dekInfo := strings.SplitN(block.Headers["DEK-Info"], ",", 2)
+	if len(dekInfo) != 2 {
+		return nil, errors.New("Malformed encrypted private key")
+	}
+	params, ok := pemCiphers[dekInfo[0]]
+	if !ok {
+		return nil, fmt.Errorf("Unsupported private key encryption: %s", dekInfo[0])
+	}
+	iv, err := hex.DecodeString(dekInfo[1])
+	if err != nil || len(iv) < 8 {
+		return nil, errors.New("Malformed encrypted private key")
+	}
+
+	// The salt is the first 8 bytes of the IV.
+	var key, digest []byte
+	for len(key) < params.keyLen {
+		h := md5.New()
+		h.Write(digest)
+		h.Write(password)
+		h.Write(iv[:8])
+		digest = h.Sum(nil)
+		key = append(key, digest...)
+	}
+	c, err := params.newBlock(key[:params.keyLen])
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := decryptCBC(c, iv, block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := x509.ParsePKCS1PrivateKey(plaintext); err == nil {
+		return plaintext, nil
+	}
+	if _, err := x509.ParseECPrivateKey(plaintext); err == nil {
+		return plaintext, nil
+	}
+	return nil, ErrIncorrectPassphrase
+}
+
+// decryptCBC decrypts data with block in CBC mode and removes its PKCS#7
+// padding.
+func decryptCBC(block cipher.Block, iv, data []byte) ([]byte, error) {
+	if len(iv) != block.BlockSize() || len(data) == 0 || len(data)%block.BlockSize() != 0 {
+		return nil, errors.New("Malformed encrypted private key")
+	}
+
+	plaintext := make([]byte, len(data))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plaintext, data)
+
+	// A wrong passphrase almost always leaves bad padding, and otherwise
+	// garbage that won't parse as a key.
+	padding := int(plaintext[len(plaintext)-1])
+	if padding == 0 || padding > block.BlockSize() {
+		return nil, ErrIncorrectPassphrase
+	}
+	for _, b := range plaintext[len(plaintext)-padding:] {
+		if int(b) != padding {
+			return nil, ErrIncorrectPassphrase
+		}
+	}
+	return plaintext[:len(plaintext)-padding], nil
+}
+
+// RFC 8018, appendix A and B.
+var (
+	oidPBES2          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidHMACWithSHA1   = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHMACWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidHMACWithSHA512 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 11}
+	oidDESEDE3CBC     = asn1.ObjectIdentifier{1, 2, 840, 113549, 3, 7}
+	oidAES128CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAES256CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+)
+
+type encryptedPrivateKeyInfo struct {
+	Algorithm     pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+type pbes2Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+type pbkdf2Params struct {
+	Salt           []byte
+	IterationCount int
+	KeyLength      int                      `asn1:"optional"`
+	PRF            pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+// decryptPKCS8 decrypts an EncryptedPrivateKeyInfo, as written by
+// 'openssl pkcs8 -topk8' and 'openssl genpkey' with a cipher. Only PBES2
+// with PBKDF2 is supported, which is what OpenSSL has used by default since
+// 1.1.0.
+func decryptPKCS8(der, password []byte) ([]byte, error) {
+	var info encryptedPrivateKeyInfo
+	if rest, err := asn1.Unmarshal(der, &info); err != nil || len(rest) > 0 {
+		return nil, errors.New("Malformed encrypted private key")
+	}
+	if !info.Algorithm.Algorithm.Equal(oidPBES2) {
+		return nil, fmt.Errorf("Unsupported private key encryption: %s", info.Algorithm.Algorithm)
+	}
+
+	var params pbes2Params
+	if _, err := asn1.Unmarshal(info.Algorithm.Parameters.FullBytes, &params); err != nil {
+		return nil, errors.New("Malformed encrypted private key")
+	}
+	if !params.KeyDerivationFunc.Algorithm.Equal(oidPBKDF2) {
+		return nil, fmt.Errorf("Unsupported private key derivation: %s", params.KeyDerivationFunc.Algorithm)
+	}
+	var kdfParams pbkdf2Params
+	if _, err := asn1.Unmarshal(params.KeyDerivationFunc.Parameters.FullBytes, &kdfParams); err != nil {
+		return nil, errors.New("Malformed encrypted private key")
+	}
+
+	var prf func() hash.Hash
+	switch {
+	case len(kdfParams.PRF.Algorithm) == 0, kdfParams.PRF.Algorithm.Equal(oidHMACWithSHA1):
+		prf = sha1.New
+	case kdfParams.PRF.Algorithm.Equal(oidHMACWithSHA256):
+		prf = sha256.New
+	case kdfParams.PRF.Algorithm.Equal(oidHMACWithSHA512):
+		prf = sha512.New
+	default:
+		return nil, fmt.Errorf("Unsupported private key derivation: %s", kdfParams.PRF.Algorithm)
+	}
+
+	var (
+		keyLen   int
+		newBlock func([]byte) (cipher.Block, error)
+	)
+	switch scheme := params.EncryptionScheme.Algorithm; {
+	case scheme.Equal(oidAES128CBC):
+		keyLen, newBlock = 16, aes.NewCipher
+	case scheme.Equal(oidAES192CBC):
+		keyLen, newBlock = 24, aes.NewCipher
+	case scheme.Equal(oidAES256CBC):
+		keyLen, newBlock = 32, aes.NewCipher
+	case scheme.Equal(oidDESEDE3CBC):
+		keyLen, newBlock = 24, des.NewTripleDESCipher
+	default:
+		return nil, fmt.Errorf("Unsupported private key encryption: %s", scheme)
+	}
+	var iv []byte
+	if _, err := asn1.Unmarshal(params.EncryptionScheme.Parameters.FullBytes, &iv); err != nil {
+		return nil, errors.New("Malformed encrypted private key")
+	}
+
+	key := pbkdf2.Key(password, kdfParams.Salt, kdfParams.IterationCount, keyLen, prf)
+	block, err := newBlock(key)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := decryptCBC(block, iv, info.EncryptedData)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := x509.ParsePKCS8PrivateKey(plaintext); err != nil {
+		return nil, ErrIncorrectPassphrase
+	}
+	return plaintext, nil
+}
@@ -0,0 +1,238 @@
+package tlsconfig
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/bbbacsa/deploy.io/utils"
+	"github.com/bbbacsa/deploy.io/vendor/crypto/tls"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// KnownHosts pins the certificate each host presents, SSH style: the first
+// time we connect to a host its certificate's fingerprint is recorded, and
+// from then on a host presenting a different certificate is refused until
+// the user accepts the change.
+//
+// The file has one host per line, followed by its fingerprint:
+//
+//	104.131.158.124:2376 SHA256:Yq3Fh2d0...
+//
+// Blank lines and lines starting with '#' are ignored. Changes are made
+// under a lock, known_hosts.lock, so that commands changing the file at the
+// same time don't lose each other's changes.
+type KnownHosts struct {
+	Path string
+
+	// Added, if not nil, is told about every host that's pinned on first
+	// use.
+	Added func(host, fingerprint string)
+}
+
+// knownHostsMu serializes changes to the file within the process, where
+// proxies and fan-out workers each have their own KnownHosts. flock only
+// keeps other processes out.
+var knownHostsMu sync.Mutex
+
+// GetKnownHostsPath returns the path of the known hosts file.
+func GetKnownHostsPath() string {
+	return path.Join(os.Getenv("HOME"), ".deploy", "known_hosts")
+}
+
+func NewKnownHosts(filename string) *KnownHosts {
+	return &KnownHosts{Path: filename}
+}
+
+// Fingerprint returns the fingerprint of a DER encoded certificate, in the
+// same format 'ssh-keygen -l' uses for keys.
+func Fingerprint(cert []byte) string {
+	sum := sha256.Sum256(cert)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+// HostChangedError is returned when a host presents a certificate other than
+// the one it was pinned to.
+type HostChangedError struct {
+	Host  string
+	Known string
+	Got   string
+}
+
+func (e *HostChangedError) Error() string {
+	return fmt.Sprintf("The certificate of %s has changed!\n"+
+		"It's possible that someone is intercepting your connection, or the host was replaced.\n"+
+		"Expected fingerprint %s, but the host presented %s.", e.Host, e.Known, e.Got)
+}
+
+// Lookup returns the fingerprint host is pinned to, if any.
+func (k *KnownHosts) Lookup(host string) (string, bool, error) {
+	entries, err := k.read()
+	if err != nil {
+		return "", false, err
+	}
+	for _, entry := range entries {
+		if entry[0] == host {
+			return entry[1], true, nil
+		}
+	}
+	return "", false, nil
+}
+
+// Set pins host to fingerprint, replacing any fingerprint it had.
+func (k *KnownHosts) Set(host, fingerprint string) error {
+	unlock, err := k.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return k.update(host, fingerprint)
+}
+
+// Remove forgets host's fingerprint.
+func (k *KnownHosts) Remove(host string) error {
+	unlock, err := k.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return k.update(host, "")
+}
+
+// Verify checks the leaf certificate of rawCerts against the one host is
+// pinned to, pinning it if host hasn't been seen before.
+func (k *KnownHosts) Verify(host string, rawCerts [][]byte) error {
+	if len(rawCerts) == 0 {
+		return errors.New("The host didn't present a certificate")
+	}
+	fingerprint := Fingerprint(rawCerts[0])
+
+	// A proxy dials several connections at once, and only the first should
+	// pin the host.
+	unlock, err := k.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	known, ok, err := k.Lookup(host)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		if err := k.update(host, fingerprint); err != nil {
+			return err
+		}
+		if k.Added != nil {
+			k.Added(host, fingerprint)
+		}
+		return nil
+	}
+	if known != fingerprint {
+		return &HostChangedError{Host: host, Known: known, Got: fingerprint}
+	}
+	return nil
+}
+
+// Pin makes config verify host's certificate against the known hosts, on top
+// of whatever verification config already does.
+func (k *KnownHosts) Pin(config *tls.Config, host string) {
+	config.VerifyPeerCertificate = func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		return k.Verify(host, rawCerts)
+	}
+}
+
+// lock holds the file for changing until the function it returns is called.
+func (k *KnownHosts) lock() (func(), error) {
+	knownHostsMu.Lock()
+
+	if err := os.MkdirAll(path.Dir(k.Path), 0700); err != nil {
+		knownHostsMu.Unlock()
+		return nil, err
+	}
+	f, err := os.OpenFile(k.Path+".lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		knownHostsMu.Unlock()
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		knownHostsMu.Unlock()
+		return nil, err
+	}
+
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+		knownHostsMu.Unlock()
+	}, nil
+}
+
+func (k *KnownHosts) read() ([][2]string, error) {
+	f, err := os.Open(k.Path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseKnownHosts(f)
+}
+
+func parseKnownHosts(r io.Reader) ([][2]string, error) {
+	entries := [][2]string{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("Malformed line in known hosts file: %q", line)
+		}
+		entries = append(entries, [2]string{fields[0], fields[1]})
+	}
+	return entries, scanner.Err()
+}
+
+// update rewrites the file with host's fingerprint replaced, or removed if
+// fingerprint is empty. Comments are kept. It has to be called under lock.
+func (k *KnownHosts) update(host, fingerprint string) error {
+	data, err := ioutil.ReadFile(k.Path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	var buf bytes.Buffer
+	for _, line := range strings.SplitAfter(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 0 && fields[0] == host {
+			continue
+		}
+		buf.WriteString(line)
+	}
+	if buf.Len() > 0 && !bytes.HasSuffix(buf.Bytes(), []byte("\n")) {
+		buf.WriteString("\n")
+	}
+	if fingerprint != "" {
+		fmt.Fprintf(&buf, "%s %s\n", host, fingerprint)
+	}
+
+	dir := path.Dir(k.Path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	return utils.WriteFileAtomic(k.Path, buf.Bytes(), 0600)
+}
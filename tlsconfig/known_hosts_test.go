@@ -0,0 +1,134 @@
+package tlsconfig
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func newTestKnownHosts(t *testing.T) *KnownHosts {
+	dir, err := ioutil.TempDir("", "deploy-known-hosts-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewKnownHosts(path.Join(dir, "deploy", "known_hosts"))
+}
+
+func TestKnownHostsTrustOnFirstUse(t *testing.T) {
+	knownHosts := newTestKnownHosts(t)
+	defer os.RemoveAll(path.Dir(path.Dir(knownHosts.Path)))
+
+	var added []string
+	knownHosts.Added = func(host, fingerprint string) {
+		added = append(added, host)
+	}
+
+	first := [][]byte{[]byte("first certificate")}
+	if err := knownHosts.Verify("1.2.3.4:2376", first); err != nil {
+		t.Fatal(err)
+	}
+	if err := knownHosts.Verify("1.2.3.4:2376", first); err != nil {
+		t.Fatal(err)
+	}
+	if len(added) != 1 {
+		t.Errorf("expected the host to be added once, got %d", len(added))
+	}
+
+	err := knownHosts.Verify("1.2.3.4:2376", [][]byte{[]byte("second certificate")})
+	changed, ok := err.(*HostChangedError)
+	if !ok {
+		t.Fatalf("expected a HostChangedError, got %v", err)
+	}
+	if changed.Known != Fingerprint(first[0]) {
+		t.Errorf("expected the known fingerprint %s, got %s", Fingerprint(first[0]), changed.Known)
+	}
+
+	info, err := os.Stat(knownHosts.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("expected mode 0600, got %o", info.Mode().Perm())
+	}
+}
+
+func TestKnownHostsSetAndRemove(t *testing.T) {
+	knownHosts := newTestKnownHosts(t)
+	defer os.RemoveAll(path.Dir(path.Dir(knownHosts.Path)))
+
+	os.MkdirAll(path.Dir(knownHosts.Path), 0700)
+	contents := "# Managed by deploy\n1.2.3.4:2376 SHA256:old\n5.6.7.8:2376 SHA256:other\n"
+	if err := ioutil.WriteFile(knownHosts.Path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := knownHosts.Set("1.2.3.4:2376", "SHA256:new"); err != nil {
+		t.Fatal(err)
+	}
+	if fingerprint, _, _ := knownHosts.Lookup("1.2.3.4:2376"); fingerprint != "SHA256:new" {
+		t.Errorf("expected SHA256:new, got %q", fingerprint)
+	}
+
+	if err := knownHosts.Remove("5.6.7.8:2376"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := knownHosts.Lookup("5.6.7.8:2376"); ok {
+		t.Error("expected the host to be removed")
+	}
+
+	data, err := ioutil.ReadFile(knownHosts.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(data), "# Managed by deploy\n") {
+		t.Errorf("expected the comment to be kept, got %q", data)
+	}
+}
+
+func TestKnownHostsConcurrentChanges(t *testing.T) {
+	knownHosts := newTestKnownHosts(t)
+	defer os.RemoveAll(path.Dir(path.Dir(knownHosts.Path)))
+
+	for i := 0; i < 10; i++ {
+		if err := knownHosts.Set(fmt.Sprintf("10.0.0.%d:2376", i), "SHA256:old"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Each goroutine has its own KnownHosts, like the workers of a fan-out.
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			host := fmt.Sprintf("1.2.3.%d:2376", i)
+			if err := NewKnownHosts(knownHosts.Path).Verify(host, [][]byte{[]byte(host)}); err != nil {
+				t.Error(err)
+			}
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+			if err := NewKnownHosts(knownHosts.Path).Remove(fmt.Sprintf("10.0.0.%d:2376", i)); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	entries, err := knownHosts.read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 10 {
+		t.Fatalf("expected the 10 new hosts and none of the old ones, got %q", entries)
+	}
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry[0], "1.2.3.") {
+			t.Errorf("expected %s to be removed", entry[0])
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package tlsconfig
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"github.com/bbbacsa/deploy.io/utils"
+	"github.com/bbbacsa/deploy.io/vendor/crypto/tls"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+)
+
+// How long a stored session is offered for resumption. Hosts stop accepting
+// tickets long before this, but there's no point keeping them forever.
+var SessionTTL = 24 * time.Hour
+
+// FileSessionCache is a tls.ClientSessionCache that keeps sessions in files,
+// so that one 'deploy' command can resume a session negotiated by another
+// instead of paying for a full handshake.
+//
+// Each file contains a session's master secret, so the directory is created
+// 0700, files are written 0600, and files readable by anyone else are
+// ignored.
+type FileSessionCache struct {
+	Dir string
+	TTL time.Duration
+
+	// Namespace is mixed into file names so that sessions negotiated with
+	// one client certificate are never offered with another.
+	Namespace string
+
+	// Stderr is where the cache warns about files it ignores.
+	Stderr io.Writer
+}
+
+func NewFileSessionCache(dir, namespace string, ttl time.Duration, stderr io.Writer) (*FileSessionCache, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &FileSessionCache{Dir: dir, TTL: ttl, Namespace: namespace, Stderr: stderr}, nil
+}
+
+// GetSessionDir returns the directory sessions are stored in.
+func GetSessionDir() string {
+	return path.Join(os.Getenv("HOME"), ".deploy", "sessions")
+}
+
+func (c *FileSessionCache) Get(sessionKey string) (*tls.ClientSessionState, bool) {
+	filename := c.path(sessionKey)
+
+	info, err := os.Stat(filename)
+	if err != nil {
+		return nil, false
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		fmt.Fprintf(c.Stderr, "Warning: ignoring TLS session cache file %s, which is accessible by other users\n", filename)
+		return nil, false
+	}
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil || len(data) < 8 {
+		return nil, false
+	}
+
+	created := time.Unix(int64(binary.BigEndian.Uint64(data[:8])), 0)
+	if time.Since(created) > c.TTL {
+		os.Remove(filename)
+		return nil, false
+	}
+
+	session := new(tls.ClientSessionState)
+	if err := session.UnmarshalBinary(data[8:]); err != nil {
+		os.Remove(filename)
+		return nil, false
+	}
+
+	return session, true
+}
+
+func (c *FileSessionCache) Put(sessionKey string, cs *tls.ClientSessionState) {
+	filename := c.path(sessionKey)
+
+	if cs == nil {
+		os.Remove(filename)
+		return
+	}
+
+	serialized, err := cs.MarshalBinary()
+	if err != nil {
+		return
+	}
+
+	data := make([]byte, 8+len(serialized))
+	binary.BigEndian.PutUint64(data[:8], uint64(time.Now().Unix()))
+	copy(data[8:], serialized)
+
+	utils.WriteFileAtomic(filename, data, 0600)
+}
+
+// Prune removes every expired session.
+func (c *FileSessionCache) Prune() error {
+	entries, err := ioutil.ReadDir(c.Dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if time.Since(entry.ModTime()) > c.TTL {
+			os.Remove(path.Join(c.Dir, entry.Name()))
+		}
+	}
+	return nil
+}
+
+func (c *FileSessionCache) path(sessionKey string) string {
+	h := sha256.New()
+	h.Write([]byte(c.Namespace))
+	h.Write([]byte{0})
+	h.Write([]byte(sessionKey))
+	return path.Join(c.Dir, fmt.Sprintf("%x", h.Sum(nil)))
+}
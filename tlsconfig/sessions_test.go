@@ -0,0 +1,80 @@
+package tlsconfig
+
+import (
+	"github.com/bbbacsa/deploy.io/vendor/crypto/tls"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func newTestSessionCache(t *testing.T, ttl time.Duration) *FileSessionCache {
+	dir, err := ioutil.TempDir("", "deploy-sessions-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache, err := NewFileSessionCache(dir, "client-cert", ttl, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cache
+}
+
+func TestFileSessionCacheRoundTrip(t *testing.T) {
+	cache := newTestSessionCache(t, time.Hour)
+	defer os.RemoveAll(cache.Dir)
+
+	if _, ok := cache.Get("1.2.3.4:2376"); ok {
+		t.Fatal("expected an empty cache")
+	}
+
+	cache.Put("1.2.3.4:2376", new(tls.ClientSessionState))
+
+	if _, ok := cache.Get("1.2.3.4:2376"); !ok {
+		t.Error("expected to find the session that was put")
+	}
+
+	info, err := os.Stat(cache.path("1.2.3.4:2376"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("expected session file to be 0600, got %o", info.Mode().Perm())
+	}
+
+	other := &FileSessionCache{Dir: cache.Dir, TTL: time.Hour, Namespace: "another-cert", Stderr: ioutil.Discard}
+	if _, ok := other.Get("1.2.3.4:2376"); ok {
+		t.Error("expected a session not to be shared between client certificates")
+	}
+
+	cache.Put("1.2.3.4:2376", nil)
+	if _, ok := cache.Get("1.2.3.4:2376"); ok {
+		t.Error("expected putting nil to remove the session")
+	}
+}
+
+func TestFileSessionCacheExpiry(t *testing.T) {
+	cache := newTestSessionCache(t, -time.Second)
+	defer os.RemoveAll(cache.Dir)
+
+	cache.Put("1.2.3.4:2376", new(tls.ClientSessionState))
+
+	if _, ok := cache.Get("1.2.3.4:2376"); ok {
+		t.Error("expected an expired session to be ignored")
+	}
+	if _, err := os.Stat(cache.path("1.2.3.4:2376")); !os.IsNotExist(err) {
+		t.Error("expected an expired session to be removed")
+	}
+}
+
+func TestFileSessionCacheIgnoresReadableFiles(t *testing.T) {
+	cache := newTestSessionCache(t, time.Hour)
+	defer os.RemoveAll(cache.Dir)
+
+	cache.Put("1.2.3.4:2376", new(tls.ClientSessionState))
+	os.Chmod(cache.path("1.2.3.4:2376"), 0644)
+
+	if _, ok := cache.Get("1.2.3.4:2376"); ok {
+		t.Error("expected a world-readable session file to be ignored")
+	}
+}
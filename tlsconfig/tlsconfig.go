@@ -1,61 +1,152 @@
 package tlsconfig
 
 import (
-	"crypto/x509"
+	"crypto/sha256"
+	"fmt"
+	"github.com/bbbacsa/deploy.io/api"
+	"github.com/bbbacsa/deploy.io/trust"
 	"github.com/bbbacsa/deploy.io/vendor/crypto/tls"
-	"io/ioutil"
+	"io"
+	"net"
+	"net/url"
 	"os"
+	"strings"
+	"sync"
 )
 
-func GetTLSConfig(clientCertPEMData, clientKeyPEMData []byte) (*tls.Config, error) {
-	certPool := x509.NewCertPool()
+// Options says how GetTLSConfig connects to hosts.
+type Options struct {
+	// Keys decrypts client keys that are encrypted.
+	Keys *Keys
 
-	certChainPath := os.Getenv("DEPLOY_HOST_CA")
-	if certChainPath != "" {
-		certChainData, err := ioutil.ReadFile(certChainPath)
+	// Stderr is where warnings, e.g. about certificates that expire soon,
+	// are written.
+	Stderr io.Writer
+
+	// DebugKeyLog makes GetTLSConfig write the secrets of every TLS session
+	// to the file named by SSLKEYLOGFILE, so that tools like Wireshark can
+	// decrypt captures of them. It's set by the --debug-tls flag, and must
+	// never be on by default: anyone who can read the file can read the
+	// sessions.
+	DebugKeyLog bool
+}
+
+// Expired sessions are cleared out the first time GetTLSConfig is called,
+// rather than every time.
+var pruneSessions sync.Once
+
+var (
+	keyLogOnce   sync.Once
+	keyLogWriter io.Writer
+	keyLogErr    error
+)
+
+// openKeyLog opens SSLKEYLOGFILE for appending, warning that it's been
+// enabled on stderr. It's only opened once per process.
+func openKeyLog(stderr io.Writer) (io.Writer, error) {
+	keyLogOnce.Do(func() {
+		keyLogPath := os.Getenv("SSLKEYLOGFILE")
+		if keyLogPath == "" {
+			keyLogErr = fmt.Errorf("--debug-tls needs SSLKEYLOGFILE to be set to the file to write TLS secrets to")
+			return
+		}
+
+		f, err := os.OpenFile(keyLogPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
 		if err != nil {
-			return nil, err
+			keyLogErr = err
+			return
 		}
-		certPool.AppendCertsFromPEM(certChainData)
-	} else {
-		certPool.AppendCertsFromPEM([]byte(deployCerts))
+		keyLogWriter = f
+
+		fmt.Fprintf(stderr, "WARNING: Writing TLS secrets to %s\n", keyLogPath)
+		fmt.Fprintf(stderr, "WARNING: Anyone with this file can decrypt your traffic to your hosts. Delete it when you're done debugging.\n")
+	})
+	return keyLogWriter, keyLogErr
+}
+
+// ServerName returns the name a host's certificate is verified against, and
+// which is sent in SNI so that a shared TLS front end can route to the host:
+// the hostname in the host's URL if it has one, or else its IP address.
+func ServerName(host *api.Host) string {
+	if host.URL != "" {
+		rawURL := host.URL
+		if !strings.Contains(rawURL, "://") {
+			rawURL = "//" + rawURL
+		}
+		if u, err := url.Parse(rawURL); err == nil && u.Host != "" {
+			if name, _, err := net.SplitHostPort(u.Host); err == nil {
+				return name
+			}
+			return u.Host
+		}
+	}
+	return host.IPAddress
+}
+
+// clientKeyPair returns the PEM encoded client certificate and key to
+// connect to host with.
+func clientKeyPair(host *api.Host, stderr io.Writer) ([]byte, []byte, error) {
+	// Prefer a key we generated ourselves, since the server never saw it.
+	if host.ID != "" {
+		certPEMData, keyPEMData, ok, err := NewCertStore(GetCertDir(), stderr).Load(host.ID)
+		if err != nil {
+			return nil, nil, err
+		}
+		if ok {
+			return certPEMData, keyPEMData, nil
+		}
+	}
+	return []byte(host.ClientCert), []byte(host.ClientKey), nil
+}
+
+// LoadClientCertificate loads the client certificate to connect to host
+// with, using options.Keys to decrypt its key if it's encrypted.
+func LoadClientCertificate(host *api.Host, options *Options) (tls.Certificate, error) {
+	clientCertPEMData, clientKeyPEMData, err := clientKeyPair(host, options.Stderr)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return options.Keys.LoadKeyPair(clientCertPEMData, clientKeyPEMData)
+}
+
+func GetTLSConfig(host *api.Host, options *Options) (*tls.Config, error) {
+	clientCertPEMData, clientKeyPEMData, err := clientKeyPair(host, options.Stderr)
+	if err != nil {
+		return nil, err
+	}
+
+	bundle, err := trust.ForHost(host.Name, host.CACert)
+	if err != nil {
+		return nil, err
 	}
 
-	clientCert, err := tls.X509KeyPair(clientCertPEMData, clientKeyPEMData)
+	warnExpiring(options.Stderr, bundle, clientCertPEMData, host.Name)
+
+	clientCert, err := options.Keys.LoadKeyPair(clientCertPEMData, clientKeyPEMData)
 	if err != nil {
 		return nil, err
 	}
 
 	config := new(tls.Config)
-	config.RootCAs = certPool
+	config.RootCAs = bundle.Pool()
 	config.Certificates = []tls.Certificate{clientCert}
 	config.BuildNameToCertificate()
+	config.ServerName = ServerName(host)
+
+	if options.DebugKeyLog {
+		config.KeyLogWriter, err = openKeyLog(options.Stderr)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sessionCache, err := NewFileSessionCache(GetSessionDir(), fmt.Sprintf("%x", sha256.Sum256(clientCertPEMData)), SessionTTL, options.Stderr)
+	if err == nil {
+		pruneSessions.Do(func() { sessionCache.Prune() })
+		config.ClientSessionCache = sessionCache
+	} else {
+		config.ClientSessionCache = tls.NewLRUClientSessionCache(0)
+	}
 
 	return config, nil
 }
-
-var deployCerts string = `-----BEGIN CERTIFICATE-----
-MIIEKTCCAxGgAwIBAgIJAP81C5xoXHunMA0GCSqGSIb3DQEBCwUAMIGqMQswCQYD
-VQQGEwJQSDEPMA0GA1UECAwGTGFndW5hMRAwDgYDVQQHDAdDYWxhbWJhMS4wLAYD
-VQQKDCVCcnljaGVUZWNoIEludGVybmV0IFNvbHV0aW9ucyBDb21wYW55MQwwCgYD
-VQQLDANEZXYxGDAWBgNVBAMMDzEwNC4xMzEuMTU4LjEyNDEgMB4GCSqGSIb3DQEJ
-ARYRYmJiYWNzYUBnbWFpbC5jb20wHhcNMTQxMTEwMDUyMzU5WhcNMTUxMTEwMDUy
-MzU5WjCBqjELMAkGA1UEBhMCUEgxDzANBgNVBAgMBkxhZ3VuYTEQMA4GA1UEBwwH
-Q2FsYW1iYTEuMCwGA1UECgwlQnJ5Y2hlVGVjaCBJbnRlcm5ldCBTb2x1dGlvbnMg
-Q29tcGFueTEMMAoGA1UECwwDRGV2MRgwFgYDVQQDDA8xMDQuMTMxLjE1OC4xMjQx
-IDAeBgkqhkiG9w0BCQEWEWJiYmFjc2FAZ21haWwuY29tMIIBIjANBgkqhkiG9w0B
-AQEFAAOCAQ8AMIIBCgKCAQEAzWBb0yQS5ca0dQWhsrPdFcsfUGazhJ8EXM+2Np5s
-bj7wiT06TSunB+ME1Aj61KKxb9gI1QSW8LJy9Xp/1R1r7SWJ5VAAb8oSXP92w0Dk
-ph8MXPl1x8K3B22hJk0jiIADdS09AG30cp7osW6uqz7ARgsQh4khh2DohaB0zM1t
-9uLrDgUdP9BAVlFVRSYpfKMBPZ5PfmKmYod9GYOA9/Nxs44N/PhmvFMI42cVoL88
-YFZ3x/U7Iu495Hri9fJ1roHAh7Z7nGL3sD/iGd3bGXOeDztXWiqp59qSFUyvOuyC
-K/paZnz5izBlaz6Zir+M+zMcjAh4qvccfWyRlNZWFtAONwIDAQABo1AwTjAdBgNV
-HQ4EFgQUSBE1/wLJOO3R2TFs8katsJy9B+0wHwYDVR0jBBgwFoAUSBE1/wLJOO3R
-2TFs8katsJy9B+0wDAYDVR0TBAUwAwEB/zANBgkqhkiG9w0BAQsFAAOCAQEATZbL
-PdPIH8ahQpGdtTb0shcxOYcuLcrn67kxEzeOkXcOsmHhw8RdWkQiglMPBwdyi0Xj
-8yY9ri1Jv1jC/swAAmtsB6qd+oxJaiVn2G+okVX2xXaLCQROwfIcNEnwVxUXyNwG
-hMZEiNT1kymy8MI5FwQqZ4hvbbUqcMSrB2O1z5C8zwDL2eXm8LjrmRkRpb+pP9fX
-kwYPbQO4v0v4PKge2ezhWc4u0WFN3Zg68XS2YB5anKQzK1heFiB79mbHyRKF+t9c
-F4Un6peNMm7WBxup68KTBCQb6lK6jhtTUvVirMCjwaXUQOHOrRT9QzoBrfgJm0OJ
-gCAxbCdK3lcDQKxC8Q==
------END CERTIFICATE-----`
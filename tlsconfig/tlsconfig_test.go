@@ -0,0 +1,27 @@
+package tlsconfig
+
+import (
+	"github.com/bbbacsa/deploy.io/api"
+	"testing"
+)
+
+func TestServerName(t *testing.T) {
+	tests := []struct {
+		url      string
+		expected string
+	}{
+		{"", "1.2.3.4"},
+		{"tcp://myhost.deploy.io:2376", "myhost.deploy.io"},
+		{"https://myhost.deploy.io", "myhost.deploy.io"},
+		{"myhost.deploy.io", "myhost.deploy.io"},
+		{"myhost.deploy.io:2376", "myhost.deploy.io"},
+		{"tcp://[::1]:2376", "::1"},
+	}
+
+	for _, test := range tests {
+		host := &api.Host{URL: test.url, IPAddress: "1.2.3.4"}
+		if name := ServerName(host); name != test.expected {
+			t.Errorf("URL %q: expected %q, got %q", test.url, test.expected, name)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+// Package trust decides which certificate authorities deploy trusts, for
+// connections to hosts and to the API alike.
+//
+// CA certificates come from:
+//
+//   - the Deploy.IO CA, which is built in, unless DEPLOY_HOST_CA is set
+//   - the system roots, for the API only
+//   - every *.pem and *.crt file in ~/.deploy/ca
+//   - the files listed in DEPLOY_CA_BUNDLE, and the file DEPLOY_HOST_CA
+//   - the CA the API says a host's certificate is signed by, for that host
+//     only
+//
+// Apart from DEPLOY_HOST_CA, which replaces the built in CA as it always
+// has, each source adds to the others rather than replacing them, so a
+// TLS-inspecting proxy's CA can be trusted without losing the Deploy.IO one.
+package trust
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// builtIn is the Source of the Deploy.IO CA.
+const builtIn = "built in"
+
+// Entry is a CA certificate, and where it came from.
+type Entry struct {
+	Cert   *x509.Certificate
+	Source string
+
+	// Host, if it's set, is the only host the CA is trusted for: the one
+	// the API delivered it with.
+	Host string
+}
+
+// BuiltIn returns whether the entry is the built in Deploy.IO CA.
+func (e Entry) BuiltIn() bool {
+	return e.Source == builtIn
+}
+
+// Bundle is a set of CA certificates.
+type Bundle struct {
+	Entries []Entry
+
+	// System is whether the system roots are trusted too. They're not in
+	// Entries, since not every platform can list them.
+	System bool
+
+	// Host is the host the bundle is for, if it's for one. CAs pinned to
+	// any other host are left out of its pool.
+	Host string
+}
+
+// GetCADir returns the directory extra CA bundles are read from.
+func GetCADir() string {
+	return path.Join(os.Getenv("HOME"), ".deploy", "ca")
+}
+
+// Load returns the CA certificates both hosts and the API are trusted by:
+// the Deploy.IO CA, and any extra bundles.
+func Load() (*Bundle, error) {
+	bundle := new(Bundle)
+	if os.Getenv("DEPLOY_HOST_CA") == "" {
+		if err := bundle.AddPEM([]byte(deployCA), builtIn); err != nil {
+			return nil, err
+		}
+	}
+
+	filenames, err := ioutil.ReadDir(GetCADir())
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, info := range filenames {
+		if ext := path.Ext(info.Name()); info.IsDir() || (ext != ".pem" && ext != ".crt") {
+			continue
+		}
+		filename := path.Join(GetCADir(), info.Name())
+		if err := bundle.AddFile(filename, filename); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, filename := range filepath.SplitList(os.Getenv("DEPLOY_CA_BUNDLE")) {
+		if filename == "" {
+			continue
+		}
+		if err := bundle.AddFile(filename, "$DEPLOY_CA_BUNDLE "+filename); err != nil {
+			return nil, err
+		}
+	}
+
+	if filename := os.Getenv("DEPLOY_HOST_CA"); filename != "" {
+		if err := bundle.AddFile(filename, "$DEPLOY_HOST_CA "+filename); err != nil {
+			return nil, err
+		}
+	}
+
+	return bundle, nil
+}
+
+// ForHost returns the CA certificates a host's certificate is checked
+// against: those from Load, and caPEMData, the CA the API delivered for the
+// host, if any. System roots aren't included, since they have no business
+// signing certificates for hosts.
+func ForHost(hostName, caPEMData string) (*Bundle, error) {
+	bundle, err := Load()
+	if err != nil {
+		return nil, err
+	}
+	bundle.Host = hostName
+	if strings.TrimSpace(caPEMData) != "" {
+		if err := bundle.AddHostPEM([]byte(caPEMData), hostName); err != nil {
+			return nil, err
+		}
+	}
+	return bundle, nil
+}
+
+// ForAPI returns the CA certificates the API's certificate is checked
+// against: the system roots, and those from Load.
+func ForAPI() (*Bundle, error) {
+	bundle, err := Load()
+	if err != nil {
+		return nil, err
+	}
+	bundle.System = true
+	return bundle, nil
+}
+
+// AddPEM adds every certificate in pemData. It's an error for there to be
+// none.
+func (b *Bundle) AddPEM(pemData []byte, source string) error {
+	return b.addPEM(pemData, source, "")
+}
+
+// AddHostPEM adds every certificate in pemData, the CA the API delivered for
+// a host, pinned to that host.
+func (b *Bundle) AddHostPEM(pemData []byte, hostName string) error {
+	return b.addPEM(pemData, fmt.Sprintf("host '%s'", hostName), hostName)
+}
+
+func (b *Bundle) addPEM(pemData []byte, source, hostName string) error {
+	added := false
+	for {
+		var block *pem.Block
+		block, pemData = pem.Decode(pemData)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return fmt.Errorf("Couldn't parse a CA certificate from %s: %s", source, err)
+		}
+		b.Entries = append(b.Entries, Entry{Cert: cert, Source: source, Host: hostName})
+		added = true
+	}
+	if !added {
+		return fmt.Errorf("No CA certificates found in %s", source)
+	}
+	return nil
+}
+
+// AddFile adds every certificate in a PEM file.
+func (b *Bundle) AddFile(filename, source string) error {
+	pemData, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	return b.AddPEM(pemData, source)
+}
+
+// Certificates returns the certificates in Entries.
+func (b *Bundle) Certificates() []*x509.Certificate {
+	certs := make([]*x509.Certificate, len(b.Entries))
+	for i, entry := range b.Entries {
+		certs[i] = entry.Cert
+	}
+	return certs
+}
+
+// Pool returns a pool of the bundle's certificates, for tls.Config.RootCAs.
+// CAs pinned to a host are only in the pool of that host's bundle.
+func (b *Bundle) Pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	if b.System {
+		if systemPool, err := x509.SystemCertPool(); err == nil {
+			pool = systemPool
+		}
+	}
+	for _, entry := range b.Entries {
+		if entry.Host != "" && entry.Host != b.Host {
+			continue
+		}
+		pool.AddCert(entry.Cert)
+	}
+	return pool
+}
@@ -0,0 +1,142 @@
+package trust
+
+import (
+	"crypto/x509"
+	"github.com/bbbacsa/deploy.io/dockertest"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func newTestCA(t *testing.T, commonName string) []byte {
+	ca, err := dockertest.NewCA(commonName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ca.PEM
+}
+
+func TestSourcesAddUp(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deploy-trust-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	caDir := path.Join(dir, ".deploy", "ca")
+	if err := os.MkdirAll(caDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{
+		path.Join(caDir, "corporate.pem"): newTestCA(t, "Corporate CA"),
+		path.Join(caDir, "README"):        []byte("not a certificate"),
+		path.Join(dir, "bundle.pem"):      newTestCA(t, "Bundle CA"),
+		path.Join(dir, "host-ca.pem"):     newTestCA(t, "Host CA"),
+	}
+	for filename, data := range files {
+		if err := ioutil.WriteFile(filename, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Setenv("HOME", dir)
+	t.Setenv("DEPLOY_CA_BUNDLE", path.Join(dir, "bundle.pem"))
+	t.Setenv("DEPLOY_HOST_CA", path.Join(dir, "host-ca.pem"))
+
+	bundle, err := ForHost("web", string(newTestCA(t, "Delivered CA")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bundle.System {
+		t.Error("expected hosts not to be checked against the system roots")
+	}
+
+	expected := []struct {
+		commonName string
+		source     string
+	}{
+		{"Corporate CA", path.Join(caDir, "corporate.pem")},
+		{"Bundle CA", "$DEPLOY_CA_BUNDLE " + path.Join(dir, "bundle.pem")},
+		{"Host CA", "$DEPLOY_HOST_CA " + path.Join(dir, "host-ca.pem")},
+		{"Delivered CA", "host 'web'"},
+	}
+	if len(bundle.Entries) != len(expected) {
+		t.Fatalf("expected %d certificates, got %d", len(expected), len(bundle.Entries))
+	}
+	for i, entry := range bundle.Entries {
+		if entry.Cert.Subject.CommonName != expected[i].commonName || entry.Source != expected[i].source {
+			t.Errorf("expected %q from %q, got %q from %q", expected[i].commonName, expected[i].source, entry.Cert.Subject.CommonName, entry.Source)
+		}
+	}
+
+	apiBundle, err := ForAPI()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !apiBundle.System {
+		t.Error("expected the API to be checked against the system roots")
+	}
+	if len(apiBundle.Entries) != len(expected)-1 {
+		t.Errorf("expected %d certificates, got %d", len(expected)-1, len(apiBundle.Entries))
+	}
+}
+
+func TestHostCAReplacesBuiltIn(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deploy-trust-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	t.Setenv("HOME", dir)
+	t.Setenv("DEPLOY_CA_BUNDLE", "")
+	t.Setenv("DEPLOY_HOST_CA", "")
+
+	bundle, err := Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bundle.Entries) != 1 || !bundle.Entries[0].BuiltIn() {
+		t.Fatalf("expected just the built in CA, got %d certificates", len(bundle.Entries))
+	}
+
+	hostCA := path.Join(dir, "host-ca.pem")
+	if err := ioutil.WriteFile(hostCA, newTestCA(t, "Host CA"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("DEPLOY_HOST_CA", hostCA)
+	bundle, err = Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bundle.Entries) != 1 || bundle.Entries[0].Cert.Subject.CommonName != "Host CA" {
+		t.Fatalf("expected just the DEPLOY_HOST_CA certificate, got %d certificates", len(bundle.Entries))
+	}
+}
+
+func TestHostCAsArePinned(t *testing.T) {
+	bundle := &Bundle{Host: "web"}
+	certs := map[string]*x509.Certificate{}
+	for _, hostName := range []string{"web", "db"} {
+		pemData := newTestCA(t, hostName+" CA")
+		if err := bundle.AddHostPEM(pemData, hostName); err != nil {
+			t.Fatal(err)
+		}
+		certs[hostName] = bundle.Entries[len(bundle.Entries)-1].Cert
+	}
+
+	pool := bundle.Pool()
+	if _, err := certs["web"].Verify(x509.VerifyOptions{Roots: pool}); err != nil {
+		t.Errorf("expected web's CA to be trusted for web, got %s", err)
+	}
+	if _, err := certs["db"].Verify(x509.VerifyOptions{Roots: pool}); err == nil {
+		t.Error("expected db's CA not to be trusted for web")
+	}
+}
+
+func TestAddPEMWithoutCertificates(t *testing.T) {
+	bundle := new(Bundle)
+	if err := bundle.AddPEM([]byte("not a certificate"), "test"); err == nil {
+		t.Error("expected an error")
+	}
+}
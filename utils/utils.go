@@ -2,9 +2,13 @@ package utils
 
 import (
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 )
 
 func Capitalize(str string) string {
@@ -21,6 +25,30 @@ func HumanSize(size int64) string {
 	return fmt.Sprintf("%d%s", size, units[i])
 }
 
+// Formats a duration the way 'docker ps' does, e.g. "3 minutes" or "About an hour".
+func HumanDuration(d time.Duration) string {
+	if seconds := int(d.Seconds()); seconds < 1 {
+		return "Less than a second"
+	} else if seconds < 60 {
+		return fmt.Sprintf("%d seconds", seconds)
+	} else if minutes := int(d.Minutes()); minutes == 1 {
+		return "About a minute"
+	} else if minutes < 60 {
+		return fmt.Sprintf("%d minutes", minutes)
+	} else if hours := int(d.Hours()); hours == 1 {
+		return "About an hour"
+	} else if hours < 48 {
+		return fmt.Sprintf("%d hours", hours)
+	} else if hours < 24*7*2 {
+		return fmt.Sprintf("%d days", hours/24)
+	} else if hours < 24*30*3 {
+		return fmt.Sprintf("%d weeks", hours/24/7)
+	} else if hours < 24*365*2 {
+		return fmt.Sprintf("%d months", hours/24/30)
+	}
+	return fmt.Sprintf("%d years", int(d.Hours())/24/365)
+}
+
 // Parses a human-readable string representing an amount of RAM
 // in bytes, kibibytes, mebibytes or gibibytes, and returns the
 // number of bytes, or -1 if the string is unparseable.
@@ -54,3 +82,27 @@ func RAMInBytes(size string) (bytes int64, err error) {
 
 	return memLimit, nil
 }
+
+// Writes data to filename by renaming a temporary file with the given
+// permissions over it, so that commands reading the file at the same time
+// never see half of it.
+func WriteFileAtomic(filename string, data []byte, perm os.FileMode) error {
+	tmp, err := ioutil.TempFile(path.Dir(filename), "."+path.Base(filename))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}